@@ -6,6 +6,10 @@ type ReturnedData struct {
 	// It should be "ok" is everything goes fine
 	Status string `json:"status" `
 
+	// The stable error code, see errors.go. The frontend should switch on it rather than on the status.
+	// It is omitted on success
+	Code Code `json:"code,omitempty"`
+
 	// Anything you want to pass to the frontend, but make it simple and necessary
 	// If there's nothing to return, this field will be omitted
 	Data interface{} `json:"data,omitempty"`
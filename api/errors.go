@@ -0,0 +1,310 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	ZhCN = "zh-CN"
+	EnUS = "en-US"
+
+	DefaultLanguage = EnUS
+)
+
+// Code is a stable, machine-readable error code. The frontend should switch on it, never on the message.
+type Code string
+
+const (
+	// Requests
+	InvalidRequest  Code = "invalid_request"
+	InvalidID       Code = "invalid_id"
+	InternalError   Code = "internal_error"
+	DBError         Code = "db_error"
+	TokenError      Code = "token_error"
+	MailServerError Code = "mail_server_error"
+
+	// Authentication
+	NotLoggedIn         Code = "not_logged_in"
+	InvalidToken        Code = "invalid_token"
+	InvalidAPIKey       Code = "invalid_api_key"
+	APIKeyNotAllowed    Code = "api_key_not_allowed"
+	PermissionDenied    Code = "permission_denied"
+	TooManyAttempts     Code = "too_many_attempts"
+	EmailNotFound       Code = "email_not_found"
+	WrongAuthCode       Code = "wrong_auth_code"
+	WrongPassword       Code = "wrong_password"
+	WrongPasswordOrTOTP Code = "wrong_password_or_totp"
+	PasswordRejected    Code = "password_rejected"
+	PasswordExpired     Code = "password_expired"
+	PasswordAlreadySet  Code = "password_already_set"
+	AccountDisabled     Code = "account_disabled"
+	InvalidChallenge    Code = "invalid_challenge"
+	InvalidRefreshToken Code = "invalid_refresh_token"
+	RefreshTokenExpired Code = "refresh_token_expired"
+	SessionNotFound     Code = "session_not_found"
+
+	// TOTP
+	TOTPRequired       Code = "totp_required"
+	TOTPCodeRequired   Code = "totp_code_required"
+	WrongTOTPCode      Code = "wrong_totp_code"
+	TOTPAlreadyEnabled Code = "totp_already_enabled"
+	TOTPNotEnabled     Code = "totp_not_enabled"
+	TOTPNotStarted     Code = "totp_not_started"
+
+	// Single sign-on
+	SSORequired           Code = "sso_required"
+	SSONotConfigured      Code = "sso_not_configured"
+	SSOStaffOnly          Code = "sso_staff_only"
+	IdPUnavailable        Code = "idp_unavailable"
+	IdPRefused            Code = "idp_refused"
+	InvalidIDToken        Code = "invalid_id_token"
+	InvalidLogin          Code = "invalid_login"
+	VerifiedEmailRequired Code = "verified_email_required"
+	IdentityConflict      Code = "identity_conflict"
+
+	// Accounts
+	AccountNotFound        Code = "account_not_found"
+	AccountOccupied        Code = "account_occupied"
+	InvalidEmail           Code = "invalid_email"
+	InvalidAccountType     Code = "invalid_account_type"
+	InvalidBirthday        Code = "invalid_birthday"
+	InvalidDepartment      Code = "invalid_department"
+	InvalidField           Code = "invalid_field"
+	CannotModifySelf       Code = "cannot_modify_self"
+	AccountHasRecords      Code = "account_has_records"
+	EmailNotVerified       Code = "email_not_verified"
+	EmailAlreadyVerified   Code = "email_already_verified"
+	NoPendingEmailChange   Code = "no_pending_email_change"
+	DoctorNotFound         Code = "doctor_not_found"
+	DoctorNotApproved      Code = "doctor_not_approved"
+	CredentialNotFound     Code = "credential_not_found"
+	InvalidFileType        Code = "invalid_file_type"
+	FileTooLarge           Code = "file_too_large"
+	ProfileChangeNotFound  Code = "profile_change_not_found"
+	ProfileChangeReviewed  Code = "profile_change_reviewed"
+	ProfileChangeConflict  Code = "profile_change_conflict"
+	ErasureNotFound        Code = "erasure_not_found"
+	ErasureRequested       Code = "erasure_requested"
+	ErasureReviewed        Code = "erasure_reviewed"
+	InvalidCSV             Code = "invalid_csv"
+	InvalidRows            Code = "invalid_rows"
+	ServiceAccountNotFound Code = "service_account_not_found"
+	APIKeyNotFound         Code = "api_key_not_found"
+	NameOccupied           Code = "name_occupied"
+	InvalidScope           Code = "invalid_scope"
+
+	// Patients and delegations
+	PatientNotFound         Code = "patient_not_found"
+	NotAPatient             Code = "not_a_patient"
+	ProfileNotFound         Code = "profile_not_found"
+	NotAManagedProfile      Code = "not_a_managed_profile"
+	AlreadyDelegated        Code = "already_delegated"
+	DelegationNotFound      Code = "delegation_not_found"
+	LastOwner               Code = "last_owner"
+	InvalidNationalID       Code = "invalid_national_id"
+	NationalIDTaken         Code = "national_id_taken"
+	InvalidInsuranceNumber  Code = "invalid_insurance_number"
+	InsuranceNumberTaken    Code = "insurance_number_taken"
+	MergeTargetNotFound     Code = "merge_target_not_found"
+	PatientsNotMergeable    Code = "patients_not_mergeable"
+	AllergyNotFound         Code = "allergy_not_found"
+	AllergyTargetRequired   Code = "allergy_target_required"
+	MedicineNotFound        Code = "medicine_not_found"
+	CaseFinished            Code = "case_finished"
+	PrescriptionCaseChanged Code = "prescription_case_changed"
+	CaseNotFound            Code = "case_not_found"
+	CaseDeleted             Code = "case_deleted"
+	PrescriptionNotFound    Code = "prescription_not_found"
+	RetentionNotElapsed     Code = "retention_not_elapsed"
+	ReasonRequired          Code = "reason_required"
+	RevisionNotFound        Code = "revision_not_found"
+	SearchQueryRequired     Code = "search_query_required"
+	PrescriptionWarnings    Code = "prescription_warnings"
+	PrescriptionBlocked     Code = "prescription_blocked"
+
+	// Registrations
+	SearchFailed             Code = "search_failed"
+	DepartmentNotFound       Code = "department_not_found"
+	RegistrationNotFound     Code = "registration_not_found"
+	RegistrationFailed       Code = "registration_failed"
+	InvalidSchedule          Code = "invalid_schedule"
+	NotEnoughCapacity        Code = "not_enough_capacity"
+	CannotAssignDoctor       Code = "cannot_assign_doctor"
+	RegistrationUpdateFailed Code = "registration_update_failed"
+	TerminatedCauseRequired  Code = "terminated_cause_required"
+	MileStoneNotFound        Code = "milestone_not_found"
+	MileStoneFailed          Code = "milestone_failed"
+	ChatStartFailed          Code = "chat_start_failed"
+	UpgradeFailed            Code = "upgrade_failed"
+)
+
+type entry struct {
+	status int
+	en     string
+	zh     string
+}
+
+var catalog = map[Code]entry{
+	InvalidRequest:  {http.StatusBadRequest, "Invalid request", "请求参数错误"},
+	InvalidID:       {http.StatusBadRequest, "Invalid ID", "ID 无效"},
+	InternalError:   {http.StatusInternalServerError, "Internal server error", "服务器内部错误"},
+	DBError:         {http.StatusInternalServerError, "DB error", "数据库错误"},
+	TokenError:      {http.StatusInternalServerError, "Failed to generate token", "令牌生成失败"},
+	MailServerError: {http.StatusInternalServerError, "Email server error", "邮件服务器错误"},
+
+	NotLoggedIn:         {http.StatusBadRequest, "Not logged in", "未登录"},
+	InvalidToken:        {http.StatusForbidden, "Failed to get id from token", "令牌无效"},
+	InvalidAPIKey:       {http.StatusForbidden, "Failed to get id from API key", "API 密钥无效"},
+	APIKeyNotAllowed:    {http.StatusForbidden, "API keys not allowed here", "此处不允许使用 API 密钥"},
+	PermissionDenied:    {http.StatusForbidden, "Permission denied", "无权操作"},
+	TooManyAttempts:     {http.StatusTooManyRequests, "Too many attempts", "尝试次数过多，请稍后再试"},
+	EmailNotFound:       {http.StatusBadRequest, "E-Mail not found", "邮箱不存在"},
+	WrongAuthCode:       {http.StatusBadRequest, "Wrong or expired AuthCode", "验证码错误或已过期"},
+	WrongPassword:       {http.StatusBadRequest, "Wrong Password", "密码错误"},
+	WrongPasswordOrTOTP: {http.StatusBadRequest, "Wrong Password or TOTP code", "密码或动态口令错误"},
+	PasswordRejected:    {http.StatusBadRequest, "Password rejected", "密码不符合要求"},
+	PasswordExpired:     {http.StatusForbidden, "Password expired", "密码已过期"},
+	PasswordAlreadySet:  {http.StatusBadRequest, "Account already has a password", "账户已设置密码"},
+	AccountDisabled:     {http.StatusForbidden, "Account disabled", "账户已停用"},
+	InvalidChallenge:    {http.StatusUnauthorized, "Invalid challenge", "登录验证无效"},
+	InvalidRefreshToken: {http.StatusUnauthorized, "Invalid refresh token", "刷新令牌无效"},
+	RefreshTokenExpired: {http.StatusUnauthorized, "Refresh token expired", "刷新令牌已过期"},
+	SessionNotFound:     {http.StatusNotFound, "Session not found", "找不到该会话"},
+
+	TOTPRequired:       {http.StatusForbidden, "TOTP required", "需要启用动态口令"},
+	TOTPCodeRequired:   {http.StatusBadRequest, "TOTP code required", "请输入动态口令"},
+	WrongTOTPCode:      {http.StatusBadRequest, "Wrong TOTP code", "动态口令错误"},
+	TOTPAlreadyEnabled: {http.StatusBadRequest, "TOTP already enabled", "动态口令已启用"},
+	TOTPNotEnabled:     {http.StatusBadRequest, "TOTP not enabled", "动态口令未启用"},
+	TOTPNotStarted:     {http.StatusBadRequest, "TOTP enrollment not started", "尚未开始绑定动态口令"},
+
+	SSORequired:           {http.StatusForbidden, "Single sign-on required", "请使用单点登录"},
+	SSONotConfigured:      {http.StatusNotFound, "Single sign-on not configured", "未配置单点登录"},
+	SSOStaffOnly:          {http.StatusForbidden, "Single sign-on is for staff accounts", "单点登录仅限员工账户"},
+	IdPUnavailable:        {http.StatusBadGateway, "Identity provider unavailable", "身份提供方不可用"},
+	IdPRefused:            {http.StatusBadRequest, "Login refused by identity provider", "身份提供方拒绝了登录"},
+	InvalidIDToken:        {http.StatusBadRequest, "Invalid ID token", "ID 令牌无效"},
+	InvalidLogin:          {http.StatusBadRequest, "Invalid or expired login", "登录无效或已过期"},
+	VerifiedEmailRequired: {http.StatusForbidden, "Verified email required", "需要已验证的邮箱"},
+	IdentityConflict:      {http.StatusConflict, "Account linked to another identity", "账户已关联其他身份"},
+
+	AccountNotFound:        {http.StatusNotFound, "Account not found", "找不到用户"},
+	AccountOccupied:        {http.StatusBadRequest, "E-Mail or AccountID occupied", "邮箱或账户已被占用"},
+	InvalidEmail:           {http.StatusBadRequest, "Invalid E-mail Address", "邮箱地址无效"},
+	InvalidAccountType:     {http.StatusBadRequest, "Invalid Account Type", "账户类型无效"},
+	InvalidBirthday:        {http.StatusBadRequest, "Invalid Birthday", "生日无效"},
+	InvalidDepartment:      {http.StatusBadRequest, "Invalid Department", "科室无效"},
+	InvalidField:           {http.StatusBadRequest, "Invalid field for account type", "该账户类型不能修改此字段"},
+	CannotModifySelf:       {http.StatusBadRequest, "Cannot modify your own account", "不能修改自己的账户"},
+	AccountHasRecords:      {http.StatusConflict, "The account has medical records, disable it or erase it through an erasure request instead", "该账户存在医疗记录，请停用账户或通过删除申请匿名化"},
+	EmailNotVerified:       {http.StatusForbidden, "E-Mail not verified", "邮箱未验证"},
+	EmailAlreadyVerified:   {http.StatusBadRequest, "E-Mail already verified", "邮箱已验证"},
+	NoPendingEmailChange:   {http.StatusBadRequest, "No pending E-Mail change", "没有待确认的邮箱变更"},
+	DoctorNotFound:         {http.StatusNotFound, "Doctor not found", "无法找到该医生"},
+	DoctorNotApproved:      {http.StatusForbidden, "Doctor not approved", "医生资质尚未审核通过"},
+	CredentialNotFound:     {http.StatusNotFound, "Credential not found", "找不到该资质文件"},
+	InvalidFileType:        {http.StatusBadRequest, "Invalid file type", "文件类型无效"},
+	FileTooLarge:           {http.StatusBadRequest, "File too large", "文件过大"},
+	ProfileChangeNotFound:  {http.StatusNotFound, "Profile change not found", "找不到该资料变更"},
+	ProfileChangeReviewed:  {http.StatusBadRequest, "Profile change already reviewed", "该资料变更已审核"},
+	ProfileChangeConflict:  {http.StatusConflict, "Profile change reviewed meanwhile, try again", "资料变更已被他人审核，请重试"},
+	ErasureNotFound:        {http.StatusNotFound, "Erasure request not found", "找不到该删除申请"},
+	ErasureRequested:       {http.StatusBadRequest, "Erasure already requested", "已提交过删除申请"},
+	ErasureReviewed:        {http.StatusBadRequest, "Erasure request already reviewed", "该删除申请已审核"},
+	InvalidCSV:             {http.StatusBadRequest, "Invalid CSV", "CSV 文件无效"},
+	InvalidRows:            {http.StatusBadRequest, "Invalid rows", "部分行无效"},
+	ServiceAccountNotFound: {http.StatusNotFound, "Service account not found", "找不到该服务账户"},
+	APIKeyNotFound:         {http.StatusNotFound, "API key not found", "找不到该 API 密钥"},
+	NameOccupied:           {http.StatusBadRequest, "Name occupied", "名称已被占用"},
+	InvalidScope:           {http.StatusBadRequest, "Invalid scope", "权限范围无效"},
+
+	PatientNotFound:         {http.StatusNotFound, "Patient not found", "无法找到该患者"},
+	NotAPatient:             {http.StatusBadRequest, "Not a patient account", "不是患者账户"},
+	ProfileNotFound:         {http.StatusNotFound, "Profile not found", "找不到该就诊人"},
+	NotAManagedProfile:      {http.StatusBadRequest, "Not a managed profile", "不是托管的就诊人"},
+	AlreadyDelegated:        {http.StatusBadRequest, "Already delegated", "已经授权过该用户"},
+	DelegationNotFound:      {http.StatusNotFound, "Delegation not found", "找不到该授权"},
+	LastOwner:               {http.StatusBadRequest, "Cannot revoke the last owner", "不能撤销最后一位管理人"},
+	InvalidNationalID:       {http.StatusBadRequest, "Invalid National ID", "身份证号无效"},
+	NationalIDTaken:         {http.StatusBadRequest, "National ID already registered", "身份证号已被登记"},
+	InvalidInsuranceNumber:  {http.StatusBadRequest, "Invalid Insurance Number", "医保号无效"},
+	InsuranceNumberTaken:    {http.StatusBadRequest, "Insurance Number already registered", "医保号已被登记"},
+	MergeTargetNotFound:     {http.StatusNotFound, "Patient to merge into not found", "找不到合并目标患者"},
+	PatientsNotMergeable:    {http.StatusBadRequest, "Patients cannot be merged", "这两位患者不能合并"},
+	AllergyNotFound:         {http.StatusNotFound, "Allergy not found", "找不到该过敏记录"},
+	AllergyTargetRequired:   {http.StatusBadRequest, "Either medicine_id or ingredient is required", "请填写药品或成分"},
+	MedicineNotFound:        {http.StatusNotFound, "Medicine not found", "找不到该药品"},
+	CaseFinished:            {http.StatusBadRequest, "Cannot update a finished case", "病历已结束，不能修改"},
+	PrescriptionCaseChanged: {http.StatusBadRequest, "Cannot update caseID of prescription", "不能修改处方所属病历"},
+	CaseNotFound:            {http.StatusNotFound, "Case not found", "找不到该病历"},
+	CaseDeleted:             {http.StatusBadRequest, "The case is deleted, restore it first", "病历已删除，请先恢复病历"},
+	RetentionNotElapsed:     {http.StatusBadRequest, "Records can only be purged after the retention period", "保存期限未满，不能彻底删除"},
+	PrescriptionNotFound:    {http.StatusNotFound, "Prescription not found", "找不到该处方"},
+	ReasonRequired:          {http.StatusBadRequest, "A reason is required to amend a case", "修改病历需要填写原因"},
+	RevisionNotFound:        {http.StatusNotFound, "Revision not found", "找不到该病历版本"},
+	SearchQueryRequired:     {http.StatusBadRequest, "Search words are required", "请输入搜索内容"},
+	PrescriptionWarnings:    {http.StatusBadRequest, "The prescription has safety warnings, a justification is required to prescribe it", "处方存在用药安全警告，需要填写理由才能开具"},
+	PrescriptionBlocked:     {http.StatusBadRequest, "The prescription is unsafe for the patient", "处方对该患者存在严重用药风险，不能开具"},
+
+	SearchFailed:             {http.StatusBadRequest, "Search failed", "查询失败"},
+	DepartmentNotFound:       {http.StatusNotFound, "Department not found", "无法找到该科室"},
+	RegistrationNotFound:     {http.StatusNotFound, "Registration not found", "找不到该挂号"},
+	RegistrationFailed:       {http.StatusBadRequest, "Registration failed, check the capacity of the department and your other registrations", "挂号失败，请检查科室是否有余量或者时间冲突"},
+	InvalidSchedule:          {http.StatusBadRequest, "The time slot is not available", "该时段不可用"},
+	NotEnoughCapacity:        {http.StatusBadRequest, "The time slot is fully booked", "该时段已经没有足够的挂号余量"},
+	CannotAssignDoctor:       {http.StatusBadRequest, "No doctor can take the registration", "无法为该挂号分配医生"},
+	RegistrationUpdateFailed: {http.StatusBadRequest, "Failed to update the registration", "挂号状态更新失败"},
+	TerminatedCauseRequired:  {http.StatusBadRequest, "Missing terminated causes", "请填写终止原因"},
+	MileStoneNotFound:        {http.StatusNotFound, "MileStone not found", "找不到该 MileStone"},
+	MileStoneFailed:          {http.StatusBadRequest, "Failed to create MileStone", "创建 MileStone 失败"},
+	ChatStartFailed:          {http.StatusInternalServerError, "Failed to start the chat, please retry", "无法启动会话，请重试"},
+	UpgradeFailed:            {http.StatusBadRequest, "Upgrade Fail", "连接升级失败"},
+}
+
+// Language picks the supported language best matching an Accept-Language header.
+func Language(acceptLanguage string) string {
+	for _, tag := range strings.Split(acceptLanguage, ",") {
+		tag = strings.ToLower(strings.TrimSpace(strings.Split(tag, ";")[0]))
+		switch {
+		case strings.HasPrefix(tag, "zh"):
+			return ZhCN
+		case strings.HasPrefix(tag, "en"):
+			return EnUS
+		}
+	}
+	return DefaultLanguage
+}
+
+// Status is the HTTP status answered with code.
+func (code Code) Status() int {
+	if e, ok := catalog[code]; ok {
+		return e.status
+	}
+	return http.StatusInternalServerError
+}
+
+// Message is the message for code in lang, falling back to DefaultLanguage.
+func (code Code) Message(lang string) string {
+	e, ok := catalog[code]
+	if !ok {
+		return string(code)
+	}
+	if lang == ZhCN {
+		return e.zh
+	}
+	return e.en
+}
+
+// Error returns the body of an error response: the message in lang and the code.
+func Error(code Code, lang string, data interface{}) ReturnedData {
+	return ReturnedData{Status: code.Message(lang), Code: code, Data: data}
+}
+
+// Fail answers the request with code, its HTTP status and its message in the language the client accepts.
+func Fail(c echo.Context, code Code, data interface{}) error {
+	lang := Language(c.Request().Header.Get("Accept-Language"))
+	return c.JSON(code.Status(), Error(code, lang, data))
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalog(t *testing.T) {
+	for code, e := range catalog {
+		assert.NotEmpty(t, e.en, code)
+		assert.NotEmpty(t, e.zh, code)
+		assert.GreaterOrEqual(t, e.status, 400, code)
+	}
+	assert.Equal(t, http.StatusInternalServerError, Code("no_such_code").Status())
+}
+
+func TestFail(t *testing.T) {
+	e := echo.New()
+	for lang, want := range map[string]string{
+		"zh-CN,zh;q=0.9,en;q=0.8": "无法找到该患者",
+		"en-GB, zh;q=0.5":         "Patient not found",
+		"fr-FR":                   "Patient not found",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Language", lang)
+		rec := httptest.NewRecorder()
+		require.NoError(t, Fail(e.NewContext(req, rec), PatientNotFound, nil))
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		assert.Equal(t, want, body["status"])
+		assert.Equal(t, "patient_not_found", body["code"])
+		assert.NotContains(t, body, "data")
+	}
+}
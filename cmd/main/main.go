@@ -5,6 +5,8 @@ import (
 	"net/http"
 
 	"github.com/AsterNighT/software-engineering-backend/pkg/database"
+	"github.com/AsterNighT/software-engineering-backend/pkg/keyring"
+	"github.com/AsterNighT/software-engineering-backend/pkg/mail"
 	"github.com/AsterNighT/software-engineering-backend/pkg/router"
 	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
 	"github.com/go-playground/validator"
@@ -25,6 +27,20 @@ func main() {
 	// initialize database
 	db := database.InitDB()
 
+	// initialize mail delivery
+	mailer, err := mail.NewFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	mail.SetMailer(mailer)
+
+	// load the token signing keys
+	keys, err := keyring.NewFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyring.Set(keys)
+
 	// create echo instance
 	app := echo.New()
 	app.Debug = true
@@ -38,7 +54,7 @@ func main() {
 	}))
 	app.Use(database.ContextDB(db))
 
-	err := router.RegisterRouters(app)
+	err = router.RegisterRouters(app)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,296 @@
+package account
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// AdminHandler serves the admin-only account management endpoints.
+// Routes must be guarded by CheckAccountID and RequireRole(models.AdminType).
+type AdminHandler struct{}
+
+// @Summary list and search accounts
+// @Description q matches email, first name or last name
+// @Tags Admin
+// @Produce json
+// @Param q query string false "search keyword"
+// @Param type query string false "account type"
+// @Param disabled query bool false "only disabled (true) or enabled (false) accounts"
+// @Param page query int false "page number, starting from 1"
+// @Param size query int false "page size, at most 100"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/accounts [GET]
+func (h *AdminHandler) ListAccounts(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	query := db.Model(&models.Account{})
+
+	if q := c.QueryParam("q"); q != "" {
+		pattern := "%" + q + "%"
+		query = query.Where("email ILIKE ? OR first_name ILIKE ? OR last_name ILIKE ?", pattern, pattern, pattern)
+	}
+	if t := c.QueryParam("type"); t != "" {
+		query = query.Where("type = ?", t)
+	}
+	if d := c.QueryParam("disabled"); d != "" {
+		disabled, err := strconv.ParseBool(d)
+		if err != nil {
+			return api.Fail(c, api.InvalidRequest, err.Error())
+		}
+		query = query.Where("disabled = ?", disabled)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+
+	page, size := utils.Pagination(c)
+	var accounts []models.Account
+	if err := query.Omit("passwd").Order("id").Offset((page - 1) * size).Limit(size).Find(&accounts).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", echo.Map{"total": total, "accounts": accounts}))
+}
+
+// @Summary get an account
+// @Tags Admin
+// @Produce json
+// @Param accountID path uint true "account ID"
+// @Success 200 {object} api.ReturnedData{data=models.Account}
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /admin/accounts/{accountID} [GET]
+func (h *AdminHandler) GetAccount(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	var account models.Account
+	if err := db.Omit("passwd").First(&account, c.Param("accountID")).Error; err != nil {
+		return api.Fail(c, api.AccountNotFound, nil)
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", account))
+}
+
+// @Summary disable an account
+// @Description the account can no longer log in and its tokens are revoked
+// @Tags Admin
+// @Produce json
+// @Param accountID path uint true "account ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/accounts/{accountID}/disable [PUT]
+func (h *AdminHandler) DisableAccount(c echo.Context) error {
+	return h.setDisabled(c, true)
+}
+
+// @Summary enable a disabled account
+// @Tags Admin
+// @Produce json
+// @Param accountID path uint true "account ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/accounts/{accountID}/enable [PUT]
+func (h *AdminHandler) EnableAccount(c echo.Context) error {
+	return h.setDisabled(c, false)
+}
+
+func (h *AdminHandler) setDisabled(c echo.Context, disabled bool) error {
+	account, code := h.targetAccount(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&account).Update("disabled", disabled).Error; err != nil {
+			return err
+		}
+		if disabled {
+			return revokeAllTokens(tx, account.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	if disabled {
+		return c.JSON(http.StatusOK, api.Return("Account disabled", nil))
+	}
+	return c.JSON(http.StatusOK, api.Return("Account enabled", nil))
+}
+
+// @Summary change the type of an account
+// @Description the doctor or patient row is created if missing; tokens of the account must be refreshed
+// @Tags Admin
+// @Produce json
+// @Param accountID path uint true "account ID"
+// @Param type body string true "new account type, in {patient, doctor, admin}"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/accounts/{accountID}/type [PUT]
+func (h *AdminHandler) ChangeAccountType(c echo.Context) error {
+	type RequestBody struct {
+		Type models.AcountType `json:"type" validate:"required"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+	if body.Type != models.PatientType && body.Type != models.DoctorType && body.Type != models.AdminType {
+		return api.Fail(c, api.InvalidAccountType, nil)
+	}
+
+	account, code := h.targetAccount(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&account).Update("type", body.Type).Error; err != nil {
+			return err
+		}
+		account.Type = body.Type
+		if err := createRoleRow(tx, &account); err != nil {
+			return err
+		}
+		// The role is embedded in the tokens
+		return bumpTokenVersion(tx, account.ID)
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Account type changed", nil))
+}
+
+// @Summary delete an account
+// @Description removes the account together with its doctor/patient row and credentials. Accounts with medical records are refused, disable them or approve their erasure instead
+// @Tags Admin
+// @Produce json
+// @Param accountID path uint true "account ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 409 {object} api.ReturnedData{}
+// @Router /admin/accounts/{accountID} [DELETE]
+func (h *AdminHandler) DeleteAccount(c echo.Context) error {
+	account, code := h.targetAccount(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	if hasMedicalRecords(db, account.ID) {
+		return api.Fail(c, api.AccountHasRecords, nil)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Allergies and their history are medical records, hasMedicalRecords kept accounts having any
+		patientIDs := tx.Model(&models.Patient{}).Select("id").Where("account_id = ?", account.ID)
+		if err := tx.Where("patient_id IN (?)", patientIDs).Delete(&models.PatientDelegation{}).Error; err != nil {
+			return err
+		}
+		doctorIDs := tx.Model(&models.Doctor{}).Select("id").Where("account_id = ?", account.ID)
+		if err := tx.Where("doctor_id IN (?)", doctorIDs).Delete(&models.DoctorProfileChange{}).Error; err != nil {
+			return err
+		}
+		for _, model := range []interface{}{&models.Doctor{}, &models.Patient{}, &models.RefreshToken{}, &models.RevokedToken{},
+			&models.Session{}, &models.RecoveryCode{}, &models.ExternalIdentity{}, &models.PasswordHistory{}, &models.ErasureRequest{}, &models.PatientDelegation{}} {
+			if err := tx.Where("account_id = ?", account.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("email = ?", account.Email).Delete(&models.Auth{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&account).Error
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Account deleted", nil))
+}
+
+/**
+ * @brief whether cases, registrations, allergies, revisions or safety overrides, deleted ones included,
+ * belong to the account or its patient/doctor rows, or were written by it. Those must outlive the account.
+ */
+func hasMedicalRecords(db *gorm.DB, accountID uint) bool {
+	patientIDs := db.Model(&models.Patient{}).Select("id").Where("account_id = ?", accountID)
+	doctorIDs := db.Model(&models.Doctor{}).Select("id").Where("account_id = ?", accountID)
+	for _, query := range []*gorm.DB{
+		db.Unscoped().Model(&models.Case{}).Where("patient_id = ? OR doctor_id IN (?)", accountID, doctorIDs),
+		db.Model(&models.Registration{}).Where("patient_id IN (?) OR doctor_id IN (?)", patientIDs, doctorIDs),
+		db.Model(&models.Allergy{}).Where("patient_id IN (?)", patientIDs),
+		db.Model(&models.AllergyHistory{}).Where("patient_id IN (?)", patientIDs),
+		db.Model(&models.CaseRevision{}).Where("author_id = ?", accountID),
+		db.Model(&models.SafetyOverride{}).Where("overridden_by = ?", accountID),
+	} {
+		var count int64
+		if query.Count(&count); count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// @Summary list lockout events
+// @Description accounts locked after repeated authentication failures, newest first
+// @Tags Admin
+// @Produce json
+// @Param email query string false "only events of this email"
+// @Param page query int false "page number, starting from 1"
+// @Param size query int false "page size, at most 100"
+// @Success 200 {object} api.ReturnedData{data=[]models.LockoutEvent}
+// @Router /admin/lockouts [GET]
+func (h *AdminHandler) ListLockouts(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	query := db.Model(&models.LockoutEvent{})
+	if email := c.QueryParam("email"); email != "" {
+		query = query.Where("email = ?", email)
+	}
+
+	page, size := utils.Pagination(c)
+	var events []models.LockoutEvent
+	if err := query.Order("created_at DESC").Offset((page - 1) * size).Limit(size).Find(&events).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", events))
+}
+
+// @Summary unlock an account
+// @Description clears the failed attempts of the account so that it can log in right away
+// @Tags Admin
+// @Produce json
+// @Param accountID path uint true "account ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/accounts/{accountID}/unlock [PUT]
+func (h *AdminHandler) UnlockAccount(c echo.Context) error {
+	account, code := h.targetAccount(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	clearFailures(db, account.Email)
+	return c.JSON(http.StatusOK, api.Return("Account unlocked", nil))
+}
+
+/**
+ * @brief load the account named by the accountID path parameter.
+ * Admins cannot act on their own account, so that they cannot lock themselves out.
+ * On failure the returned code is the error to answer with, "" otherwise.
+ */
+func (h *AdminHandler) targetAccount(c echo.Context) (models.Account, api.Code) {
+	var account models.Account
+	id, err := strconv.Atoi(c.Param("accountID"))
+	if err != nil {
+		return account, api.InvalidID
+	}
+	if uint(id) == c.Get("id").(uint) {
+		return account, api.CannotModifySelf
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	if err := db.First(&account, id).Error; err != nil {
+		return account, api.AccountNotFound
+	}
+	return account, ""
+}
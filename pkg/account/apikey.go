@@ -0,0 +1,311 @@
+package account
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Machine integrations authenticate with the API keys of a service account,
+// sent as "Authorization: ApiKey <key>" or "X-API-Key: <key>". CheckAccountID
+// lets a key through only to the route groups listed in scopeGroups, and only
+// if the key has the scope of the group.
+
+const (
+	ScopeCasesRead       = "cases:read"
+	ScopeAllergiesRead   = "allergies:read"
+	ScopeAllergiesWrite  = "allergies:write"
+	ScopeMedicineRead    = "medicine:read"
+	ScopeDepartmentsRead = "departments:read"
+)
+
+// Scopes lists every scope an API key can be given.
+var Scopes = []string{
+	ScopeCasesRead, ScopeAllergiesRead, ScopeAllergiesWrite, ScopeMedicineRead, ScopeDepartmentsRead,
+}
+
+// scopeGroups are the route groups API keys can reach, by route path prefix. Other routes refuse API keys.
+var scopeGroups = []struct {
+	prefix string
+	read   string // Scope needed for GET
+	write  string // Scope needed for other methods, empty if keys cannot write there
+}{
+	{"/api/cases", ScopeCasesRead, ""},
+	// case, cases and their prescriptions; only doctors write them, as the authors of their revisions
+	{"/api/patient/:patientID/case", ScopeCasesRead, ""},
+	{"/api/patient/:patientID/allergies", ScopeAllergiesRead, ScopeAllergiesWrite},
+	{"/api/medicine", ScopeMedicineRead, ""},
+	{"/api/department", ScopeDepartmentsRead, ""}, // departments and department/:departmentID
+}
+
+// API keys are used by a few machines over and over, their last use need not be exact.
+const lastUsedPrecision = time.Minute
+
+// @Summary create a service account
+// @Tags Admin
+// @Produce json
+// @Param name body string true "unique name, e.g. lab-system"
+// @Param description body string false "description"
+// @Success 200 {object} api.ReturnedData{data=models.ServiceAccount}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /admin/serviceaccounts [POST]
+func (h *AdminHandler) CreateServiceAccount(c echo.Context) error {
+	type RequestBody struct {
+		Name        string `json:"name" validate:"required,max=64"`
+		Description string `json:"description"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	if err := db.Where("name = ?", body.Name).First(&models.ServiceAccount{}).Error; err == nil {
+		return api.Fail(c, api.NameOccupied, nil)
+	}
+	service := models.ServiceAccount{
+		Name:        body.Name,
+		Description: body.Description,
+		CreatedBy:   c.Get("id").(uint),
+	}
+	if err := db.Create(&service).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Service account created", service))
+}
+
+// @Summary list service accounts with their keys
+// @Description also returns every scope a key can be given
+// @Tags Admin
+// @Produce json
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/serviceaccounts [GET]
+func (h *AdminHandler) ListServiceAccounts(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	var services []models.ServiceAccount
+	if err := db.Preload("APIKeys").Order("id").Find(&services).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", echo.Map{"service_accounts": services, "scopes": Scopes}))
+}
+
+// @Summary disable a service account
+// @Description none of its keys works until it is enabled again
+// @Tags Admin
+// @Produce json
+// @Param serviceAccountID path uint true "service account ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/serviceaccounts/{serviceAccountID}/disable [PUT]
+func (h *AdminHandler) DisableServiceAccount(c echo.Context) error {
+	return h.setServiceDisabled(c, true)
+}
+
+// @Summary enable a service account
+// @Tags Admin
+// @Produce json
+// @Param serviceAccountID path uint true "service account ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/serviceaccounts/{serviceAccountID}/enable [PUT]
+func (h *AdminHandler) EnableServiceAccount(c echo.Context) error {
+	return h.setServiceDisabled(c, false)
+}
+
+func (h *AdminHandler) setServiceDisabled(c echo.Context, disabled bool) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	var service models.ServiceAccount
+	if err := db.First(&service, c.Param("serviceAccountID")).Error; err != nil {
+		return api.Fail(c, api.ServiceAccountNotFound, nil)
+	}
+	if err := db.Model(&service).Update("disabled", disabled).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	if disabled {
+		return c.JSON(http.StatusOK, api.Return("Service account disabled", nil))
+	}
+	return c.JSON(http.StatusOK, api.Return("Service account enabled", nil))
+}
+
+// @Summary create an API key for a service account
+// @Description the key is only returned here, store it right away
+// @Tags Admin
+// @Produce json
+// @Param serviceAccountID path uint true "service account ID"
+// @Param scopes body []string true "scopes, see GET /admin/serviceaccounts"
+// @Param expires_in_day body int false "days until the key expires, never if omitted"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /admin/serviceaccounts/{serviceAccountID}/keys [POST]
+func (h *AdminHandler) CreateAPIKey(c echo.Context) error {
+	type RequestBody struct {
+		Scopes       []string `json:"scopes" validate:"required,min=1"`
+		ExpiresInDay int      `json:"expires_in_day" validate:"min=0"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+	known := strings.Join(Scopes, ",")
+	for _, scope := range body.Scopes {
+		if !hasScope(known, scope) {
+			return api.Fail(c, api.InvalidScope, scope)
+		}
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	var service models.ServiceAccount
+	if err := db.First(&service, c.Param("serviceAccountID")).Error; err != nil {
+		return api.Fail(c, api.ServiceAccountNotFound, nil)
+	}
+
+	prefix, err := utils.RandomString(6)
+	if err != nil {
+		return api.Fail(c, api.InternalError, err.Error())
+	}
+	secret, err := utils.RandomString(32)
+	if err != nil {
+		return api.Fail(c, api.InternalError, err.Error())
+	}
+	key := prefix + "." + secret
+	apiKey := models.APIKey{
+		ServiceAccountID: service.ID,
+		Prefix:           prefix,
+		KeyHash:          hashToken(key),
+		Scopes:           strings.Join(body.Scopes, ","),
+		CreatedBy:        c.Get("id").(uint),
+	}
+	if body.ExpiresInDay > 0 {
+		expiresAt := time.Now().AddDate(0, 0, body.ExpiresInDay)
+		apiKey.ExpiresAt = &expiresAt
+	}
+	if err := db.Create(&apiKey).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("API key created", echo.Map{"api_key": apiKey, "key": key}))
+}
+
+// @Summary revoke an API key
+// @Tags Admin
+// @Produce json
+// @Param serviceAccountID path uint true "service account ID"
+// @Param keyID path uint true "API key ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/serviceaccounts/{serviceAccountID}/keys/{keyID} [DELETE]
+func (h *AdminHandler) RevokeAPIKey(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	var apiKey models.APIKey
+	if err := db.Where("service_account_id = ?", c.Param("serviceAccountID")).First(&apiKey, c.Param("keyID")).Error; err != nil {
+		return api.Fail(c, api.APIKeyNotFound, nil)
+	}
+	if apiKey.RevokedAt == nil {
+		if err := db.Model(&apiKey).Update("revoked_at", time.Now()).Error; err != nil {
+			return api.Fail(c, api.DBError, err.Error())
+		}
+	}
+	return c.JSON(http.StatusOK, api.Return("API key revoked", nil))
+}
+
+/**
+ * @brief the API key sent with the request, if any.
+ */
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "ApiKey ") {
+		return strings.TrimPrefix(auth, "ApiKey ")
+	}
+	return ""
+}
+
+/**
+ * @brief authenticate a request by API key, for CheckAccountID.
+ * The request passes as a ServiceType principal with no account behind it.
+ */
+func checkAPIKey(c echo.Context, key string, next echo.HandlerFunc) error {
+	scope := routeScope(c.Request().Method, c.Path())
+	if scope == "" {
+		return api.Fail(c, api.APIKeyNotAllowed, nil)
+	}
+	db, _ := c.Get("db").(*gorm.DB)
+	apiKey, err := loadAPIKey(db, key)
+	if err != nil {
+		return api.Fail(c, api.InvalidAPIKey, err.Error())
+	}
+	if !hasScope(apiKey.Scopes, scope) {
+		return api.Fail(c, api.PermissionDenied, echo.Map{"scope": scope})
+	}
+
+	if now := time.Now(); apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > lastUsedPrecision {
+		db.Model(apiKey).Update("last_used_at", now)
+	}
+	c.Set("id", uint(0))
+	c.Set("verified", true)
+	c.Set("type", models.ServiceType)
+	c.Set("doctorID", uint(0))
+	c.Set("patientID", uint(0))
+	c.Set("claims", &models.TokenClaims{Type: models.ServiceType})
+	c.Set("serviceAccountID", apiKey.ServiceAccountID)
+	return next(c)
+}
+
+/**
+ * @brief load a usable API key by its value.
+ */
+func loadAPIKey(db *gorm.DB, key string) (*models.APIKey, error) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("malformed API key")
+	}
+	var apiKey models.APIKey
+	if err := db.Where("prefix = ?", parts[0]).First(&apiKey).Error; err != nil {
+		return nil, errors.New("invalid API key")
+	}
+	if subtle.ConstantTimeCompare([]byte(apiKey.KeyHash), []byte(hashToken(key))) != 1 {
+		return nil, errors.New("invalid API key")
+	}
+	if apiKey.RevokedAt != nil {
+		return nil, errors.New("API key has been revoked")
+	}
+	if apiKey.ExpiresAt != nil && time.Now().After(*apiKey.ExpiresAt) {
+		return nil, errors.New("API key expired")
+	}
+	var service models.ServiceAccount
+	if err := db.Select("id", "disabled").First(&service, apiKey.ServiceAccountID).Error; err != nil || service.Disabled {
+		return nil, errors.New("service account has been disabled")
+	}
+	return &apiKey, nil
+}
+
+/**
+ * @brief the scope an API key needs for a route, empty if API keys cannot reach it.
+ * path is the route path as registered, e.g. /api/patient/:patientID/cases.
+ */
+func routeScope(method, path string) string {
+	for _, group := range scopeGroups {
+		if !strings.HasPrefix(path, group.prefix) {
+			continue
+		}
+		if method == http.MethodGet {
+			return group.read
+		}
+		return group.write
+	}
+	return ""
+}
+
+func hasScope(scopes string, scope string) bool {
+	for _, s := range strings.Split(scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package account
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteScope(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		path   string
+		scope  string
+	}{
+		{http.MethodGet, "/api/cases", ScopeCasesRead},
+		{http.MethodGet, "/api/patient/:patientID/cases/:caseID", ScopeCasesRead},
+		{http.MethodPost, "/api/patient/:patientID/case/:caseID/prescription", ""},
+		{http.MethodPut, "/api/patient/:patientID/case/:caseID", ""},
+		{http.MethodDelete, "/api/patient/:patientID/allergies/:allergyID", ScopeAllergiesWrite},
+		{http.MethodGet, "/api/departments", ScopeDepartmentsRead},
+		{http.MethodGet, "/api/patient/:patientID/chat", ""},
+		{http.MethodGet, "/api/account/getinfo", ""},
+		{http.MethodGet, "/api/admin/accounts", ""},
+	} {
+		assert.Equal(t, tc.scope, routeScope(tc.method, tc.path), tc.method+" "+tc.path)
+	}
+}
+
+func TestRequestAPIKey(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Equal(t, "", requestAPIKey(r))
+
+	r.Header.Set("Authorization", "Bearer abc")
+	assert.Equal(t, "", requestAPIKey(r))
+
+	r.Header.Set("Authorization", "ApiKey abc.def")
+	assert.Equal(t, "abc.def", requestAPIKey(r))
+
+	r.Header.Set("X-API-Key", "ghi.jkl")
+	assert.Equal(t, "ghi.jkl", requestAPIKey(r))
+}
@@ -0,0 +1,81 @@
+package account
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"math/big"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/mail"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+/**
+ * @brief generate a fresh auth code for email, replacing any previous one for the same purpose.
+ */
+func issueAuthCode(db *gorm.DB, email string, purpose models.AuthPurpose, validFor time.Duration) (models.Auth, error) {
+	authCode := ""
+	for i := 0; i < 6; i++ {
+		nBig, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return models.Auth{}, err
+		}
+		authCode += string("0123456789"[nBig.Int64()])
+	}
+
+	auth := models.Auth{
+		Email:           email,
+		AuthCode:        authCode,
+		AuthCodeExpires: time.Now().Add(validFor),
+		Purpose:         purpose,
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("email = ? AND purpose = ?", email, purpose).Delete(&models.Auth{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&auth).Error
+	})
+	return auth, err
+}
+
+/**
+ * @brief issue an auth code valid for EMAIL_VALID_MIN minutes and mail it with template.
+ */
+func sendAuthCode(c echo.Context, db *gorm.DB, email string, purpose models.AuthPurpose, template string) error {
+	expireMin := envInt("EMAIL_VALID_MIN", 10)
+	auth, err := issueAuthCode(db, email, purpose, time.Duration(expireMin)*time.Minute)
+	if err != nil {
+		return err
+	}
+	lang := mail.Language(c.Request().Header.Get("Accept-Language"))
+	return mail.SendTemplate(email, lang, template, echo.Map{"Code": auth.AuthCode, "ExpireMin": expireMin})
+}
+
+/**
+ * @brief check code against the auth code sent to email for purpose.
+ * Wrong guesses count as failures of endpoint, and the code is dropped
+ * after AUTH_CODE_MAX_ATTEMPTS of them so that it cannot be enumerated.
+ */
+func verifyAuthCode(c echo.Context, db *gorm.DB, endpoint string, email string, code string, purpose models.AuthPurpose) bool {
+	var auth models.Auth
+	if err := db.Where("email = ? AND purpose = ?", email, purpose).First(&auth).Error; err != nil { // not found
+		recordFailure(c, db, endpoint, email)
+		return false
+	}
+	if time.Now().After(auth.AuthCodeExpires) {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(auth.AuthCode), []byte(code)) == 1 {
+		return true
+	}
+
+	recordFailure(c, db, endpoint, email)
+	if auth.Attempts+1 >= envInt("AUTH_CODE_MAX_ATTEMPTS", 5) {
+		db.Where("email = ? AND purpose = ?", email, purpose).Delete(&models.Auth{})
+	} else {
+		db.Model(&models.Auth{}).Where("email = ? AND purpose = ?", email, purpose).Update("attempts", gorm.Expr("attempts + 1"))
+	}
+	return false
+}
@@ -0,0 +1,417 @@
+package account
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// An account acts for its own patient profile and for every profile it holds an
+// active PatientDelegation of. Dependent profiles (children, elderly relatives
+// without an account of their own) are managed accounts owned by the account
+// which created them. Profiles are named by Patient.ID here.
+
+// @Summary list the patient profiles the current account can act for
+// @Tags Account
+// @Produce json
+// @Success 200 {object} api.ReturnedData{}
+// @Router /account/profiles [GET]
+func (h *AccountHandler) ListProfiles(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	accountID := c.Get("id").(uint)
+
+	type entry struct {
+		patient  models.Patient
+		role     string
+		relation string
+	}
+	var entries []entry
+	var own []models.Patient
+	db.Where("account_id = ?", accountID).Find(&own)
+	for _, patient := range own {
+		entries = append(entries, entry{patient, "self", ""})
+	}
+	var delegations []models.PatientDelegation
+	db.Where("account_id = ? AND revoked_at IS NULL", accountID).Order("id").Find(&delegations)
+	for _, d := range delegations {
+		var patient models.Patient
+		if db.First(&patient, d.PatientID).Error == nil {
+			entries = append(entries, entry{patient, string(d.Role), d.Relation})
+		}
+	}
+
+	profiles := make([]echo.Map, 0, len(entries))
+	for _, e := range entries {
+		var account models.Account
+		db.First(&account, e.patient.AccountID)
+		profiles = append(profiles, echo.Map{
+			"patient_id":      e.patient.ID,
+			"account_id":      account.ID,
+			"firstname":       account.FirstName,
+			"lastname":        account.LastName,
+			"gender":          account.Gender,
+			"birthday":        account.Birthday.Format("2006-01-02"),
+			"allergy":         e.patient.Allergy,
+			"nationalid":      e.patient.NationalID,
+			"insurancenumber": e.patient.InsuranceNumber,
+			"managed":         account.Managed,
+			"role":            e.role,
+			"relation":        e.relation,
+		})
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", profiles))
+}
+
+// @Summary create a dependent patient profile
+// @Description the profile has no credentials of its own; the current account owns it and can delegate it further
+// @Tags Account
+// @Produce json
+// @Param firstname body string true "first name"
+// @Param lastname body string true "last name"
+// @Param gender body string true "gender, male or female"
+// @Param birthday body string true "birthday string in yyyy-mm-dd"
+// @Param relation body string true "relation of the profile to the current account, e.g. child"
+// @Param allergy body string false "allergy history"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/profiles [POST]
+func (h *AccountHandler) CreateProfile(c echo.Context) error {
+	type RequestBody struct {
+		FirstName string `json:"firstname" validate:"required"`
+		LastName  string `json:"lastname" validate:"required"`
+		Gender    string `json:"gender" validate:"required,oneof=male female"`
+		Birthday  string `json:"birthday" validate:"required"`
+		Relation  string `json:"relation" validate:"required"`
+		Allergy   string `json:"allergy"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+	birthday, err := time.Parse("2006-01-02", body.Birthday)
+	if err != nil || birthday.After(time.Now()) {
+		return api.Fail(c, api.InvalidBirthday, nil)
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	accountID := c.Get("id").(uint)
+	var patient models.Patient
+	err = db.Transaction(func(tx *gorm.DB) error {
+		account := models.Account{
+			Type:          models.PatientType,
+			FirstName:     body.FirstName,
+			LastName:      body.LastName,
+			Gender:        body.Gender,
+			Birthday:      birthday,
+			Managed:       true,
+			EmailVerified: true, // Nothing to verify, the owner's email counts
+		}
+		if err := tx.Create(&account).Error; err != nil {
+			return err
+		}
+		patient = models.Patient{AccountID: account.ID}
+		if err := tx.Create(&patient).Error; err != nil {
+			return err
+		}
+		err := tx.Create(&models.PatientDelegation{
+			PatientID: patient.ID,
+			AccountID: accountID,
+			Role:      models.DelegationOwner,
+			Relation:  body.Relation,
+			GrantedBy: accountID,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return reportAllergy(tx, patient.ID, accountID, body.Allergy)
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Profile created", echo.Map{"patient_id": patient.ID, "account_id": patient.AccountID}))
+}
+
+// @Summary update a dependent patient profile
+// @Description only owners can; the fields are the same as /account/profile
+// @Tags Account
+// @Produce json
+// @Param patientID path uint true "patient ID"
+// @Param firstname body string false "first name"
+// @Param lastname body string false "last name"
+// @Param gender body string false "gender, male or female"
+// @Param birthday body string false "birthday string in yyyy-mm-dd"
+// @Param allergy body string false "allergy history"
+// @Param nationalid body string false "national ID (GB 11643)"
+// @Param insurancenumber body string false "medical insurance number"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/profiles/{patientID} [PUT]
+func (h *AccountHandler) UpdateManagedProfile(c echo.Context) error {
+	type RequestBody struct {
+		FirstName *string `json:"firstname" validate:"omitempty,min=1"`
+		LastName  *string `json:"lastname" validate:"omitempty,min=1"`
+		Gender    *string `json:"gender" validate:"omitempty,oneof=male female"`
+		Birthday  *string `json:"birthday"`
+		Allergy   *string `json:"allergy"`
+		patientIdentifiers
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	patient, code := h.ownedProfile(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	db, _ := c.Get("db").(*gorm.DB)
+	var account models.Account
+	if err := db.First(&account, patient.AccountID).Error; err != nil || !account.Managed {
+		return api.Fail(c, api.NotAManagedProfile, nil)
+	}
+
+	updates := map[string]interface{}{}
+	if body.FirstName != nil {
+		updates["first_name"] = *body.FirstName
+	}
+	if body.LastName != nil {
+		updates["last_name"] = *body.LastName
+	}
+	if body.Gender != nil {
+		updates["gender"] = *body.Gender
+	}
+	if body.Birthday != nil {
+		birthday, err := time.Parse("2006-01-02", *body.Birthday)
+		if err != nil || birthday.After(time.Now()) {
+			return api.Fail(c, api.InvalidBirthday, nil)
+		}
+		updates["birthday"] = birthday
+	}
+	identifiers, code := body.patientIdentifiers.updates(db, patient.ID)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if len(updates) > 0 {
+			if err := tx.Model(&account).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		if len(identifiers) > 0 {
+			if err := tx.Model(&patient).Updates(identifiers).Error; err != nil {
+				return err
+			}
+		}
+		if body.Allergy != nil {
+			return reportAllergy(tx, patient.ID, c.Get("id").(uint), *body.Allergy)
+		}
+		return nil
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Profile updated", nil))
+}
+
+// @Summary list who can act for a patient profile
+// @Description only owners can
+// @Tags Account
+// @Produce json
+// @Param patientID path uint true "patient ID"
+// @Success 200 {object} api.ReturnedData{data=[]models.PatientDelegation}
+// @Router /account/profiles/{patientID}/delegates [GET]
+func (h *AccountHandler) ListDelegates(c echo.Context) error {
+	patient, code := h.ownedProfile(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	db, _ := c.Get("db").(*gorm.DB)
+	var delegations []models.PatientDelegation
+	if err := db.Where("patient_id = ? AND revoked_at IS NULL", patient.ID).Order("id").Find(&delegations).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", delegations))
+}
+
+// @Summary let another account act for a patient profile
+// @Description only owners can; the other account is named by its email and must be a patient account
+// @Tags Account
+// @Produce json
+// @Param patientID path uint true "patient ID"
+// @Param email body string true "e-mail of the account to delegate to"
+// @Param relation body string true "relation of the profile to that account, e.g. parent"
+// @Param role body string false "delegate (default) or owner"
+// @Success 200 {object} api.ReturnedData{data=models.PatientDelegation}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/profiles/{patientID}/delegates [POST]
+func (h *AccountHandler) AddDelegate(c echo.Context) error {
+	type RequestBody struct {
+		Email    string                `json:"email" validate:"required"`
+		Relation string                `json:"relation" validate:"required"`
+		Role     models.DelegationRole `json:"role" validate:"omitempty,oneof=owner delegate"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+	if body.Role == "" {
+		body.Role = models.DelegationDelegate
+	}
+
+	patient, code := h.ownedProfile(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	db, _ := c.Get("db").(*gorm.DB)
+	var delegate models.Account
+	if err := db.Where("email = ? AND type = ?", body.Email, models.PatientType).First(&delegate).Error; err != nil {
+		return api.Fail(c, api.EmailNotFound, echo.Map{"emailok": false})
+	}
+	if delegate.ID == patient.AccountID || ActsFor(db, delegate.ID, &patient) {
+		return api.Fail(c, api.AlreadyDelegated, nil)
+	}
+
+	delegation := models.PatientDelegation{
+		PatientID: patient.ID,
+		AccountID: delegate.ID,
+		Role:      body.Role,
+		Relation:  body.Relation,
+		GrantedBy: c.Get("id").(uint),
+	}
+	if err := db.Create(&delegation).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Delegated", delegation))
+}
+
+// @Summary revoke a delegation
+// @Description owners can revoke any delegation of the profile, delegates their own one
+// @Tags Account
+// @Produce json
+// @Param patientID path uint true "patient ID"
+// @Param delegationID path uint true "delegation ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/profiles/{patientID}/delegates/{delegationID} [DELETE]
+func (h *AccountHandler) RevokeDelegate(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	accountID := c.Get("id").(uint)
+	var delegation models.PatientDelegation
+	err := db.Where("patient_id = ? AND revoked_at IS NULL", c.Param("patientID")).First(&delegation, c.Param("delegationID")).Error
+	if err != nil {
+		return api.Fail(c, api.DelegationNotFound, nil)
+	}
+	var patient models.Patient
+	if err := db.First(&patient, delegation.PatientID).Error; err != nil {
+		return api.Fail(c, api.DelegationNotFound, nil)
+	}
+	if delegation.AccountID != accountID && !ownsProfile(db, accountID, &patient) {
+		return api.Fail(c, api.PermissionDenied, nil)
+	}
+
+	// A dependent profile must keep someone to manage it
+	if delegation.Role == models.DelegationOwner {
+		var owners int64
+		db.Model(&models.PatientDelegation{}).
+			Where("patient_id = ? AND role = ? AND revoked_at IS NULL", patient.ID, models.DelegationOwner).Count(&owners)
+		var account models.Account
+		db.Select("managed").First(&account, patient.AccountID)
+		if account.Managed && owners <= 1 {
+			return api.Fail(c, api.LastOwner, nil)
+		}
+	}
+
+	if err := db.Model(&delegation).Update("revoked_at", time.Now()).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Delegation revoked", nil))
+}
+
+/**
+ * @brief whether the account may act for patient, as the patient itself or through an active delegation.
+ */
+func ActsFor(db *gorm.DB, accountID uint, patient *models.Patient) bool {
+	if patient.AccountID == accountID {
+		return true
+	}
+	err := db.Where("patient_id = ? AND account_id = ? AND revoked_at IS NULL", patient.ID, accountID).
+		First(&models.PatientDelegation{}).Error
+	return err == nil
+}
+
+/**
+ * @brief ActsFor with the account ID of the patient, which is what case and chat routes carry.
+ */
+func ActsForAccount(db *gorm.DB, accountID uint, patientAccountID uint) bool {
+	if patientAccountID == accountID {
+		return true
+	}
+	var patient models.Patient
+	if err := db.Where("account_id = ?", patientAccountID).First(&patient).Error; err != nil {
+		return false
+	}
+	return ActsFor(db, accountID, &patient)
+}
+
+/**
+ * @brief the IDs of every patient profile the account may act for, its own one first.
+ */
+func PatientIDs(db *gorm.DB, accountID uint) []uint {
+	var ids []uint
+	db.Model(&models.Patient{}).Where("account_id = ?", accountID).Pluck("id", &ids)
+	var delegated []uint
+	db.Model(&models.PatientDelegation{}).Where("account_id = ? AND revoked_at IS NULL", accountID).Pluck("patient_id", &delegated)
+	return append(ids, delegated...)
+}
+
+/**
+ * @brief middleware only letting through accounts which may act for the patient
+ * whose account ID is the path parameter param. It must come after CheckAccountID.
+ */
+func RequirePatientAccount(param string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			patientAccountID, err := strconv.Atoi(c.Param(param))
+			if err != nil {
+				return api.Fail(c, api.InvalidID, nil)
+			}
+			db, _ := c.Get("db").(*gorm.DB)
+			if !ActsForAccount(db, c.Get("id").(uint), uint(patientAccountID)) {
+				return api.Fail(c, api.PermissionDenied, nil)
+			}
+			return next(c)
+		}
+	}
+}
+
+func ownsProfile(db *gorm.DB, accountID uint, patient *models.Patient) bool {
+	if patient.AccountID == accountID {
+		return true
+	}
+	err := db.Where("patient_id = ? AND account_id = ? AND role = ? AND revoked_at IS NULL", patient.ID, accountID, models.DelegationOwner).
+		First(&models.PatientDelegation{}).Error
+	return err == nil
+}
+
+/**
+ * @brief load the profile named by the patientID path parameter, which the current account must own.
+ * On failure the returned code is the error to answer with, "" otherwise.
+ */
+func (h *AccountHandler) ownedProfile(c echo.Context) (models.Patient, api.Code) {
+	var patient models.Patient
+	db, _ := c.Get("db").(*gorm.DB)
+	if err := db.First(&patient, c.Param("patientID")).Error; err != nil {
+		return patient, api.ProfileNotFound
+	}
+	if !ownsProfile(db, c.Get("id").(uint), &patient) {
+		return patient, api.PermissionDenied
+	}
+	return patient, ""
+}
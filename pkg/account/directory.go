@@ -0,0 +1,322 @@
+package account
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Doctors propose changes of their public profile, which go live once an admin
+// approves them. Approved doctors are listed in the public directory.
+
+// @Summary public profile of the current doctor
+// @Description the profile as listed in the directory and the latest proposed change, if any
+// @Tags Account
+// @Produce json
+// @Success 200 {object} api.ReturnedData{}
+// @Router /account/doctor/profile [GET]
+func (h *AccountHandler) GetDoctorProfile(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	var doctor models.Doctor
+	if err := db.First(&doctor, c.Get("doctorID")).Error; err != nil {
+		return api.Fail(c, api.DoctorNotFound, nil)
+	}
+	var change *models.DoctorProfileChange
+	var latest models.DoctorProfileChange
+	if err := db.Where("doctor_id = ?", doctor.ID).Order("id DESC").First(&latest).Error; err == nil {
+		change = &latest
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", echo.Map{
+		"profile": DoctorProfiles(db, []models.Doctor{doctor})[0],
+		"change":  change,
+	}))
+}
+
+// @Summary propose a change of the public profile of the current doctor
+// @Description only the given fields change; the change replaces any pending one and goes live once an admin approves it
+// @Tags Account
+// @Produce json
+// @Param title body string false "title, e.g. chief physician"
+// @Param specialty body string false "specialty"
+// @Param years_of_experience body int false "years of experience"
+// @Param languages body []string false "spoken languages"
+// @Param bio body string false "biography"
+// @Param photo_url body string false "photo URL"
+// @Success 200 {object} api.ReturnedData{data=models.DoctorProfileChange}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/doctor/profile [PUT]
+func (h *AccountHandler) UpdateDoctorProfile(c echo.Context) error {
+	type RequestBody struct {
+		Title             *string   `json:"title" validate:"omitempty,max=64"`
+		Specialty         *string   `json:"specialty" validate:"omitempty,max=128"`
+		YearsOfExperience *int      `json:"years_of_experience" validate:"omitempty,min=0,max=80"`
+		Languages         *[]string `json:"languages" validate:"omitempty,max=10,dive,min=1,max=32,excludesall=0x2C"`
+		Bio               *string   `json:"bio" validate:"omitempty,max=2000"`
+		PhotoURL          *string   `json:"photo_url" validate:"omitempty,url"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	var doctor models.Doctor
+	if err := db.First(&doctor, c.Get("doctorID")).Error; err != nil {
+		return api.Fail(c, api.DoctorNotFound, nil)
+	}
+
+	// Changes pile up on the pending proposal, or start from the live profile
+	var change models.DoctorProfileChange
+	err := db.Where("doctor_id = ? AND status = ?", doctor.ID, models.DoctorPending).First(&change).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		change = models.DoctorProfileChange{
+			DoctorID:          doctor.ID,
+			Title:             doctor.Title,
+			Specialty:         doctor.Specialty,
+			YearsOfExperience: doctor.YearsOfExperience,
+			Languages:         doctor.Languages,
+			Bio:               doctor.Bio,
+			PhotoURL:          doctor.PhotoURL,
+			Status:            models.DoctorPending,
+		}
+	} else if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+
+	if body.Title != nil {
+		change.Title = strings.TrimSpace(*body.Title)
+	}
+	if body.Specialty != nil {
+		change.Specialty = strings.TrimSpace(*body.Specialty)
+	}
+	if body.YearsOfExperience != nil {
+		change.YearsOfExperience = *body.YearsOfExperience
+	}
+	if body.Languages != nil {
+		change.Languages = strings.Join(*body.Languages, ",")
+	}
+	if body.Bio != nil {
+		change.Bio = strings.TrimSpace(*body.Bio)
+	}
+	if body.PhotoURL != nil {
+		change.PhotoURL = *body.PhotoURL
+	}
+
+	if change.ID == 0 {
+		err = db.Create(&change).Error
+	} else {
+		// An admin may have reviewed the proposal meanwhile
+		result := db.Model(&change).Where("status = ?", models.DoctorPending).
+			Select("title", "specialty", "years_of_experience", "languages", "bio", "photo_url").Updates(&change)
+		if err = result.Error; err == nil && result.RowsAffected != 1 {
+			return api.Fail(c, api.ProfileChangeConflict, nil)
+		}
+	}
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Profile change submitted", change))
+}
+
+// @Summary public doctor directory
+// @Description approved doctors, most experienced first
+// @Tags Account
+// @Produce json
+// @Param department query uint false "department ID"
+// @Param specialty query string false "specialty keyword"
+// @Param language query string false "spoken language"
+// @Param page query int false "page number, starting from 1"
+// @Param size query int false "page size, at most 100"
+// @Success 200 {object} api.ReturnedData{data=[]models.DoctorProfileJSON}
+// @Router /doctors [GET]
+func (h *AccountHandler) ListDoctorDirectory(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	enabled := db.Model(&models.Account{}).Select("id").Where("NOT disabled")
+	query := db.Model(&models.Doctor{}).Where("status = ? AND account_id IN (?)", models.DoctorApproved, enabled)
+	if department := c.QueryParam("department"); department != "" {
+		query = query.Where("department = ?", department)
+	}
+	if specialty := c.QueryParam("specialty"); specialty != "" {
+		query = query.Where("specialty ILIKE ?", "%"+specialty+"%")
+	}
+	if language := c.QueryParam("language"); language != "" {
+		query = query.Where("',' || languages || ',' ILIKE ?", "%,"+language+",%")
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	page, size := utils.Pagination(c)
+	var doctors []models.Doctor
+	if err := query.Order("years_of_experience DESC, id").Offset((page - 1) * size).Limit(size).Find(&doctors).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", echo.Map{"total": total, "doctors": DoctorProfiles(db, doctors)}))
+}
+
+// @Summary list proposed doctor profile changes
+// @Tags Admin
+// @Produce json
+// @Param status query string false "pending, approved or rejected"
+// @Param page query int false "page number, starting from 1"
+// @Param size query int false "page size, at most 100"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/profilechanges [GET]
+func (h *AdminHandler) ListProfileChanges(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	query := db.Model(&models.DoctorProfileChange{})
+	if status := c.QueryParam("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	page, size := utils.Pagination(c)
+	var changes []models.DoctorProfileChange
+	if err := query.Order("id").Offset((page - 1) * size).Limit(size).Find(&changes).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+
+	result := make([]echo.Map, 0, len(changes))
+	for _, change := range changes {
+		var doctor models.Doctor
+		db.First(&doctor, change.DoctorID)
+		result = append(result, echo.Map{
+			"change":  change,
+			"current": DoctorProfiles(db, []models.Doctor{doctor})[0],
+		})
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", result))
+}
+
+// @Summary approve a doctor profile change
+// @Description the proposed profile replaces the live one
+// @Tags Admin
+// @Produce json
+// @Param changeID path uint true "profile change ID"
+// @Param note body string false "review note"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/profilechanges/{changeID}/approve [PUT]
+func (h *AdminHandler) ApproveProfileChange(c echo.Context) error {
+	return h.reviewProfileChange(c, models.DoctorApproved)
+}
+
+// @Summary reject a doctor profile change
+// @Tags Admin
+// @Produce json
+// @Param changeID path uint true "profile change ID"
+// @Param note body string false "review note, e.g. what to fix"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/profilechanges/{changeID}/reject [PUT]
+func (h *AdminHandler) RejectProfileChange(c echo.Context) error {
+	return h.reviewProfileChange(c, models.DoctorRejected)
+}
+
+func (h *AdminHandler) reviewProfileChange(c echo.Context, status models.DoctorStatus) error {
+	type RequestBody struct {
+		Note string `json:"note"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	var change models.DoctorProfileChange
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Lock the proposal, lest the doctor amends it while it is being approved
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&change, c.Param("changeID")).Error; err != nil {
+			return err
+		}
+		if change.Status != models.DoctorPending {
+			return nil
+		}
+		err := tx.Model(&change).Updates(map[string]interface{}{
+			"status":      status,
+			"reviewer_id": c.Get("id"),
+			"reviewed_at": &now,
+			"review_note": body.Note,
+		}).Error
+		if err != nil || status != models.DoctorApproved {
+			return err
+		}
+		return tx.Model(&models.Doctor{}).Where("id = ?", change.DoctorID).Updates(map[string]interface{}{
+			"title":               change.Title,
+			"specialty":           change.Specialty,
+			"years_of_experience": change.YearsOfExperience,
+			"languages":           change.Languages,
+			"bio":                 change.Bio,
+			"photo_url":           change.PhotoURL,
+		}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return api.Fail(c, api.ProfileChangeNotFound, nil)
+	}
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	if change.Status != status {
+		return api.Fail(c, api.ProfileChangeReviewed, change.Status)
+	}
+	if status == models.DoctorApproved {
+		return c.JSON(http.StatusOK, api.Return("Profile change approved", nil))
+	}
+	return c.JSON(http.StatusOK, api.Return("Profile change rejected", nil))
+}
+
+/**
+ * @brief the public profiles of doctors, in the same order.
+ * Names and departments are loaded in one query each.
+ */
+func DoctorProfiles(db *gorm.DB, doctors []models.Doctor) []models.DoctorProfileJSON {
+	accountIDs := make([]uint, len(doctors))
+	departmentIDs := make([]uint, len(doctors))
+	for i, doctor := range doctors {
+		accountIDs[i] = doctor.AccountID
+		departmentIDs[i] = doctor.Department
+	}
+	var accounts []models.Account
+	var departments []models.Department
+	if len(doctors) > 0 {
+		db.Select("id", "first_name", "last_name").Find(&accounts, accountIDs)
+		db.Find(&departments, departmentIDs)
+	}
+	names := make(map[uint]models.Account, len(accounts))
+	for _, account := range accounts {
+		names[account.ID] = account
+	}
+	departmentNames := make(map[uint]string, len(departments))
+	for _, department := range departments {
+		departmentNames[department.ID] = department.Name
+	}
+
+	profiles := make([]models.DoctorProfileJSON, len(doctors))
+	for i, doctor := range doctors {
+		languages := []string{}
+		if doctor.Languages != "" {
+			languages = strings.Split(doctor.Languages, ",")
+		}
+		profiles[i] = models.DoctorProfileJSON{
+			ID:                doctor.ID,
+			FirstName:         names[doctor.AccountID].FirstName,
+			LastName:          names[doctor.AccountID].LastName,
+			DepartmentID:      doctor.Department,
+			Department:        departmentNames[doctor.Department],
+			Title:             doctor.Title,
+			Specialty:         doctor.Specialty,
+			YearsOfExperience: doctor.YearsOfExperience,
+			Languages:         languages,
+			Bio:               doctor.Bio,
+			PhotoURL:          doctor.PhotoURL,
+		}
+	}
+	return profiles
+}
@@ -0,0 +1,281 @@
+package account
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Doctors start pending. They enter their license number and upload credential
+// documents, then an admin approves or rejects them. Only approved doctors get
+// the "approved" claim checked by RequireApproved.
+
+var credentialTypes = map[string]string{
+	"application/pdf": ".pdf",
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+}
+
+// @Summary set the license number of the current doctor
+// @Description changing it sends an approved or rejected doctor back to review
+// @Tags Account
+// @Produce json
+// @Param licensenumber body string true "medical license number"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/doctor/license [PUT]
+func (h *AccountHandler) SetLicense(c echo.Context) error {
+	type RequestBody struct {
+		LicenseNumber string `json:"licensenumber" validate:"required"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	var doctor models.Doctor
+	if err := db.First(&doctor, c.Get("doctorID")).Error; err != nil {
+		return api.Fail(c, api.DoctorNotFound, nil)
+	}
+	if doctor.LicenseNumber == body.LicenseNumber {
+		return c.JSON(http.StatusOK, api.Return("License number set", nil))
+	}
+
+	wasPending := doctor.Status == models.DoctorPending
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&doctor).Updates(map[string]interface{}{
+			"license_number": body.LicenseNumber,
+			"status":         models.DoctorPending,
+		}).Error
+		if err != nil || wasPending {
+			return err
+		}
+		// The approval is embedded in the tokens
+		return bumpTokenVersion(tx, doctor.AccountID)
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("License number set", nil))
+}
+
+// @Summary upload a credential document of the current doctor
+// @Description multipart form with a "file" field; PDF, PNG or JPEG up to CREDENTIAL_MAX_MB megabytes
+// @Tags Account
+// @Accept multipart/form-data
+// @Produce json
+// @Param file formData file true "credential document"
+// @Success 200 {object} api.ReturnedData{data=models.DoctorCredential}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/doctor/credentials [POST]
+func (h *AccountHandler) UploadCredential(c echo.Context) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+	if file.Size > int64(envInt("CREDENTIAL_MAX_MB", 10))<<20 {
+		return api.Fail(c, api.FileTooLarge, nil)
+	}
+	src, err := file.Open()
+	if err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+	defer src.Close()
+
+	// Trust the content, not the name the client gave it
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(src, head)
+	contentType := http.DetectContentType(head[:n])
+	ext, ok := credentialTypes[contentType]
+	if !ok {
+		return api.Fail(c, api.InvalidFileType, contentType)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return api.Fail(c, api.InternalError, err.Error())
+	}
+
+	doctorID := c.Get("doctorID").(uint)
+	name, err := utils.RandomString(16)
+	if err != nil {
+		return api.Fail(c, api.InternalError, err.Error())
+	}
+	dir := filepath.Join(credentialDir(), fmt.Sprint(doctorID))
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return api.Fail(c, api.InternalError, err.Error())
+	}
+	path := filepath.Join(dir, name+ext)
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return api.Fail(c, api.InternalError, err.Error())
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return api.Fail(c, api.InternalError, err.Error())
+	}
+
+	credential := models.DoctorCredential{
+		DoctorID:    doctorID,
+		FileName:    filepath.Base(file.Filename),
+		ContentType: contentType,
+		Size:        file.Size,
+		Path:        path,
+	}
+	db, _ := c.Get("db").(*gorm.DB)
+	if err := db.Create(&credential).Error; err != nil {
+		os.Remove(path)
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Credential uploaded", credential))
+}
+
+// @Summary review status and credentials of the current doctor
+// @Tags Account
+// @Produce json
+// @Success 200 {object} api.ReturnedData{}
+// @Router /account/doctor/credentials [GET]
+func (h *AccountHandler) GetCredentials(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	var doctor models.Doctor
+	if err := db.First(&doctor, c.Get("doctorID")).Error; err != nil {
+		return api.Fail(c, api.DoctorNotFound, nil)
+	}
+	var credentials []models.DoctorCredential
+	db.Where("doctor_id = ?", doctor.ID).Order("created_at").Find(&credentials)
+	return c.JSON(http.StatusOK, api.Return("ok", echo.Map{
+		"status":         doctor.Status,
+		"license_number": doctor.LicenseNumber,
+		"review_note":    doctor.ReviewNote,
+		"credentials":    credentials,
+	}))
+}
+
+// @Summary list doctors by review status
+// @Tags Admin
+// @Produce json
+// @Param status query string false "pending, approved or rejected"
+// @Param page query int false "page number, starting from 1"
+// @Param size query int false "page size, at most 100"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/doctors [GET]
+func (h *AdminHandler) ListDoctors(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	query := db.Model(&models.Doctor{})
+	if status := c.QueryParam("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	page, size := utils.Pagination(c)
+	var doctors []models.Doctor
+	if err := query.Order("id").Offset((page - 1) * size).Limit(size).Find(&doctors).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+
+	result := make([]echo.Map, 0, len(doctors))
+	for _, doctor := range doctors {
+		var account models.Account
+		db.Select("first_name", "last_name").First(&account, doctor.AccountID)
+		var credentials []models.DoctorCredential
+		db.Where("doctor_id = ?", doctor.ID).Order("created_at").Find(&credentials)
+		result = append(result, echo.Map{
+			"doctor":      doctor,
+			"firstname":   account.FirstName,
+			"lastname":    account.LastName,
+			"credentials": credentials,
+		})
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", result))
+}
+
+// @Summary download a credential document
+// @Tags Admin
+// @Produce octet-stream
+// @Param doctorID path uint true "doctor ID"
+// @Param credentialID path uint true "credential ID"
+// @Success 200 {file} binary
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /admin/doctors/{doctorID}/credentials/{credentialID} [GET]
+func (h *AdminHandler) GetCredentialFile(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	var credential models.DoctorCredential
+	if err := db.Where("doctor_id = ?", c.Param("doctorID")).First(&credential, c.Param("credentialID")).Error; err != nil {
+		return api.Fail(c, api.CredentialNotFound, nil)
+	}
+	return c.Attachment(credential.Path, credential.FileName)
+}
+
+// @Summary approve a doctor
+// @Description the doctor can use doctor-only endpoints after refreshing the token
+// @Tags Admin
+// @Produce json
+// @Param doctorID path uint true "doctor ID"
+// @Param note body string false "review note"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/doctors/{doctorID}/approve [PUT]
+func (h *AdminHandler) ApproveDoctor(c echo.Context) error {
+	return h.reviewDoctor(c, models.DoctorApproved)
+}
+
+// @Summary reject a doctor
+// @Tags Admin
+// @Produce json
+// @Param doctorID path uint true "doctor ID"
+// @Param note body string false "review note, e.g. which document is missing"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/doctors/{doctorID}/reject [PUT]
+func (h *AdminHandler) RejectDoctor(c echo.Context) error {
+	return h.reviewDoctor(c, models.DoctorRejected)
+}
+
+func (h *AdminHandler) reviewDoctor(c echo.Context, status models.DoctorStatus) error {
+	type RequestBody struct {
+		Note string `json:"note"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	var doctor models.Doctor
+	if err := db.First(&doctor, c.Param("doctorID")).Error; err != nil {
+		return api.Fail(c, api.DoctorNotFound, nil)
+	}
+
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&doctor).Updates(map[string]interface{}{
+			"status":      status,
+			"review_note": body.Note,
+			"reviewed_at": &now,
+		}).Error
+		if err != nil {
+			return err
+		}
+		// The approval is embedded in the tokens
+		return bumpTokenVersion(tx, doctor.AccountID)
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	if status == models.DoctorApproved {
+		return c.JSON(http.StatusOK, api.Return("Doctor approved", nil))
+	}
+	return c.JSON(http.StatusOK, api.Return("Doctor rejected", nil))
+}
+
+func credentialDir() string {
+	if dir := os.Getenv("CREDENTIAL_DIR"); dir != "" {
+		return dir
+	}
+	return "build/credentials"
+}
@@ -1,13 +1,9 @@
 package account
 
 import (
-	"crypto/rand"
 	"errors"
 	"fmt"
-	"math/big"
 	"net/http"
-	"net/smtp"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -17,6 +13,7 @@ import (
 
 	"github.com/AsterNighT/software-engineering-backend/api"
 	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/keyring"
 	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo/v4"
@@ -25,6 +22,39 @@ import (
 
 type AccountHandler struct{}
 
+// accountFields are what a new account is made of, whether it signs up or is imported.
+type accountFields struct {
+	Email string `json:"email" validate:"required"`
+
+	Type      models.AcountType `json:"type" validate:"required"`
+	FirstName string            `json:"firstname" validate:"required"`
+	LastName  string            `json:"lastname" validate:"required"`
+
+	BirthString string `json:"birthday" validate:"required"`
+	Gender      string `json:"gender" validate:"required"`
+}
+
+/**
+ * @brief check fields against the rules of a new account, returning the birthday on success.
+ */
+func (fields *accountFields) check(db *gorm.DB) (time.Time, api.Code) {
+	if ok, _ := regexp.MatchString(`^\w+@\w+[.\w+]+$`, fields.Email); !ok {
+		return time.Time{}, api.InvalidEmail
+	}
+	// Admins are created by other admins, never through signup
+	if fields.Type != models.PatientType && fields.Type != models.DoctorType {
+		return time.Time{}, api.InvalidAccountType
+	}
+	birthday, err := time.Parse("2006-01-02", fields.BirthString)
+	if err != nil {
+		return time.Time{}, api.InvalidBirthday
+	}
+	if err := db.Where("email = ?", fields.Email).First(&models.Account{}).Error; err == nil {
+		return time.Time{}, api.AccountOccupied
+	}
+	return birthday, ""
+}
+
 // @Summary create and account based on email(as id), type, name and password
 // @Description will check primarykey other, then add to accountList if possible
 // @Tags Account
@@ -41,39 +71,23 @@ type AccountHandler struct{}
 // @Router /account/create [POST]
 func (h *AccountHandler) CreateAccount(c echo.Context) error {
 	type RequestBody struct {
-		Email string `json:"email" validate:"required"`
-
-		Type      models.AcountType `json:"type" validate:"required"`
-		FirstName string            `json:"firstname" validate:"required"`
-		LastName  string            `json:"lastname" validate:"required"`
-		Passwd    string            `json:"passwd" validate:"required"`
-
-		BirthString string `json:"birthday" validate:"required"`
-		Gender      string `json:"gender" validate:"required"`
+		accountFields
+		Passwd string `json:"passwd" validate:"required"`
 	}
 
 	var body RequestBody
 	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", err.Error()))
-	}
-	if ok, _ := regexp.MatchString(`^\w+@\w+[.\w+]+$`, body.Email); !ok {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid E-mail Address", nil))
-	}
-	if body.Type != models.PatientType && body.Type != models.DoctorType && body.Type != models.AdminType {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid Account Type", nil))
-	}
-
-	AccountPasswdLen, _ := strconv.Atoi(os.Getenv("PASSWD_MIN_LEN"))
-	if len(body.Passwd) < AccountPasswdLen {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid Password Length", nil))
+		return api.Fail(c, api.InvalidRequest, err.Error())
 	}
 
 	db, _ := c.Get("db").(*gorm.DB)
-	if err := db.Where("email = ?", body.Email).First(&models.Account{}).Error; err == nil {
-		return c.JSON(http.StatusBadRequest, api.Return("E-Mail or AccountID occupied", nil))
+	birthDay, code := body.check(db)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	if violations := currentPasswdPolicy().Check(body.Passwd, body.Email); len(violations) > 0 {
+		return passwdRejected(c, violations)
 	}
-
-	birthDay, _ := time.Parse("2006-01-02", body.BirthString)
 
 	account := models.Account{
 		Email: body.Email,
@@ -83,6 +97,8 @@ func (h *AccountHandler) CreateAccount(c echo.Context) error {
 		LastName:  body.LastName,
 		Passwd:    body.Passwd,
 
+		PasswdChangedAt: time.Now(),
+
 		Gender:   body.Gender,
 		Birthday: birthDay,
 	}
@@ -90,38 +106,33 @@ func (h *AccountHandler) CreateAccount(c echo.Context) error {
 
 	// Add account
 	if result := db.Create(&account); result.Error != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("DB error", result.Error.Error()))
+		return api.Fail(c, api.DBError, result.Error.Error())
 	}
 
 	// Update account id since it's auto-gen by db
 	if err := db.Where("email = ?", account.Email).First(&account).Error; err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("DB error", err.Error()))
+		return api.Fail(c, api.DBError, err.Error())
 	}
 
-	if account.Type == "doctor" {
-		doctor := models.Doctor{AccountID: account.ID, Email: account.Email}
-		if result := db.Create(&doctor); result.Error != nil {
-			return c.JSON(http.StatusBadRequest, api.Return("DB error", result.Error.Error()))
-		}
-	} else if account.Type == "patient" {
-		patient := models.Patient{AccountID: account.ID, Email: account.Email}
-		if result := db.Create(&patient); result.Error != nil {
-			return c.JSON(http.StatusBadRequest, api.Return("DB error", result.Error.Error()))
-		}
-	} else {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid account type:", account.Type))
+	if err := createRoleRow(db, &account); err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	if err := recordPasswd(db, &account); err != nil {
+		return api.Fail(c, api.DBError, err.Error())
 	}
 
-	token, err := account.GenerateToken()
+	// The account stays unverified until the code sent here comes back
+	if err := sendAuthCode(c, db, account.Email, models.VerifyPurpose, "verify_email"); err != nil {
+		c.Logger().Error("fail to send verification email: ", err)
+	}
 
+	data, err := issueTokens(c, db, &account, "", false)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, api.Return("fail to generete token", err.Error()))
+		return api.Fail(c, api.TokenError, err.Error())
 	}
+	data["totp_required"] = totpRequired(account.Type)
 
-	return c.JSON(http.StatusOK, api.Return("Created", echo.Map{
-		"account": account,
-		"token":   token,
-	}))
+	return c.JSON(http.StatusOK, api.Return("Created", data))
 }
 
 // @Summary set doctor info
@@ -140,13 +151,13 @@ func (h *AccountHandler) SetDoctor(c echo.Context) error {
 
 	var body RequestBody
 	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", err.Error()))
+		return api.Fail(c, api.InvalidRequest, err.Error())
 	}
 
 	db, _ := c.Get("db").(*gorm.DB)
 
 	if result := db.Model(&models.Doctor{}).Where("account_id = ?", accountID).Update("department", body.DepartmentID); result.Error != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("DB error", result.Error.Error()))
+		return api.Fail(c, api.DBError, result.Error.Error())
 	}
 	return c.JSON(http.StatusOK, api.Return("Doctor set", nil))
 }
@@ -167,13 +178,20 @@ func (h *AccountHandler) SetPatient(c echo.Context) error {
 
 	var body RequestBody
 	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", err.Error()))
+		return api.Fail(c, api.InvalidRequest, err.Error())
 	}
 
 	db, _ := c.Get("db").(*gorm.DB)
 
-	if result := db.Model(&models.Patient{}).Where("account_id = ?", accountID).Updates(map[string]interface{}{"allergy": body.Allergy}); result.Error != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("DB error", result.Error.Error()))
+	var patient models.Patient
+	if err := db.Where("account_id = ?", accountID).First(&patient).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return reportAllergy(tx, patient.ID, accountID.(uint), body.Allergy)
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
 	}
 	return c.JSON(http.StatusOK, api.Return("Patient set", nil))
 }
@@ -193,29 +211,29 @@ func (h *AccountHandler) CheckEmail(c echo.Context) error {
 	var body RequestBody
 
 	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", err.Error()))
+		return api.Fail(c, api.InvalidRequest, err.Error())
 	}
 
 	if ok, _ := regexp.MatchString(`^\w+@\w+[.\w+]+$`, body.Email); !ok {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid E-mail Address", nil))
+		return api.Fail(c, api.InvalidEmail, nil)
 	}
 
 	db, _ := c.Get("db").(*gorm.DB)
 	var account models.Account
 	if err := db.Where("email = ?", body.Email).First(&account).Error; err != nil { // not found
-		return c.JSON(http.StatusBadRequest, api.Return("E-Mail", echo.Map{"emailok": false}))
+		return api.Fail(c, api.EmailNotFound, echo.Map{"emailok": false})
 	}
 	return c.JSON(http.StatusOK, api.Return("E-Mail", echo.Map{"emailok": true}))
 
 }
 
 // @Summary login using email and passwd
-// @Description
 // @Tags Account
 // @Produce json
 // @Param email body string true "user e-mail"
 // @Param passwd body string true "user password"
-// @Success 200 {string} api.ReturnedData{data=echo.Map{"account": account, "token": token,}
+// @Description accounts with TOTP enabled get a challenge instead of tokens, to be exchanged at /account/login/totp
+// @Success 200 {string} api.ReturnedData{data=echo.Map{"account": account, "token": token, "refresh_token": refreshToken, "expires_in": seconds}
 // @Failure 400 {string} api.ReturnedData{data=nil}
 // @Router /account/login [POST]
 func (h *AccountHandler) LoginAccount(c echo.Context) error {
@@ -226,37 +244,59 @@ func (h *AccountHandler) LoginAccount(c echo.Context) error {
 	var body RequestBody
 
 	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", err.Error()))
+		return api.Fail(c, api.InvalidRequest, err.Error())
 	}
 
 	if ok, _ := regexp.MatchString(`^\w+@\w+[.\w+]+$`, body.Email); !ok {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid E-mail Address", nil))
-	}
-
-	AccountPasswdLen, _ := strconv.Atoi(os.Getenv("PASSWD_MIN_LEN"))
-	if len(body.Passwd) < AccountPasswdLen {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid Password Length", nil))
+		return api.Fail(c, api.InvalidEmail, nil)
 	}
 
 	db, _ := c.Get("db").(*gorm.DB)
+	if wait := retryAfter(c, db, body.Email); wait > 0 {
+		return tooManyAttempts(c, wait)
+	}
 	var account models.Account
 	if err := db.Where("email = ?", body.Email).First(&account).Error; err != nil { // not found
-		return c.JSON(http.StatusBadRequest, api.Return("E-Mail", echo.Map{"emailok": false}))
+		recordFailure(c, db, "login", body.Email)
+		return api.Fail(c, api.EmailNotFound, echo.Map{"emailok": false})
 	}
 	if bcrypt.CompareHashAndPassword([]byte(account.Passwd), []byte(body.Passwd)) != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("Wrong Password", nil))
+		recordFailure(c, db, "login", body.Email)
+		return api.Fail(c, api.WrongPassword, nil)
+	}
+	clearFailures(db, body.Email)
+	if account.Disabled {
+		return api.Fail(c, api.AccountDisabled, nil)
+	}
+	// These roles log in through the identity provider, see OIDCLogin
+	if roleListed("OIDC_REQUIRED_ROLES", account.Type) {
+		return api.Fail(c, api.SSORequired, echo.Map{"sso_required": true})
+	}
+	if passwdExpired(&account) {
+		return api.Fail(c, api.PasswordExpired, echo.Map{"passwd_expired": true})
 	}
 
-	token, err := account.GenerateToken()
+	// The password alone is not enough, the challenge has to go through /account/login/totp
+	if account.TOTPEnabled {
+		challenge, err := newChallenge(&account)
+		if err != nil {
+			return api.Fail(c, api.TokenError, err.Error())
+		}
+		return c.JSON(http.StatusOK, api.Return("TOTP required", echo.Map{
+			"mfa_required": true,
+			"challenge":    challenge,
+			"expires_in":   int(challengeLifetime.Seconds()),
+		}))
+	}
 
+	data, err := issueTokens(c, db, &account, "", false)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, api.Return("fail to generete token", err.Error()))
+		return api.Fail(c, api.TokenError, err.Error())
 	}
+	// Set when the role requires TOTP but the account has not enrolled yet
+	data["totp_required"] = totpRequired(account.Type)
 
-	return c.JSON(http.StatusOK, api.Return("Logged in", echo.Map{
-		"account": account,
-		"token":   token,
-	}))
+	return c.JSON(http.StatusOK, api.Return("Logged in", data))
 }
 
 // @Summary the interface of modifying password
@@ -278,33 +318,42 @@ func (h *AccountHandler) ModifyPasswd(c echo.Context) error {
 	var body RequestBody
 
 	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", err.Error()))
+		return api.Fail(c, api.InvalidRequest, err.Error())
 	}
 
 	if ok, _ := regexp.MatchString(`^\w+@\w+[.\w+]+$`, body.Email); !ok {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid E-mail Address", nil))
+		return api.Fail(c, api.InvalidEmail, nil)
 	}
 
-	// Check old passwd
+	// Check old passwd, throttled like log in since it would guess passwords just as well
 	db, _ := c.Get("db").(*gorm.DB)
+	if wait := retryAfter(c, db, body.Email); wait > 0 {
+		return tooManyAttempts(c, wait)
+	}
 	var account models.Account
 	if err := db.Where("email = ?", body.Email).First(&account).Error; err != nil { // not found
-		return c.JSON(http.StatusBadRequest, api.Return("E-Mail", echo.Map{"emailok": false}))
+		recordFailure(c, db, "modifypasswd", body.Email)
+		return api.Fail(c, api.EmailNotFound, echo.Map{"emailok": false})
 	}
 	if bcrypt.CompareHashAndPassword([]byte(account.Passwd), []byte(body.Passwd)) != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("Wrong Password", nil))
+		recordFailure(c, db, "modifypasswd", body.Email)
+		return api.Fail(c, api.WrongPassword, nil)
 	}
-
-	AccountPasswdLen, _ := strconv.Atoi(os.Getenv("PASSWD_MIN_LEN"))
-	if len(body.NewPasswd) < AccountPasswdLen {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid Password Length", nil))
+	clearFailures(db, body.Email)
+	if account.Disabled {
+		return api.Fail(c, api.AccountDisabled, nil)
 	}
 
-	account.Passwd = body.NewPasswd
-	account.HashPassword()
+	if violations := checkPasswd(db, &account, body.NewPasswd); len(violations) > 0 {
+		return passwdRejected(c, violations)
+	}
+	if err := setPasswd(db, &account, body.NewPasswd); err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
 
-	if result := db.Model(&models.Account{}).Where("id = ?", account.ID).Update("passwd", account.Passwd); result.Error != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("DB error", result.Error.Error()))
+	// Sessions opened with the old password must not survive the change
+	if err := revokeAllTokens(db, account.ID); err != nil {
+		return api.Fail(c, api.DBError, err.Error())
 	}
 
 	return c.JSON(http.StatusOK, api.Return("Successfully modified", nil))
@@ -316,7 +365,7 @@ func (h *AccountHandler) ModifyPasswd(c echo.Context) error {
 // @Produce json
 // @Param email body string true "user e-mail"
 // @Success 200 {string} api.ReturnedData{data=nil}
-// @Failure 400 {string} api.ReturnedData{data=echo.Map{"authCode": authCode}}
+// @Failure 500 {string} api.ReturnedData{data=nil}
 // @Router /account/sendemail [POST]
 func (h *AccountHandler) SendEmail(c echo.Context) error {
 	type RequestBody struct {
@@ -325,58 +374,17 @@ func (h *AccountHandler) SendEmail(c echo.Context) error {
 	var body RequestBody
 
 	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", err.Error()))
+		return api.Fail(c, api.InvalidRequest, err.Error())
 	}
 
 	if ok, _ := regexp.MatchString(`^\w+@\w+[.\w+]+$`, body.Email); !ok {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid E-mail Address", nil))
+		return api.Fail(c, api.InvalidEmail, nil)
 	}
 
 	db, _ := c.Get("db").(*gorm.DB)
-
-	authCode := ""
-	for i := 0; i < 6; i++ {
-		nBig, _ := rand.Int(rand.Reader, big.NewInt(10))
-		authCode += string("0123456789"[nBig.Int64()])
-	}
-	c.Logger().Debug(authCode)
-
-	if tmp := db.Model(&models.Auth{}).Where("email = ?", body.Email).Update("auth_code", authCode); tmp.Error != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("DB error", tmp.Error))
-	}
-
-	emailServerHost := os.Getenv("EMAIL_SERVER_HOST")
-	emailServerPort := os.Getenv("EMAIL_SERVER_PORT")
-	emailUser := os.Getenv("EMAIL_USER")
-	emailPasswd := os.Getenv("EMAIL_PASSWD")
-	expireMin, _ := strconv.Atoi(os.Getenv("EMAIL_VALID_MIN"))
-
-	auth := models.Auth{
-		Email:           body.Email,
-		AuthCode:        authCode,
-		AuthCodeExpires: time.Now().Add(time.Duration(expireMin) * time.Minute),
-	}
-
-	db.Delete(&auth)
-
-	if tmp := db.Model(&models.Auth{}).Where("email = ?", body.Email).Update("auth_code", authCode); tmp.Error != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("DB error", tmp.Error))
-	}
-
-	if result := db.Create(&auth); result.Error != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("DB error", result.Error.Error()))
-	}
-
-	emailAuth := smtp.PlainAuth("", emailUser, emailPasswd, emailServerHost)
-	to := body.Email
-	msg := []byte("From: \"MediConnect\" <noreply@mediconnect.com>\n" +
-		"To: " + to + "\n" +
-		"Subject: MediConnect Account Reset\n" +
-		"Content-Type: text/plain; charset=\"UTF-8\"\n" +
-		"\n" +
-		"Your verification code is " + authCode + " (Only valid in " + strconv.Itoa(expireMin) + " minutes)\n")
-	if err := smtp.SendMail(emailServerHost+":"+emailServerPort, emailAuth, emailUser, []string{to}, msg); err != nil {
-		return c.JSON(http.StatusOK, api.Return("Email server error", echo.Map{"err": err, "msg": msg}))
+	if err := sendAuthCode(c, db, body.Email, models.ResetPurpose, "reset_password"); err != nil {
+		c.Logger().Error("fail to send reset email: ", err)
+		return api.Fail(c, api.MailServerError, nil)
 	}
 
 	return c.JSON(http.StatusOK, api.Return("Successfully send reset email", nil))
@@ -402,23 +410,22 @@ func (h *AccountHandler) CheckAuthCode(c echo.Context) error {
 	var body RequestBody
 
 	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", err.Error()))
+		return api.Fail(c, api.InvalidRequest, err.Error())
 	}
 
 	if ok, _ := regexp.MatchString(`^\w+@\w+[.\w+]+$`, body.Email); !ok {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid E-mail Address", nil))
+		return api.Fail(c, api.InvalidEmail, nil)
 	}
 
 	// Check authcode
 	db, _ := c.Get("db").(*gorm.DB)
-	var auth models.Auth
-	if err := db.Where("email = ?", body.Email).First(&auth).Error; err != nil { // not found
-		return c.JSON(http.StatusBadRequest, api.Return("E-Mail", echo.Map{"emailok": false}))
+	if wait := retryAfter(c, db, body.Email); wait > 0 {
+		return tooManyAttempts(c, wait)
 	}
-	if auth.AuthCode == body.AuthCode && time.Now().Before(auth.AuthCodeExpires) {
+	if verifyAuthCode(c, db, "checkauthcode", body.Email, body.AuthCode, models.ResetPurpose) {
 		return c.JSON(http.StatusOK, api.Return("AuthCode", echo.Map{"authcodeok": true}))
 	}
-	return c.JSON(http.StatusBadRequest, api.Return("AuthCode", echo.Map{"authcodeok": false}))
+	return api.Fail(c, api.WrongAuthCode, echo.Map{"authcodeok": false})
 
 }
 
@@ -441,40 +448,42 @@ func (h *AccountHandler) ResetPasswd(c echo.Context) error {
 	var body RequestBody
 
 	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", err.Error()))
+		return api.Fail(c, api.InvalidRequest, err.Error())
 	}
 
 	if ok, _ := regexp.MatchString(`^\w+@\w+[.\w+]+$`, body.Email); !ok {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid E-mail Address", nil))
+		return api.Fail(c, api.InvalidEmail, nil)
 	}
 
 	// Check authcode
 	db, _ := c.Get("db").(*gorm.DB)
+	if wait := retryAfter(c, db, body.Email); wait > 0 {
+		return tooManyAttempts(c, wait)
+	}
 	var account models.Account
-	var auth models.Auth
 	if err := db.Where("email = ?", body.Email).First(&account).Error; err != nil { // not found
-		return c.JSON(http.StatusBadRequest, api.Return("E-Mail", echo.Map{"emailok": false}))
+		return api.Fail(c, api.EmailNotFound, echo.Map{"emailok": false})
 	}
-	if err := db.Where("email = ?", body.Email).First(&auth).Error; err != nil { // not found
-		return c.JSON(http.StatusBadRequest, api.Return("E-Mail", echo.Map{"emailok": false}))
+	if !verifyAuthCode(c, db, "resetpasswd", body.Email, body.AuthCode, models.ResetPurpose) {
+		return api.Fail(c, api.WrongAuthCode, echo.Map{"authcodeok": false})
 	}
 
-	if auth.AuthCode != body.AuthCode || time.Now().After(auth.AuthCodeExpires) {
-		return c.JSON(http.StatusBadRequest, api.Return("AuthCode", echo.Map{"authcodeok": false}))
+	if violations := checkPasswd(db, &account, body.NewPasswd); len(violations) > 0 {
+		return passwdRejected(c, violations)
 	}
-
-	AccountPasswdLen, _ := strconv.Atoi(os.Getenv("PASSWD_MIN_LEN"))
-	if len(body.NewPasswd) < AccountPasswdLen {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid Password Length", nil))
+	if err := setPasswd(db, &account, body.NewPasswd); err != nil {
+		return api.Fail(c, api.DBError, err.Error())
 	}
 
-	account.Passwd = body.NewPasswd
-	account.HashPassword()
-
-	if result := db.Model(&models.Account{}).Where("id = ?", account.ID).Update("passwd", account.Passwd); result.Error != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("DB error", result.Error.Error()))
+	// Sessions opened with the old password must not survive the change
+	if err := revokeAllTokens(db, account.ID); err != nil {
+		return api.Fail(c, api.DBError, err.Error())
 	}
 
+	// The code is single-use
+	db.Where("email = ? AND purpose = ?", body.Email, models.ResetPurpose).Delete(&models.Auth{})
+	clearFailures(db, body.Email)
+
 	return c.JSON(http.StatusOK, api.Return("Successfully modified", nil))
 }
 
@@ -491,7 +500,7 @@ func (h *AccountHandler) GetInfo(c echo.Context) error {
 	db, _ := c.Get("db").(*gorm.DB)
 	var account models.Account
 	if err := db.Where("id = ?", id).First(&account).Error; err != nil { // not found
-		return c.JSON(http.StatusBadRequest, api.Return("Not logged in", nil))
+		return api.Fail(c, api.NotLoggedIn, nil)
 	}
 
 	fmtBirth := fmt.Sprintf("%04d-%02d-%02d", account.Birthday.Year(), account.Birthday.Month(), account.Birthday.Day())
@@ -499,17 +508,17 @@ func (h *AccountHandler) GetInfo(c echo.Context) error {
 	if account.Type == "doctor" {
 		var doctor models.Doctor
 		if err := db.Where("account_id = ?", id).First(&doctor).Error; err != nil { // not found
-			return c.JSON(http.StatusBadRequest, api.Return("Wrong account id for doctor", nil))
+			return api.Fail(c, api.DoctorNotFound, nil)
 		}
-		return c.JSON(http.StatusOK, api.Return("Successfully Get", echo.Map{"id": account.ID, "email": account.Email, "type": account.Type, "firstname": account.FirstName, "lastname": account.LastName, "gender": account.Gender, "birthday": fmtBirth, "department": doctor.Department}))
+		return c.JSON(http.StatusOK, api.Return("Successfully Get", echo.Map{"id": account.ID, "email": account.Email, "type": account.Type, "firstname": account.FirstName, "lastname": account.LastName, "gender": account.Gender, "birthday": fmtBirth, "department": doctor.Department, "status": doctor.Status, "pending_email": account.PendingEmail}))
 	} else if account.Type == "patient" {
 		var patient models.Patient
 		if err := db.Where("account_id = ?", id).First(&patient).Error; err != nil { // not found
-			return c.JSON(http.StatusBadRequest, api.Return("Wrong account id for patient", nil))
+			return api.Fail(c, api.PatientNotFound, nil)
 		}
-		return c.JSON(http.StatusOK, api.Return("Successfully Get", echo.Map{"id": account.ID, "email": account.Email, "type": account.Type, "firstname": account.FirstName, "lastname": account.LastName, "gender": account.Gender, "birthday": fmtBirth, "allergy": patient.Allergy}))
+		return c.JSON(http.StatusOK, api.Return("Successfully Get", echo.Map{"id": account.ID, "email": account.Email, "type": account.Type, "firstname": account.FirstName, "lastname": account.LastName, "gender": account.Gender, "birthday": fmtBirth, "allergy": patient.Allergy, "nationalid": patient.NationalID, "insurancenumber": patient.InsuranceNumber, "pending_email": account.PendingEmail}))
 	} else {
-		return c.JSON(http.StatusBadRequest, api.Return("Invalid account type: ", account.Type))
+		return api.Fail(c, api.InvalidAccountType, account.Type)
 	}
 }
 
@@ -529,11 +538,11 @@ func (h *AccountHandler) GetInfoByPatID(c echo.Context) error {
 	db, _ := c.Get("db").(*gorm.DB)
 
 	if err := db.Where("account_id = ?", patID).First(&patient).Error; err != nil { // not found
-		return c.JSON(http.StatusBadRequest, api.Return("Wrong Patient ID", nil))
+		return api.Fail(c, api.PatientNotFound, nil)
 	}
 
 	if err := db.Where("id = ?", patient.AccountID).First(&account).Error; err != nil { // not found
-		return c.JSON(http.StatusBadRequest, api.Return("Wrong Account ID", nil))
+		return api.Fail(c, api.AccountNotFound, nil)
 	}
 
 	fmtBirth := fmt.Sprintf("%04d-%02d-%02d", account.Birthday.Year(), account.Birthday.Month(), account.Birthday.Day())
@@ -542,57 +551,111 @@ func (h *AccountHandler) GetInfoByPatID(c echo.Context) error {
 }
 
 /**
- * @brief public method for getting current logged-in account's ID.
+ * @brief create the doctor or patient row belonging to account if it does not exist yet.
+ */
+func createRoleRow(db *gorm.DB, account *models.Account) error {
+	switch account.Type {
+	case models.DoctorType:
+		doctor := models.Doctor{AccountID: account.ID, Email: account.Email}
+		return db.Where("account_id = ?", account.ID).FirstOrCreate(&doctor).Error
+	case models.PatientType:
+		patient := models.Patient{AccountID: account.ID, Email: account.Email}
+		return db.Where("account_id = ?", account.ID).FirstOrCreate(&patient).Error
+	case models.AdminType:
+		return nil
+	}
+	return fmt.Errorf("invalid account type: %s", account.Type)
+}
+
+/**
+ * @brief method for getting the claims of current logged-in account's token.
  */
-func getAccountID(c echo.Context) (uint, error) {
+func getTokenClaims(c echo.Context) (*models.TokenClaims, error) {
 	auth := c.Request().Header.Get("Authorization")
 	if auth == "" {
 		auth = c.QueryParam("token")
 	} else {
 		words := strings.Split(auth, "Bearer ")
 		if len(words) != 2 {
-			return 0, errors.New("invalid authorization header")
+			return nil, errors.New("invalid authorization header")
 		}
 		auth = words[1]
 	}
-	c.Logger().Debug("get token: ", auth)
-	id, err := ParseToken(auth)
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
+	return ParseClaims(auth)
+}
+
+// Routes which accounts of the roles in TOTP_REQUIRED_ROLES reach before their login passed TOTP,
+// so that they can enroll. Refreshing keeps the mfa claim of the login and needs no access token.
+var mfaExempt = map[string]bool{
+	"/api/account/totp/enroll":  true,
+	"/api/account/totp/confirm": true,
+	"/api/account/logout":       true,
 }
 
 /**
  * @brief middleware for getting current logged-in account's ID.
+ * Requests carrying an API key instead pass as a service principal, see checkAPIKey.
+ * Accounts of the roles in TOTP_REQUIRED_ROLES need a token from a TOTP login, except on mfaExempt routes.
  */
 func CheckAccountID(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		id, err := getAccountID(c)
+		if key := requestAPIKey(c.Request()); key != "" {
+			return checkAPIKey(c, key, next)
+		}
+		claims, err := getTokenClaims(c)
+		if err != nil {
+			return api.Fail(c, api.InvalidToken, err.Error())
+		}
+		if totpRequired(claims.Type) && !claims.MFA && !mfaExempt[c.Path()] {
+			return api.Fail(c, api.TOTPRequired, nil)
+		}
+		db, _ := c.Get("db").(*gorm.DB)
+		account, err := loadTokenAccount(db, claims)
 		if err != nil {
-			return c.JSON(403, api.Return("fail to get id from token", err.Error()))
+			return api.Fail(c, api.InvalidToken, err.Error())
 		}
-		c.Set("id", id)
+		c.Set("id", claims.AccountID)
+		c.Set("verified", account.EmailVerified)
+		c.Set("type", claims.Type)
+		c.Set("doctorID", claims.DoctorID)
+		c.Set("patientID", claims.PatientID)
+		c.Set("claims", claims)
 		return next(c)
 	}
 }
 
 func ParseToken(tokenString string) (uint, error) {
+	claims, err := ParseClaims(tokenString)
+	if err != nil {
+		return 0, err
+	}
+	return claims.AccountID, nil
+}
+
+// ParseClaims verifies the signature and expiry of an access token.
+// It does not consult the revocation store, CheckAccountID does.
+func ParseClaims(tokenString string) (*models.TokenClaims, error) {
+	claims, err := parseSigned(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	// Login challenges are signed with the same key but grant nothing
+	if claims.Purpose != "" {
+		return nil, errors.New("not an access token")
+	}
+	return claims, nil
+}
+
+func parseSigned(tokenString string) (*models.TokenClaims, error) {
 	if tokenString == "" {
-		return 0, fmt.Errorf("cannot find auth token")
+		return nil, fmt.Errorf("cannot find auth token")
 	}
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.MapClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(os.Getenv("JWT_KEY")), nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, &models.TokenClaims{}, keyring.Keyfunc)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	if claims, ok := token.Claims.(*jwt.MapClaims); ok && token.Valid {
-		fmt.Println(claims)
-		return uint((*claims)["id"].(float64)), nil
+	if claims, ok := token.Claims.(*models.TokenClaims); ok && token.Valid {
+		return claims, nil
 	}
-	return 0, err
+	return nil, errors.New("invalid token")
 }
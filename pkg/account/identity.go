@@ -0,0 +1,389 @@
+package account
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// patientIdentifiers are the optional identifiers of a patient in a request body.
+// nil leaves one unchanged, an empty string removes it.
+type patientIdentifiers struct {
+	NationalID      *string `json:"nationalid"`
+	InsuranceNumber *string `json:"insurancenumber"`
+}
+
+func (ids *patientIdentifiers) given() bool {
+	return ids.NationalID != nil || ids.InsuranceNumber != nil
+}
+
+/**
+ * @brief check the identifiers for patient, returning the column updates.
+ * An identifier must be well-formed and belong to no other patient.
+ */
+func (ids *patientIdentifiers) updates(db *gorm.DB, patientID uint) (map[string]interface{}, api.Code) {
+	updates := map[string]interface{}{}
+	for _, field := range []struct {
+		value   *string
+		column  string
+		valid   func(string) bool
+		invalid api.Code
+		taken   api.Code
+	}{
+		{ids.NationalID, "national_id", utils.ValidNationalID, api.InvalidNationalID, api.NationalIDTaken},
+		{ids.InsuranceNumber, "insurance_number", utils.ValidInsuranceNumber, api.InvalidInsuranceNumber, api.InsuranceNumberTaken},
+	} {
+		if field.value == nil {
+			continue
+		}
+		value := utils.NormalizeIdentifier(*field.value)
+		if value == "" {
+			updates[field.column] = nil
+			continue
+		}
+		if !field.valid(value) {
+			return nil, field.invalid
+		}
+		var taken int64
+		db.Model(&models.Patient{}).Where(field.column+" = ? AND id <> ?", value, patientID).Count(&taken)
+		if taken > 0 {
+			return nil, field.taken
+		}
+		updates[field.column] = value
+	}
+	return updates, ""
+}
+
+// PatientSummary is a patient as shown in the duplicate report.
+type PatientSummary struct {
+	PatientID       uint      `json:"patient_id"`
+	AccountID       uint      `json:"account_id"`
+	Email           string    `json:"email"`
+	FirstName       string    `json:"firstname"`
+	LastName        string    `json:"lastname"`
+	Birthday        time.Time `json:"birthday"`
+	NationalID      *string   `json:"nationalid"`
+	InsuranceNumber *string   `json:"insurancenumber"`
+	Managed         bool      `json:"managed"`
+}
+
+// DuplicateCandidate is a pair of patients which may be the same person.
+type DuplicateCandidate struct {
+	Patients [2]PatientSummary `json:"patients"`
+	Reasons  []string          `json:"reasons"` // name_birthday, identifier, national_id_birthday
+}
+
+// @Summary list pairs of patients which may be the same person
+// @Description patients match on name (in either order) and birthday, on a national ID given as the other's insurance number, or on last name and the birthday encoded in a national ID
+// @Tags Admin
+// @Produce json
+// @Param page query int false "page number, starting from 1"
+// @Param size query int false "page size, at most 100"
+// @Success 200 {object} api.ReturnedData{data=[]DuplicateCandidate}
+// @Router /admin/patients/duplicates [GET]
+func (h *AdminHandler) ListDuplicatePatients(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	var patients []PatientSummary
+	err := db.Table("patients").
+		Select("patients.id AS patient_id, patients.account_id, accounts.email, accounts.first_name, accounts.last_name, " +
+			"accounts.birthday, patients.national_id, patients.insurance_number, accounts.managed").
+		Joins("JOIN accounts ON accounts.id = patients.account_id").
+		Where("patients.merged_into IS NULL").Order("patients.id").Scan(&patients).Error
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+
+	candidates := duplicateCandidates(patients)
+	page, size := utils.Pagination(c)
+	from, to := (page-1)*size, page*size
+	if from > len(candidates) {
+		from = len(candidates)
+	}
+	if to > len(candidates) {
+		to = len(candidates)
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", echo.Map{"total": len(candidates), "candidates": candidates[from:to]}))
+}
+
+/**
+ * @brief pair up the patients sharing a key, see ListDuplicatePatients.
+ */
+func duplicateCandidates(patients []PatientSummary) []DuplicateCandidate {
+	groups := map[string][]int{}
+	add := func(reason string, key string, i int) {
+		groups[reason+"\x00"+key] = append(groups[reason+"\x00"+key], i)
+	}
+	for i, p := range patients {
+		first := strings.ToLower(strings.TrimSpace(p.FirstName))
+		last := strings.ToLower(strings.TrimSpace(p.LastName))
+		if first != "" || last != "" {
+			// Family and given names are often swapped between registrations
+			name := []string{first, last}
+			sort.Strings(name)
+			add("name_birthday", strings.Join(name, "\x00")+"\x00"+p.Birthday.Format("2006-01-02"), i)
+		}
+		// Many insurance numbers are the holder's national ID
+		ids := map[string]bool{}
+		for _, id := range []*string{p.NationalID, p.InsuranceNumber} {
+			if id != nil && !ids[*id] {
+				ids[*id] = true
+				add("identifier", *id, i)
+			}
+		}
+		if p.NationalID != nil {
+			if birthday, ok := utils.NationalIDBirthday(*p.NationalID); ok {
+				add("national_id_birthday", last+"\x00"+birthday.Format("2006-01-02"), i)
+			}
+		}
+		add("national_id_birthday", last+"\x00"+p.Birthday.Format("2006-01-02"), i)
+	}
+
+	reasons := map[[2]int][]string{}
+	for key, members := range groups {
+		reason := key[:strings.IndexByte(key, 0)]
+		for a := 0; a < len(members); a++ {
+			for b := a + 1; b < len(members); b++ {
+				pair := [2]int{members[a], members[b]}
+				if pair[0] == pair[1] {
+					continue
+				}
+				if pair[0] > pair[1] {
+					pair[0], pair[1] = pair[1], pair[0]
+				}
+				if !contains(reasons[pair], reason) {
+					reasons[pair] = append(reasons[pair], reason)
+				}
+			}
+		}
+	}
+
+	candidates := []DuplicateCandidate{}
+	for pair, why := range reasons {
+		// Sharing last name and birthday is only telling when a national ID vouches for the birthday
+		if !nationalIDMatch(patients[pair[0]], patients[pair[1]]) {
+			why = remove(why, "national_id_birthday")
+		}
+		if len(why) == 0 {
+			continue
+		}
+		sort.Strings(why)
+		candidates = append(candidates, DuplicateCandidate{
+			Patients: [2]PatientSummary{patients[pair[0]], patients[pair[1]]},
+			Reasons:  why,
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i].Patients, candidates[j].Patients
+		if a[0].PatientID != b[0].PatientID {
+			return a[0].PatientID < b[0].PatientID
+		}
+		return a[1].PatientID < b[1].PatientID
+	})
+	return candidates
+}
+
+// nationalIDMatch tells whether the national ID of one patient encodes the birthday of the other.
+func nationalIDMatch(a PatientSummary, b PatientSummary) bool {
+	for _, pair := range [][2]PatientSummary{{a, b}, {b, a}} {
+		if pair[0].NationalID == nil {
+			continue
+		}
+		if birthday, ok := utils.NationalIDBirthday(*pair[0].NationalID); ok && birthday.Format("2006-01-02") == pair[1].Birthday.Format("2006-01-02") {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(list []string, s string) []string {
+	kept := list[:0]
+	for _, item := range list {
+		if item != s {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// @Summary merge a duplicate patient into another
+// @Description registrations, cases, allergies, delegations and missing identifiers move to the surviving patient, and the duplicate's account is disabled.
+// @Description Chats are not stored, so there are none to move
+// @Tags Admin
+// @Produce json
+// @Param patientID path uint true "patient ID of the duplicate"
+// @Param into body uint true "patient ID surviving"
+// @Param note body string false "why the two are the same person"
+// @Success 200 {object} api.ReturnedData{data=models.PatientMerge}
+// @Failure 400 {object} api.ReturnedData{}
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /admin/patients/{patientID}/merge [POST]
+func (h *AdminHandler) MergePatients(c echo.Context) error {
+	type RequestBody struct {
+		Into uint   `json:"into" validate:"required"`
+		Note string `json:"note"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	merge := models.PatientMerge{MergedBy: c.Get("id").(uint), Note: body.Note}
+	var code api.Code
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var source, target models.Patient
+		// Both rows are locked, lest two merges of the same patients cross
+		locking := tx.Clauses(clause.Locking{Strength: "UPDATE"})
+		if err := locking.First(&source, c.Param("patientID")).Error; err != nil {
+			code = api.PatientNotFound
+			return err
+		}
+		if err := locking.First(&target, body.Into).Error; err != nil {
+			code = api.MergeTargetNotFound
+			return err
+		}
+		if source.ID == target.ID || source.MergedInto != nil || target.MergedInto != nil {
+			code = api.PatientsNotMergeable
+			return errors.New(string(code))
+		}
+		merge.SourceID, merge.TargetID = source.ID, target.ID
+		merge.SourceAccountID, merge.TargetAccountID = source.AccountID, target.AccountID
+		return mergePatient(tx, &source, &target, &merge)
+	})
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Patients merged", merge))
+}
+
+/**
+ * @brief move everything of source to target and retire source, see MergePatients.
+ */
+func mergePatient(tx *gorm.DB, source *models.Patient, target *models.Patient, merge *models.PatientMerge) error {
+	now := time.Now()
+	var caseIDs []uint
+	// Deleted cases move too, lest a restore bring them back under the retired account
+	tx.Unscoped().Model(&models.Case{}).Where("patient_id = ?", source.AccountID).Pluck("id", &caseIDs)
+	steps := []*gorm.DB{
+		// Registration.PatientID is Patient.ID, Case.PatientID is the account ID
+		tx.Model(&models.Registration{}).Where("patient_id = ?", source.ID).Update("patient_id", target.ID),
+		tx.Unscoped().Model(&models.Case{}).Where("patient_id = ?", source.AccountID).Update("patient_id", target.AccountID),
+	}
+	for _, step := range steps {
+		if step.Error != nil {
+			return step.Error
+		}
+	}
+	reason := fmt.Sprintf("Patient %d merged into %d", source.ID, target.ID)
+	for _, caseID := range caseIDs {
+		if err := models.RecordCaseRevision(tx, caseID, models.CaseUpdated, merge.MergedBy, reason); err != nil {
+			return err
+		}
+	}
+	if err := mergeAllergies(tx, source, target, merge.MergedBy); err != nil {
+		return err
+	}
+
+	// Whoever acted for the duplicate acts for the survivor, unless it already does or is the survivor
+	var delegations []models.PatientDelegation
+	if err := tx.Where("patient_id = ? AND revoked_at IS NULL", source.ID).Find(&delegations).Error; err != nil {
+		return err
+	}
+	for _, delegation := range delegations {
+		var existing int64
+		tx.Model(&models.PatientDelegation{}).
+			Where("patient_id = ? AND account_id = ? AND revoked_at IS NULL", target.ID, delegation.AccountID).Count(&existing)
+		update := map[string]interface{}{"patient_id": target.ID}
+		if existing > 0 || delegation.AccountID == target.AccountID {
+			update = map[string]interface{}{"revoked_at": now}
+		}
+		if err := tx.Model(&delegation).Updates(update).Error; err != nil {
+			return err
+		}
+	}
+
+	// Identifiers are unique, the duplicate gives its up before the survivor takes the missing ones
+	ids := map[string]interface{}{}
+	if target.NationalID == nil && source.NationalID != nil {
+		ids["national_id"] = *source.NationalID
+	}
+	if target.InsuranceNumber == nil && source.InsuranceNumber != nil {
+		ids["insurance_number"] = *source.InsuranceNumber
+	}
+	err := tx.Model(source).Updates(map[string]interface{}{
+		"national_id":      nil,
+		"insurance_number": nil,
+		"allergy":          "",
+		"merged_into":      target.ID,
+	}).Error
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		if err := tx.Model(target).Updates(ids).Error; err != nil {
+			return err
+		}
+	}
+
+	// The duplicate's own credentials stop working, the person uses the survivor's
+	if source.AccountID != target.AccountID {
+		if err := tx.Model(&models.Account{}).Where("id = ?", source.AccountID).Update("disabled", true).Error; err != nil {
+			return err
+		}
+		if err := revokeAllTokens(tx, source.AccountID); err != nil {
+			return err
+		}
+	}
+
+	merge.MergedAt = now
+	return tx.Create(merge).Error
+}
+
+/**
+ * @brief move the allergies of source to target.
+ * What the two reported themselves becomes one free text, the rest moves with its history.
+ */
+func mergeAllergies(tx *gorm.DB, source *models.Patient, target *models.Patient, by uint) error {
+	if source.Allergy != "" && source.Allergy != target.Allergy {
+		text := source.Allergy
+		if target.Allergy != "" {
+			text = fmt.Sprintf("%s; %s", target.Allergy, source.Allergy)
+		}
+		// Dropped here, the text lives on in the survivor's entry
+		if err := reportAllergy(tx, source.ID, by, ""); err != nil {
+			return err
+		}
+		if err := reportAllergy(tx, target.ID, by, text); err != nil {
+			return err
+		}
+	} else if err := reportAllergy(tx, source.ID, by, ""); err != nil {
+		return err
+	}
+
+	if err := tx.Model(&models.Allergy{}).Where("patient_id = ?", source.ID).Update("patient_id", target.ID).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.AllergyHistory{}).Where("patient_id = ?", source.ID).Update("patient_id", target.ID).Error
+}
@@ -0,0 +1,37 @@
+package account
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicateCandidates(t *testing.T) {
+	id := "11010519491231002X"
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	patients := []PatientSummary{
+		{PatientID: 1, FirstName: "Wei", LastName: "Li", Birthday: day("1949-12-31"), NationalID: &id},
+		{PatientID: 2, FirstName: "li", LastName: "WEI", Birthday: day("1949-12-31")},
+		{PatientID: 3, FirstName: "Fang", LastName: "Wang", Birthday: day("1990-01-01"), InsuranceNumber: &id},
+		{PatientID: 4, FirstName: "Lei", LastName: "Li", Birthday: day("1949-12-31")},
+		{PatientID: 5, FirstName: "Min", LastName: "Zhao", Birthday: day("1980-05-05")},
+		{PatientID: 6, FirstName: "Jun", LastName: "Zhao", Birthday: day("1980-05-05")},
+	}
+	candidates := duplicateCandidates(patients)
+
+	found := map[[2]uint][]string{}
+	for _, c := range candidates {
+		found[[2]uint{c.Patients[0].PatientID, c.Patients[1].PatientID}] = c.Reasons
+	}
+	// Swapped names, the national ID given as insurance number, a typo in the first name
+	assert.Equal(t, []string{"name_birthday"}, found[[2]uint{1, 2}])
+	assert.Equal(t, []string{"identifier"}, found[[2]uint{1, 3}])
+	assert.Equal(t, []string{"national_id_birthday"}, found[[2]uint{1, 4}])
+	// Not 5 and 6, their last name and birthday have no national ID to back them
+	require.Len(t, candidates, 3)
+}
@@ -0,0 +1,365 @@
+package account
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/mail"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// A CSV import creates every account of the file or none, so that a broken
+// row can be fixed and the whole file sent again. Imported accounts have no
+// password until their owner follows the invitation.
+const importMaxRows = 1000
+
+// importColumns are the CSV columns, department only applies to doctors and allergy to patients.
+var importColumns = []string{"email", "type", "firstname", "lastname", "birthday", "gender", "department", "allergy"}
+
+// ImportRow is the outcome of one row of an imported CSV.
+type ImportRow struct {
+	Row       int      `json:"row"` // Counted from 1, after the header
+	Email     string   `json:"email"`
+	AccountID uint     `json:"account_id,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+type importRecord struct {
+	accountFields
+	Department uint
+	Allergy    string
+	birthday   time.Time
+}
+
+// @Summary create doctor or patient accounts from a CSV file
+// @Description the header names the columns: email, type, firstname, lastname, birthday, gender, and optionally department (doctors) and allergy (patients).
+// @Description every row is checked like /account/create; with dryrun nothing is created, otherwise either all rows are or, on any error, none.
+// @Description each new account is emailed an invitation to set its password at /account/acceptinvite
+// @Tags Admin
+// @Accept multipart/form-data
+// @Produce json
+// @Param file formData file true "CSV file"
+// @Param dryrun query bool false "only check the rows"
+// @Success 200 {object} api.ReturnedData{data=[]ImportRow}
+// @Failure 400 {object} api.ReturnedData{data=[]ImportRow}
+// @Router /admin/accounts/import [POST]
+func (h *AdminHandler) ImportAccounts(c echo.Context) error {
+	dryRun, _ := strconv.ParseBool(c.QueryParam("dryrun"))
+	file, err := c.FormFile("file")
+	if err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+	src, err := file.Open()
+	if err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+	defer src.Close()
+
+	records, rows, err := readImport(src)
+	if err != nil {
+		return api.Fail(c, api.InvalidCSV, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	failed := false
+	seen := make(map[string]int)
+	for i := range records {
+		rows[i].Errors = append(rows[i].Errors, checkImport(c, db, &records[i], seen)...)
+		failed = failed || len(rows[i].Errors) > 0
+		seen[records[i].Email] = rows[i].Row
+	}
+	if failed {
+		return api.Fail(c, api.InvalidRows, rows)
+	}
+	if dryRun {
+		return c.JSON(http.StatusOK, api.Return("Rows valid", rows))
+	}
+
+	accounts := make([]models.Account, len(records))
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i := range records {
+			if err := createImported(tx, &records[i], &accounts[i]); err != nil {
+				return fmt.Errorf("row %d: %w", rows[i].Row, err)
+			}
+			rows[i].AccountID = accounts[i].ID
+		}
+		return nil
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+
+	// The accounts stay even if a mail fails, the invitation can be sent again
+	for i := range accounts {
+		if err := sendInvite(c, db, &accounts[i]); err != nil {
+			c.Logger().Error("fail to send invitation email: ", err)
+			rows[i].Errors = append(rows[i].Errors, "Invitation not sent")
+		}
+	}
+	return c.JSON(http.StatusOK, api.Return("Accounts imported", rows))
+}
+
+// @Summary send the invitation of an imported account again
+// @Description replaces the previous invitation code
+// @Tags Admin
+// @Produce json
+// @Param accountID path uint true "account ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /admin/accounts/{accountID}/invite [POST]
+func (h *AdminHandler) SendInvite(c echo.Context) error {
+	account, code := h.targetAccount(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	// Only accounts that never had a password are waiting for an invitation
+	if account.Passwd != "" || account.Managed {
+		return api.Fail(c, api.PasswordAlreadySet, nil)
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	if err := sendInvite(c, db, &account); err != nil {
+		c.Logger().Error("fail to send invitation email: ", err)
+		return api.Fail(c, api.MailServerError, nil)
+	}
+	return c.JSON(http.StatusOK, api.Return("Invitation sent", nil))
+}
+
+// @Summary set the first password of an imported account
+// @Description takes the code of the invitation email, which also verifies the email. Account types in OIDC_REQUIRED_ROLES get no password, the invitation is accepted and they are sent to single sign-on
+// @Tags Account
+// @Produce json
+// @Param email body string true "user e-mail"
+// @Param authcode body string true "invitation code"
+// @Param passwd body string false "user password, required unless the account type must use single sign-on"
+// @Success 200 {string} api.ReturnedData{data=echo.Map{"account": account, "token": token, "refresh_token": refreshToken, "expires_in": seconds}}
+// @Failure 400 {object} api.ReturnedData{}
+// @Failure 403 {object} api.ReturnedData{}
+// @Router /account/acceptinvite [POST]
+func (h *AccountHandler) AcceptInvite(c echo.Context) error {
+	type RequestBody struct {
+		Email    string `json:"email" validate:"required"`
+		AuthCode string `json:"authcode" validate:"required"`
+		Passwd   string `json:"passwd"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	if wait := retryAfter(c, db, body.Email); wait > 0 {
+		return tooManyAttempts(c, wait)
+	}
+	var account models.Account
+	if err := db.Where("email = ?", body.Email).First(&account).Error; err != nil { // not found
+		recordFailure(c, db, "acceptinvite", body.Email)
+		return api.Fail(c, api.WrongAuthCode, echo.Map{"authcodeok": false})
+	}
+	if !verifyAuthCode(c, db, "acceptinvite", body.Email, body.AuthCode, models.InvitePurpose) {
+		return api.Fail(c, api.WrongAuthCode, echo.Map{"authcodeok": false})
+	}
+	if account.Disabled {
+		return api.Fail(c, api.AccountDisabled, nil)
+	}
+
+	// Like LoginAccount, these roles never get a password
+	if roleListed("OIDC_REQUIRED_ROLES", account.Type) {
+		if err := db.Model(&account).Update("email_verified", true).Error; err != nil {
+			return api.Fail(c, api.DBError, err.Error())
+		}
+		db.Where("email = ? AND purpose = ?", body.Email, models.InvitePurpose).Delete(&models.Auth{})
+		clearFailures(db, body.Email)
+		return api.Fail(c, api.SSORequired, echo.Map{"sso_required": true})
+	}
+	if body.Passwd == "" {
+		return api.Fail(c, api.InvalidRequest, "passwd is required")
+	}
+	if violations := checkPasswd(db, &account, body.Passwd); len(violations) > 0 {
+		return passwdRejected(c, violations)
+	}
+	if err := setPasswd(db, &account, body.Passwd); err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	if err := db.Model(&account).Update("email_verified", true).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+
+	// The code is single-use
+	db.Where("email = ? AND purpose = ?", body.Email, models.InvitePurpose).Delete(&models.Auth{})
+	clearFailures(db, body.Email)
+
+	data, err := issueTokens(c, db, &account, "", false)
+	if err != nil {
+		return api.Fail(c, api.TokenError, err.Error())
+	}
+	data["totp_required"] = totpRequired(account.Type)
+	return c.JSON(http.StatusOK, api.Return("Invitation accepted", data))
+}
+
+/**
+ * @brief parse an import CSV, the header decides the order of the columns.
+ */
+func readImport(r io.Reader) ([]importRecord, []ImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	index := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		index[name] = i
+	}
+	for _, name := range importColumns[:6] {
+		if _, ok := index[name]; !ok {
+			return nil, nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+
+	var records []importRecord
+	var rows []ImportRow
+	for {
+		fields, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(records) == importMaxRows {
+			return nil, nil, fmt.Errorf("more than %d rows", importMaxRows)
+		}
+		get := func(name string) string {
+			if i, ok := index[name]; ok && i < len(fields) {
+				return strings.TrimSpace(fields[i])
+			}
+			return ""
+		}
+
+		record := importRecord{
+			accountFields: accountFields{
+				Email:       get("email"),
+				Type:        models.AcountType(get("type")),
+				FirstName:   get("firstname"),
+				LastName:    get("lastname"),
+				BirthString: get("birthday"),
+				Gender:      get("gender"),
+			},
+			Allergy: get("allergy"),
+		}
+		row := ImportRow{Row: len(rows) + 1, Email: record.Email}
+		if department := get("department"); department != "" {
+			id, err := strconv.ParseUint(department, 10, 32)
+			if err != nil {
+				row.Errors = append(row.Errors, "Invalid Department")
+			}
+			record.Department = uint(id)
+		}
+		records = append(records, record)
+		rows = append(rows, row)
+	}
+	if len(records) == 0 {
+		return nil, nil, errors.New("no rows")
+	}
+	return records, rows, nil
+}
+
+/**
+ * @brief check a row by the rules of /account/create, seen maps the emails of the rows before to their numbers.
+ */
+func checkImport(c echo.Context, db *gorm.DB, record *importRecord, seen map[string]int) []string {
+	var errs []string
+	if err := c.Validate(&record.accountFields); err != nil {
+		errs = append(errs, err.Error())
+	}
+	birthday, code := record.check(db)
+	if code != "" {
+		errs = append(errs, code.Message(api.Language(c.Request().Header.Get("Accept-Language"))))
+	}
+	record.birthday = birthday
+	if row, ok := seen[record.Email]; ok {
+		errs = append(errs, fmt.Sprintf("Duplicate of row %d", row))
+	}
+
+	switch record.Type {
+	case models.DoctorType:
+		if record.Department != 0 && db.First(&models.Department{}, record.Department).Error != nil {
+			errs = append(errs, "Department not found")
+		}
+		if record.Allergy != "" {
+			errs = append(errs, "Allergy only applies to patients")
+		}
+	case models.PatientType:
+		if record.Department != 0 {
+			errs = append(errs, "Department only applies to doctors")
+		}
+	}
+	return errs
+}
+
+func createImported(tx *gorm.DB, record *importRecord, account *models.Account) error {
+	*account = models.Account{
+		Email:           record.Email,
+		Type:            record.Type,
+		FirstName:       record.FirstName,
+		LastName:        record.LastName,
+		PasswdChangedAt: time.Now(),
+		Gender:          record.Gender,
+		Birthday:        record.birthday,
+	}
+	if err := tx.Create(account).Error; err != nil {
+		return err
+	}
+	if err := createRoleRow(tx, account); err != nil {
+		return err
+	}
+	switch {
+	case record.Department != 0:
+		return tx.Model(&models.Doctor{}).Where("account_id = ?", account.ID).Update("department", record.Department).Error
+	case record.Allergy != "":
+		var patient models.Patient
+		if err := tx.Where("account_id = ?", account.ID).First(&patient).Error; err != nil {
+			return err
+		}
+		return reportAllergy(tx, patient.ID, account.ID, record.Allergy)
+	}
+	return nil
+}
+
+/**
+ * @brief mail account a code, valid for INVITE_VALID_DAY days, to set its first password with.
+ * The link points to INVITE_URL with email and code in the query.
+ */
+func sendInvite(c echo.Context, db *gorm.DB, account *models.Account) error {
+	validDay := envInt("INVITE_VALID_DAY", 7)
+	auth, err := issueAuthCode(db, account.Email, models.InvitePurpose, time.Duration(validDay)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	link := ""
+	if base := os.Getenv("INVITE_URL"); base != "" {
+		link = base + "?" + url.Values{"email": {account.Email}, "code": {auth.AuthCode}}.Encode()
+	}
+	lang := mail.Language(c.Request().Header.Get("Accept-Language"))
+	return mail.SendTemplate(account.Email, lang, "invite", echo.Map{
+		"Name":     strings.TrimSpace(account.FirstName + " " + account.LastName),
+		"Code":     auth.AuthCode,
+		"Link":     link,
+		"ValidDay": validDay,
+	})
+}
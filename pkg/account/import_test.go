@@ -0,0 +1,31 @@
+package account
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadImport(t *testing.T) {
+	records, rows, err := readImport(strings.NewReader("\ufeffEmail,Type,FirstName,LastName,Birthday,Gender,Department\n" +
+		"li@hospital.org, doctor,Li,Wei,1980-04-02,male,3\n" +
+		"wang@example.com,patient,Wang,Fang,1992-11-20,female\n" +
+		"zhao@hospital.org,doctor,Zhao,Lei,1975-01-09,male,surgery\n"))
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	assert.Equal(t, models.DoctorType, records[0].Type)
+	assert.Equal(t, uint(3), records[0].Department)
+	assert.Equal(t, "1992-11-20", records[1].BirthString)
+	assert.Empty(t, rows[1].Errors)
+	assert.Equal(t, 3, rows[2].Row)
+	assert.Equal(t, []string{"Invalid Department"}, rows[2].Errors)
+
+	_, _, err = readImport(strings.NewReader("email,type,firstname,lastname\nli@hospital.org,doctor,Li,Wei\n"))
+	assert.Error(t, err)
+	_, _, err = readImport(strings.NewReader("email,type,firstname,lastname,birthday,gender\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,317 @@
+package account
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/oidc"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Staff log in through the hospital's OpenID Connect provider in two steps:
+// /account/oidc/login hands out the URL of the provider's login page, which
+// sends the browser back to OIDC_REDIRECT_URL with a code and the state, and
+// the frontend posts both to /account/oidc/callback for our tokens.
+const oidcLoginLifetime = 10 * time.Minute
+
+// The state is bound to the browser which started the login by an HttpOnly cookie holding its hash,
+// lest a code and state of someone else's login be planted on another browser (login CSRF).
+const oidcStateCookie = "oidc_state"
+
+var (
+	oidcMu     sync.Mutex
+	oidcCached *oidc.Provider
+)
+
+var errOIDCDisabled = errors.New("single sign-on not configured")
+
+// @Summary start a single sign-on login
+// @Description returns the URL of the provider's login page and sets the oidc_state cookie binding the login to the browser; the provider sends the browser back to OIDC_REDIRECT_URL with code and state
+// @Tags Account
+// @Produce json
+// @Success 200 {string} api.ReturnedData{data=echo.Map{"url": url, "state": state, "expires_in": seconds}}
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /account/oidc/login [GET]
+func (h *AccountHandler) OIDCLogin(c echo.Context) error {
+	provider, err := oidcProvider(c.Request().Context())
+	if errors.Is(err, errOIDCDisabled) {
+		return api.Fail(c, api.SSONotConfigured, nil)
+	}
+	if err != nil {
+		return api.Fail(c, api.IdPUnavailable, err.Error())
+	}
+
+	login := models.OIDCLogin{ExpiresAt: time.Now().Add(oidcLoginLifetime)}
+	for _, value := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		if *value, err = oidc.NewVerifier(); err != nil {
+			return api.Fail(c, api.InternalError, err.Error())
+		}
+	}
+	db, _ := c.Get("db").(*gorm.DB)
+	// Abandoned logins are dropped on the way
+	db.Where("expires_at < ?", time.Now()).Delete(&models.OIDCLogin{})
+	if err := db.Create(&login).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    hashToken(login.State),
+		Path:     "/api/account/oidc",
+		MaxAge:   int(oidcLoginLifetime.Seconds()),
+		Secure:   c.Scheme() == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.JSON(http.StatusOK, api.Return("ok", echo.Map{
+		"url":        provider.AuthCodeURL(login.State, login.Nonce, oidc.Challenge(login.Verifier)),
+		"state":      login.State,
+		"expires_in": int(oidcLoginLifetime.Seconds()),
+	}))
+}
+
+// @Summary finish a single sign-on login
+// @Description links the provider's user to the account with the same verified email, or creates a doctor account for them; accounts with TOTP enabled get a challenge unless the provider did multi-factor authentication
+// @Tags Account
+// @Produce json
+// @Param code body string true "authorization code from the provider"
+// @Param state body string true "state from /account/oidc/login, posted with the oidc_state cookie it set"
+// @Success 200 {string} api.ReturnedData{data=echo.Map{"account": account, "token": token, "refresh_token": refreshToken, "expires_in": seconds}}
+// @Failure 400 {object} api.ReturnedData{}
+// @Failure 403 {object} api.ReturnedData{}
+// @Router /account/oidc/callback [POST]
+func (h *AccountHandler) OIDCCallback(c echo.Context) error {
+	type RequestBody struct {
+		Code  string `json:"code" validate:"required"`
+		State string `json:"state" validate:"required"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	provider, err := oidcProvider(ctx)
+	if errors.Is(err, errOIDCDisabled) {
+		return api.Fail(c, api.SSONotConfigured, nil)
+	}
+	if err != nil {
+		return api.Fail(c, api.IdPUnavailable, err.Error())
+	}
+
+	// Only the browser which started the login may finish it
+	cookie, err := c.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashToken(body.State))) != 1 {
+		return api.Fail(c, api.InvalidLogin, nil)
+	}
+	c.SetCookie(&http.Cookie{Name: oidcStateCookie, Path: "/api/account/oidc", MaxAge: -1, HttpOnly: true})
+
+	// A state is good for one try, whoever deletes the row gets to use it
+	db, _ := c.Get("db").(*gorm.DB)
+	var login models.OIDCLogin
+	if err := db.First(&login, "state = ?", body.State).Error; err != nil {
+		return api.Fail(c, api.InvalidLogin, nil)
+	}
+	if result := db.Where("state = ?", login.State).Delete(&models.OIDCLogin{}); result.Error != nil || result.RowsAffected != 1 ||
+		time.Now().After(login.ExpiresAt) {
+		return api.Fail(c, api.InvalidLogin, nil)
+	}
+
+	rawIDToken, err := provider.Exchange(ctx, body.Code, login.Verifier)
+	if err != nil {
+		return api.Fail(c, api.IdPRefused, err.Error())
+	}
+	claims, err := provider.Verify(ctx, rawIDToken, login.Nonce)
+	if err != nil {
+		return api.Fail(c, api.InvalidIDToken, err.Error())
+	}
+
+	var account models.Account
+	var code api.Code
+	err = db.Transaction(func(tx *gorm.DB) error {
+		account, code = externalAccount(tx, claims)
+		if code != "" {
+			return errors.New(string(code))
+		}
+		return nil
+	})
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	if account.Disabled {
+		return api.Fail(c, api.AccountDisabled, nil)
+	}
+
+	mfa := hasAMR(claims, "mfa")
+	if account.TOTPEnabled && !mfa {
+		challenge, err := newChallenge(&account)
+		if err != nil {
+			return api.Fail(c, api.TokenError, err.Error())
+		}
+		return c.JSON(http.StatusOK, api.Return("TOTP required", echo.Map{
+			"mfa_required": true,
+			"challenge":    challenge,
+			"expires_in":   int(challengeLifetime.Seconds()),
+		}))
+	}
+
+	data, err := issueTokens(c, db, &account, "", mfa)
+	if err != nil {
+		return api.Fail(c, api.TokenError, err.Error())
+	}
+	data["totp_required"] = totpRequired(account.Type) && !mfa
+	return c.JSON(http.StatusOK, api.Return("Logged in", data))
+}
+
+/**
+ * @brief find the account of the provider's user, linking it by verified email or creating a doctor account on the first login.
+ */
+func externalAccount(tx *gorm.DB, claims *oidc.Claims) (models.Account, api.Code) {
+	var account models.Account
+	now := time.Now()
+	var identity models.ExternalIdentity
+	err := tx.Where("issuer = ? AND subject = ?", claims.Issuer, claims.Subject).First(&identity).Error
+	if err == nil {
+		if err := tx.First(&account, identity.AccountID).Error; err != nil {
+			return account, api.AccountNotFound
+		}
+		tx.Model(&identity).Updates(models.ExternalIdentity{Email: claims.Email, LastLoginAt: now})
+		return account, ""
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return account, api.DBError
+	}
+
+	// Nobody may take over an account with an address the provider did not check
+	if claims.Email == "" || !claims.EmailVerified {
+		return account, api.VerifiedEmailRequired
+	}
+	err = tx.Where("email = ?", claims.Email).First(&account).Error
+	switch {
+	case err == nil:
+		if code := linkable(&account); code != "" {
+			return account, code
+		}
+		var linked int64
+		tx.Model(&models.ExternalIdentity{}).Where("account_id = ? AND issuer = ?", account.ID, claims.Issuer).Count(&linked)
+		if linked > 0 {
+			return account, api.IdentityConflict
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		if account, err = provisionDoctor(tx, claims); err != nil {
+			return account, api.DBError
+		}
+	default:
+		return account, api.DBError
+	}
+
+	identity = models.ExternalIdentity{
+		AccountID:   account.ID,
+		Issuer:      claims.Issuer,
+		Subject:     claims.Subject,
+		Email:       claims.Email,
+		LastLoginAt: now,
+	}
+	if err := tx.Create(&identity).Error; err != nil {
+		return account, api.DBError
+	}
+	return account, ""
+}
+
+/**
+ * @brief whether the identity of a provider's user may be linked to the existing account with their email.
+ * Single sign-on is for staff, patients keep their passwords. The account must have proved its email too,
+ * or whoever registered the address first would share it with its owner, password and all.
+ * On failure the returned code is the error to answer with, "" otherwise.
+ */
+func linkable(account *models.Account) api.Code {
+	if account.Type != models.DoctorType && account.Type != models.AdminType {
+		return api.SSOStaffOnly
+	}
+	if !account.EmailVerified {
+		return api.VerifiedEmailRequired
+	}
+	return ""
+}
+
+/**
+ * @brief create the doctor account of someone logging in for the first time.
+ * Its password is random and never told, the doctor still has to be approved by an admin.
+ */
+func provisionDoctor(tx *gorm.DB, claims *oidc.Claims) (models.Account, error) {
+	passwd, err := oidc.NewVerifier()
+	if err != nil {
+		return models.Account{}, err
+	}
+	firstName, lastName := claims.GivenName, claims.FamilyName
+	if firstName == "" && lastName == "" {
+		firstName = claims.Name
+	}
+	account := models.Account{
+		Email:           claims.Email,
+		Type:            models.DoctorType,
+		FirstName:       firstName,
+		LastName:        lastName,
+		Passwd:          passwd,
+		PasswdChangedAt: time.Now(),
+		EmailVerified:   true,
+	}
+	account.HashPassword()
+	if err := tx.Create(&account).Error; err != nil {
+		return account, err
+	}
+	return account, createRoleRow(tx, &account)
+}
+
+func hasAMR(claims *oidc.Claims, method string) bool {
+	for _, amr := range claims.AMR {
+		if amr == method {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * @brief the provider configured by OIDC_* in the environment, discovered on first use.
+ */
+func oidcProvider(ctx context.Context) (*oidc.Provider, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcCached != nil {
+		return oidcCached, nil
+	}
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, errOIDCDisabled
+	}
+	scopes := os.Getenv("OIDC_SCOPES")
+	if scopes == "" {
+		scopes = "email profile"
+	}
+	provider, err := oidc.NewProvider(ctx, oidc.Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields(scopes),
+	}, nil)
+	if err != nil {
+		// Not cached, the provider may be back on the next try
+		return nil, err
+	}
+	oidcCached = provider
+	return provider, nil
+}
@@ -0,0 +1,25 @@
+package account
+
+import (
+	"testing"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkable(t *testing.T) {
+	for _, tc := range []struct {
+		account models.Account
+		code    api.Code
+	}{
+		{models.Account{Type: models.DoctorType, EmailVerified: true}, ""},
+		{models.Account{Type: models.AdminType, EmailVerified: true}, ""},
+		{models.Account{Type: models.PatientType, EmailVerified: true}, api.SSOStaffOnly},
+		// Someone registered the address before its owner first logged in through the provider
+		{models.Account{Type: models.DoctorType}, api.VerifiedEmailRequired},
+		{models.Account{Type: models.AdminType}, api.VerifiedEmailRequired},
+	} {
+		assert.Equal(t, tc.code, linkable(&tc.account), tc.account)
+	}
+}
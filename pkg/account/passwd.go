@@ -0,0 +1,192 @@
+package account
+
+import (
+	// embed the common password list
+	_ "embed"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Every new password goes through the policy below, configured in configs/.env.
+// Existing passwords are not checked again, except for the maximum age of staff passwords.
+
+//go:embed common_passwords.txt
+var commonPasswdList string
+
+var commonPasswds = func() map[string]bool {
+	m := map[string]bool{}
+	for _, line := range strings.Split(commonPasswdList, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			m[line] = true
+		}
+	}
+	return m
+}()
+
+type PasswdPolicy struct {
+	MinLen     int `json:"min_length"`
+	MinClasses int `json:"min_classes"` // Out of lower case, upper case, digits and others
+	History    int `json:"history"`     // The last History passwords cannot be used again
+	MaxAgeDay  int `json:"max_age_day"` // Doctor and admin passwords expire after this, 0 for never
+}
+
+// PasswdViolation is one rule a password breaks, for the frontend to display.
+type PasswdViolation struct {
+	Rule    string `json:"rule"` // min_length, min_classes, common, contains_email or reused
+	Limit   int    `json:"limit,omitempty"`
+	Message string `json:"message"`
+}
+
+// @Summary the password policy new passwords must follow
+// @Tags Account
+// @Produce json
+// @Success 200 {object} api.ReturnedData{data=PasswdPolicy}
+// @Router /account/passwdpolicy [GET]
+func (h *AccountHandler) GetPasswdPolicy(c echo.Context) error {
+	return c.JSON(http.StatusOK, api.Return("Password policy", currentPasswdPolicy()))
+}
+
+func currentPasswdPolicy() PasswdPolicy {
+	return PasswdPolicy{
+		MinLen:     envInt("PASSWD_MIN_LEN", 8),
+		MinClasses: envInt("PASSWD_MIN_CLASSES", 3),
+		History:    envNonNegative("PASSWD_HISTORY", 5),
+		MaxAgeDay:  envNonNegative("PASSWD_MAX_AGE_DAY", 90),
+	}
+}
+
+/**
+ * @brief the rules passwd breaks, without looking at the history.
+ * email is the owner's, a password should not contain it.
+ */
+func (p PasswdPolicy) Check(passwd string, email string) []PasswdViolation {
+	var violations []PasswdViolation
+	if utf8.RuneCountInString(passwd) < p.MinLen {
+		violations = append(violations, PasswdViolation{"min_length", p.MinLen, "Password is too short"})
+	}
+	if passwdClasses(passwd) < p.MinClasses {
+		violations = append(violations, PasswdViolation{"min_classes", p.MinClasses, "Password needs more kinds of characters"})
+	}
+
+	lower := strings.ToLower(passwd)
+	// "Password123!" is as guessable as "password"
+	stem := strings.TrimRightFunc(lower, func(r rune) bool { return !unicode.IsLetter(r) })
+	if commonPasswds[lower] || commonPasswds[stem] {
+		violations = append(violations, PasswdViolation{Rule: "common", Message: "Password is too common"})
+	}
+	if name := strings.ToLower(strings.Split(email, "@")[0]); len(name) >= 3 && strings.Contains(lower, name) {
+		violations = append(violations, PasswdViolation{Rule: "contains_email", Message: "Password contains the e-mail address"})
+	}
+	return violations
+}
+
+func passwdClasses(passwd string) int {
+	var lower, upper, digit, other int
+	for _, r := range passwd {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+/**
+ * @brief the rules passwd breaks as the new password of account, including reuse of old ones.
+ * account need not exist yet.
+ */
+func checkPasswd(db *gorm.DB, account *models.Account, passwd string) []PasswdViolation {
+	policy := currentPasswdPolicy()
+	violations := policy.Check(passwd, account.Email)
+	if account.ID == 0 || policy.History == 0 {
+		return violations
+	}
+
+	var history []models.PasswordHistory
+	db.Where("account_id = ?", account.ID).Order("created_at desc").Limit(policy.History).Find(&history)
+	hashes := []string{account.Passwd}
+	for _, h := range history {
+		hashes = append(hashes, h.Passwd)
+	}
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(passwd)) == nil {
+			return append(violations, PasswdViolation{"reused", policy.History, "Password was used recently"})
+		}
+	}
+	return violations
+}
+
+/**
+ * @brief hash and store passwd as the new password of account.
+ */
+func setPasswd(db *gorm.DB, account *models.Account, passwd string) error {
+	account.Passwd = passwd
+	account.HashPassword()
+	account.PasswdChangedAt = time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.Account{}).Where("id = ?", account.ID).Updates(map[string]interface{}{
+			"passwd":            account.Passwd,
+			"passwd_changed_at": account.PasswdChangedAt,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return recordPasswd(tx, account)
+	})
+}
+
+/**
+ * @brief add the current password hash of account to its history, dropping what the policy no longer needs.
+ */
+func recordPasswd(db *gorm.DB, account *models.Account) error {
+	history := currentPasswdPolicy().History
+	if history == 0 {
+		return nil
+	}
+	if err := db.Create(&models.PasswordHistory{AccountID: account.ID, Passwd: account.Passwd}).Error; err != nil {
+		return err
+	}
+	keep := db.Model(&models.PasswordHistory{}).Select("id").Where("account_id = ?", account.ID).
+		Order("created_at desc").Limit(history)
+	return db.Where("account_id = ? AND id NOT IN (?)", account.ID, keep).Delete(&models.PasswordHistory{}).Error
+}
+
+/**
+ * @brief whether the password of a staff account is older than PASSWD_MAX_AGE_DAY.
+ */
+func passwdExpired(account *models.Account) bool {
+	maxAge := currentPasswdPolicy().MaxAgeDay
+	if maxAge == 0 || (account.Type != models.DoctorType && account.Type != models.AdminType) {
+		return false
+	}
+	return time.Since(account.PasswdChangedAt) > time.Duration(maxAge)*24*time.Hour
+}
+
+func passwdRejected(c echo.Context, violations []PasswdViolation) error {
+	return api.Fail(c, api.PasswordRejected, echo.Map{"violations": violations})
+}
+
+func envNonNegative(key string, fallback int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n < 0 {
+		return fallback
+	}
+	return n
+}
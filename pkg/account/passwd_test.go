@@ -0,0 +1,27 @@
+package account
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswdPolicyCheck(t *testing.T) {
+	policy := PasswdPolicy{MinLen: 8, MinClasses: 3}
+	rules := func(passwd string) []string {
+		var r []string
+		for _, v := range policy.Check(passwd, "scott@a.com") {
+			r = append(r, v.Rule)
+		}
+		return r
+	}
+
+	assert.Empty(t, rules("Tr0ub4dor&3"))
+	assert.Equal(t, []string{"min_length"}, rules("aB3$x"))
+	assert.Equal(t, []string{"min_classes"}, rules("abcdefghij"))
+	assert.Equal(t, []string{"common"}, rules("Password123!"))
+	assert.Equal(t, []string{"min_classes", "common"}, rules("qwertyuiop"))
+	assert.Equal(t, []string{"contains_email"}, rules("Scott_2021x"))
+	// Length counts characters, not bytes
+	assert.Equal(t, []string{"min_length"}, rules("密码Ab1"))
+}
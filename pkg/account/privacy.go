@@ -0,0 +1,331 @@
+package account
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// @Summary download everything stored about the current patient
+// @Description a zip of JSON files: account, patient, registrations, milestones, cases (with prescriptions) and erasure requests
+// @Tags Account
+// @Produce application/zip
+// @Success 200 {file} binary
+// @Router /account/export [GET]
+func (h *AccountHandler) ExportData(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	return sendExport(c, db, c.Get("id").(uint))
+}
+
+// @Summary request the erasure of the current patient's identifying data
+// @Description an admin has to approve it; medical records are kept but no longer tied to a name, and the account is closed
+// @Tags Account
+// @Produce json
+// @Param reason body string false "why the data should be erased"
+// @Success 200 {object} api.ReturnedData{data=models.ErasureRequest}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/erasure [POST]
+func (h *AccountHandler) RequestErasure(c echo.Context) error {
+	type RequestBody struct {
+		Reason string `json:"reason"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	accountID := c.Get("id").(uint)
+	if err := db.Where("account_id = ? AND status = ?", accountID, models.ErasurePending).First(&models.ErasureRequest{}).Error; err == nil {
+		return api.Fail(c, api.ErasureRequested, nil)
+	}
+
+	request := models.ErasureRequest{AccountID: accountID, Reason: body.Reason, Status: models.ErasurePending}
+	if err := db.Create(&request).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Erasure requested", request))
+}
+
+// @Summary list the erasure requests of the current account
+// @Tags Account
+// @Produce json
+// @Success 200 {object} api.ReturnedData{data=[]models.ErasureRequest}
+// @Router /account/erasure [GET]
+func (h *AccountHandler) GetErasureRequests(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	var requests []models.ErasureRequest
+	if err := db.Where("account_id = ?", c.Get("id")).Order("created_at DESC").Find(&requests).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", requests))
+}
+
+// @Summary export the data of a patient account
+// @Description the same archive as /account/export, for requests made outside the app
+// @Tags Admin
+// @Produce application/zip
+// @Param accountID path uint true "account ID"
+// @Success 200 {file} binary
+// @Router /admin/accounts/{accountID}/export [GET]
+func (h *AdminHandler) ExportData(c echo.Context) error {
+	account, code := h.targetAccount(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	if account.Type != models.PatientType {
+		return api.Fail(c, api.NotAPatient, nil)
+	}
+	db, _ := c.Get("db").(*gorm.DB)
+	return sendExport(c, db, account.ID)
+}
+
+// @Summary list erasure requests
+// @Tags Admin
+// @Produce json
+// @Param status query string false "pending, approved or rejected"
+// @Param page query int false "page number, starting from 1"
+// @Param size query int false "page size, at most 100"
+// @Success 200 {object} api.ReturnedData{data=[]models.ErasureRequest}
+// @Router /admin/erasures [GET]
+func (h *AdminHandler) ListErasureRequests(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	query := db.Model(&models.ErasureRequest{})
+	if status := c.QueryParam("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	page, size := utils.Pagination(c)
+	var requests []models.ErasureRequest
+	if err := query.Order("created_at").Offset((page - 1) * size).Limit(size).Find(&requests).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", requests))
+}
+
+// @Summary approve an erasure request
+// @Description strips the identifying fields of the account, closes it and revokes its tokens; medical records stay
+// @Tags Admin
+// @Produce json
+// @Param requestID path uint true "erasure request ID"
+// @Param note body string false "review note"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /admin/erasures/{requestID}/approve [PUT]
+func (h *AdminHandler) ApproveErasure(c echo.Context) error {
+	return h.reviewErasure(c, models.ErasureApproved)
+}
+
+// @Summary reject an erasure request
+// @Tags Admin
+// @Produce json
+// @Param requestID path uint true "erasure request ID"
+// @Param note body string false "review note, e.g. why the data has to be kept"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /admin/erasures/{requestID}/reject [PUT]
+func (h *AdminHandler) RejectErasure(c echo.Context) error {
+	return h.reviewErasure(c, models.ErasureRejected)
+}
+
+func (h *AdminHandler) reviewErasure(c echo.Context, status models.ErasureStatus) error {
+	type RequestBody struct {
+		Note string `json:"note"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	var request models.ErasureRequest
+	if err := db.First(&request, c.Param("requestID")).Error; err != nil {
+		return api.Fail(c, api.ErasureNotFound, nil)
+	}
+	if request.Status != models.ErasurePending {
+		return api.Fail(c, api.ErasureReviewed, request.Status)
+	}
+
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&request).Updates(map[string]interface{}{
+			"status":      status,
+			"reviewer_id": c.Get("id"),
+			"reviewed_at": &now,
+			"review_note": body.Note,
+		}).Error
+		if err != nil || status != models.ErasureApproved {
+			return err
+		}
+		return anonymizeAccount(tx, request.AccountID)
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	if status == models.ErasureApproved {
+		return c.JSON(http.StatusOK, api.Return("Account erased", nil))
+	}
+	return c.JSON(http.StatusOK, api.Return("Erasure rejected", nil))
+}
+
+/**
+ * @brief strip everything identifying from an account and close it.
+ * Registrations and cases keep pointing at the account, which no longer tells who it was.
+ */
+func anonymizeAccount(db *gorm.DB, accountID uint) error {
+	var account models.Account
+	if err := db.First(&account, accountID).Error; err != nil {
+		return err
+	}
+	placeholder := fmt.Sprintf("erased-%d@invalid", account.ID)
+
+	err := db.Model(&account).Updates(map[string]interface{}{
+		"email":          placeholder,
+		"first_name":     "",
+		"last_name":      "",
+		"gender":         "",
+		"birthday":       time.Time{},
+		"passwd":         "",
+		"pending_email":  "",
+		"email_verified": false,
+		"disabled":       true,
+		"totp_enabled":   false,
+		"totp_secret":    "",
+		"totp_last_step": 0,
+		"token_version":  gorm.Expr("token_version + 1"),
+	}).Error
+	if err != nil {
+		return err
+	}
+	err = db.Model(&models.Patient{}).Where("account_id = ?", account.ID).Updates(map[string]interface{}{
+		"email":            placeholder,
+		"national_id":      nil,
+		"insurance_number": nil,
+	}).Error
+	if err != nil {
+		return err
+	}
+	for _, model := range []interface{}{&models.RefreshToken{}, &models.RevokedToken{}, &models.Session{}, &models.RecoveryCode{}, &models.ExternalIdentity{}, &models.PasswordHistory{}} {
+		if err := db.Where("account_id = ?", account.ID).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	if err := db.Where("email IN ?", []string{account.Email, account.PendingEmail}).Delete(&models.Auth{}).Error; err != nil {
+		return err
+	}
+	if err := db.Where("email = ?", account.Email).Delete(&models.LockoutEvent{}).Error; err != nil {
+		return err
+	}
+	return db.Where("key = ?", emailKey(account.Email)).Delete(&models.AuthAttempt{}).Error
+}
+
+/**
+ * @brief respond with the export archive of a patient account.
+ */
+func sendExport(c echo.Context, db *gorm.DB, accountID uint) error {
+	archive, err := exportPatient(db, accountID)
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	filename := fmt.Sprintf("patient-%d-%s.zip", accountID, time.Now().Format("20060102"))
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	return c.Blob(http.StatusOK, "application/zip", archive)
+}
+
+/**
+ * @brief collect everything tied to a patient account into a zip of JSON files.
+ * Note that Case.PatientID is the account ID while Registration.PatientID is the patient ID.
+ */
+func exportPatient(db *gorm.DB, accountID uint) ([]byte, error) {
+	var account models.Account
+	if err := db.First(&account, accountID).Error; err != nil {
+		return nil, err
+	}
+	var patient models.Patient
+	if err := db.Where("account_id = ?", accountID).First(&patient).Error; err != nil {
+		return nil, err
+	}
+
+	var registrations []models.Registration
+	if err := db.Preload("Department").Where("patient_id = ?", patient.ID).Order("id").Find(&registrations).Error; err != nil {
+		return nil, err
+	}
+	registrationIDs := make([]uint, len(registrations))
+	for i, r := range registrations {
+		registrationIDs[i] = r.ID
+	}
+	milestones := []models.MileStone{}
+	if len(registrationIDs) > 0 {
+		if err := db.Where("registration_id IN ?", registrationIDs).Order("id").Find(&milestones).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	// Deleted cases and prescriptions are still stored, they come with their deletion
+	var cases []models.Case
+	unscoped := func(db *gorm.DB) *gorm.DB { return db.Unscoped() }
+	err := db.Unscoped().Preload("Prescriptions", unscoped).Preload("Prescriptions.Guidelines").Preload("Prescriptions.Guidelines.Medicine").
+		Where("patient_id = ?", accountID).Order("date").Find(&cases).Error
+	if err != nil {
+		return nil, err
+	}
+	var allergies []models.Allergy
+	if err := db.Preload("Medicine").Where("patient_id = ?", patient.ID).Order("id").Find(&allergies).Error; err != nil {
+		return nil, err
+	}
+	var erasures []models.ErasureRequest
+	if err := db.Where("account_id = ?", accountID).Order("created_at").Find(&erasures).Error; err != nil {
+		return nil, err
+	}
+
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"manifest.json", echo.Map{"account_id": accountID, "exported_at": time.Now()}},
+		{"account.json", echo.Map{
+			"id":             account.ID,
+			"email":          account.Email,
+			"type":           account.Type,
+			"firstname":      account.FirstName,
+			"lastname":       account.LastName,
+			"gender":         account.Gender,
+			"birthday":       account.Birthday.Format("2006-01-02"),
+			"email_verified": account.EmailVerified,
+			"totp_enabled":   account.TOTPEnabled,
+		}},
+		{"patient.json", patient},
+		{"registrations.json", registrations},
+		{"milestones.json", milestones},
+		{"cases.json", cases},
+		{"allergies.json", allergies},
+		{"erasure_requests.json", erasures},
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, file := range files {
+		w, err := zw.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,245 @@
+package account
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// @Summary update the profile of the current account
+// @Description only the given fields change; departmentid is for doctors, allergy, nationalid and insurancenumber for patients (empty to remove).
+// @Description A new email only replaces the old one once the code sent to it comes back through /account/confirmemail
+// @Tags Account
+// @Produce json
+// @Param firstname body string false "user first name"
+// @Param lastname body string false "user last name"
+// @Param gender body string false "user gender, male or female"
+// @Param birthday body string false "user birthday string in yyyy-mm-dd"
+// @Param email body string false "new e-mail"
+// @Param departmentid body uint false "doctor department id"
+// @Param allergy body string false "patient allergy history"
+// @Param nationalid body string false "patient national ID (GB 11643)"
+// @Param insurancenumber body string false "patient medical insurance number"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/profile [PUT]
+func (h *AccountHandler) UpdateProfile(c echo.Context) error {
+	type RequestBody struct {
+		FirstName *string `json:"firstname" validate:"omitempty,min=1"`
+		LastName  *string `json:"lastname" validate:"omitempty,min=1"`
+		Gender    *string `json:"gender" validate:"omitempty,oneof=male female"`
+		Birthday  *string `json:"birthday"`
+		Email     *string `json:"email"`
+
+		DepartmentID *uint   `json:"departmentid"`
+		Allergy      *string `json:"allergy"`
+		patientIdentifiers
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	var account models.Account
+	if err := db.First(&account, c.Get("id")).Error; err != nil {
+		return api.Fail(c, api.NotLoggedIn, nil)
+	}
+	if (body.DepartmentID != nil && account.Type != models.DoctorType) ||
+		((body.Allergy != nil || body.patientIdentifiers.given()) && account.Type != models.PatientType) {
+		return api.Fail(c, api.InvalidField, account.Type)
+	}
+
+	updates := map[string]interface{}{}
+	if body.FirstName != nil {
+		updates["first_name"] = *body.FirstName
+	}
+	if body.LastName != nil {
+		updates["last_name"] = *body.LastName
+	}
+	if body.Gender != nil {
+		updates["gender"] = *body.Gender
+	}
+	if body.Birthday != nil {
+		birthday, err := time.Parse("2006-01-02", *body.Birthday)
+		if err != nil || birthday.After(time.Now()) {
+			return api.Fail(c, api.InvalidBirthday, nil)
+		}
+		updates["birthday"] = birthday
+	}
+
+	var newEmail string
+	if body.Email != nil && !strings.EqualFold(*body.Email, account.Email) {
+		newEmail = *body.Email
+		if ok, _ := regexp.MatchString(`^\w+@\w+[.\w+]+$`, newEmail); !ok {
+			return api.Fail(c, api.InvalidEmail, nil)
+		}
+		if err := db.Where("email = ?", newEmail).First(&models.Account{}).Error; err == nil {
+			return api.Fail(c, api.AccountOccupied, nil)
+		}
+		updates["pending_email"] = newEmail
+	}
+
+	if body.DepartmentID != nil {
+		if err := db.First(&models.Department{}, *body.DepartmentID).Error; err != nil {
+			return api.Fail(c, api.InvalidDepartment, nil)
+		}
+	}
+	var patient models.Patient
+	if account.Type == models.PatientType {
+		if err := db.Where("account_id = ?", account.ID).First(&patient).Error; err != nil {
+			return api.Fail(c, api.DBError, err.Error())
+		}
+	}
+	identifiers, code := body.patientIdentifiers.updates(db, patient.ID)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if len(updates) > 0 {
+			if err := tx.Model(&account).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		if body.DepartmentID != nil {
+			if err := tx.Model(&models.Doctor{}).Where("account_id = ?", account.ID).Update("department", *body.DepartmentID).Error; err != nil {
+				return err
+			}
+		}
+		if len(identifiers) > 0 {
+			if err := tx.Model(&patient).Updates(identifiers).Error; err != nil {
+				return err
+			}
+		}
+		if body.Allergy != nil {
+			return reportAllergy(tx, patient.ID, account.ID, *body.Allergy)
+		}
+		return nil
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+
+	pendingEmail := account.PendingEmail
+	if newEmail != "" {
+		if err := sendAuthCode(c, db, newEmail, models.EmailPurpose, "change_email"); err != nil {
+			c.Logger().Error("fail to send email change code: ", err)
+			return api.Fail(c, api.MailServerError, nil)
+		}
+		pendingEmail = newEmail
+	}
+	return c.JSON(http.StatusOK, api.Return("Profile updated", echo.Map{"pending_email": pendingEmail}))
+}
+
+// @Summary confirm an email change
+// @Description takes the code sent to the new email by /account/profile; the new email replaces the old one and counts as verified
+// @Tags Account
+// @Produce json
+// @Param authcode body string true "given auth code"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/confirmemail [POST]
+func (h *AccountHandler) ConfirmEmail(c echo.Context) error {
+	type RequestBody struct {
+		AuthCode string `json:"authcode" validate:"required"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	var account models.Account
+	if err := db.First(&account, c.Get("id")).Error; err != nil {
+		return api.Fail(c, api.NotLoggedIn, nil)
+	}
+	newEmail := account.PendingEmail
+	if newEmail == "" {
+		return api.Fail(c, api.NoPendingEmailChange, nil)
+	}
+	if wait := retryAfter(c, db, newEmail); wait > 0 {
+		return tooManyAttempts(c, wait)
+	}
+	if !verifyAuthCode(c, db, "confirmemail", newEmail, body.AuthCode, models.EmailPurpose) {
+		return api.Fail(c, api.WrongAuthCode, echo.Map{"authcodeok": false})
+	}
+	// Someone may have signed up with the address meanwhile
+	if err := db.Where("email = ?", newEmail).First(&models.Account{}).Error; err == nil {
+		return api.Fail(c, api.AccountOccupied, nil)
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&account).Updates(map[string]interface{}{
+			"email":          newEmail,
+			"pending_email":  "",
+			"email_verified": true,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Doctor{}).Where("account_id = ?", account.ID).Update("email", newEmail).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Patient{}).Where("account_id = ?", account.ID).Update("email", newEmail).Error
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	db.Where("email = ? AND purpose = ?", newEmail, models.EmailPurpose).Delete(&models.Auth{})
+	clearFailures(db, newEmail)
+	return c.JSON(http.StatusOK, api.Return("E-Mail changed", echo.Map{"email": newEmail}))
+}
+
+/**
+ * @brief set the free-text allergy of a patient and mirror it into the unstructured entry reported by the patient.
+ * An empty text removes that entry, entries recorded by doctors are left alone.
+ */
+func reportAllergy(tx *gorm.DB, patientID uint, accountID uint, text string) error {
+	if err := tx.Model(&models.Patient{}).Where("id = ?", patientID).Update("allergy", text).Error; err != nil {
+		return err
+	}
+
+	var entry models.Allergy
+	err := tx.Where("patient_id = ? AND unstructured AND recorded_by = 0", patientID).First(&entry).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	found := err == nil
+
+	var action models.AllergyAction
+	switch {
+	case !found && text == "":
+		return nil
+	case !found:
+		entry = models.Allergy{
+			PatientID:    patientID,
+			Severity:     models.SeverityUnknown,
+			Note:         text,
+			Unstructured: true,
+			RecordedAt:   time.Now(),
+		}
+		err, action = tx.Create(&entry).Error, models.AllergyCreated
+	case text == "":
+		err, action = tx.Delete(&entry).Error, models.AllergyDeleted
+	case text == entry.Note:
+		return nil
+	default:
+		entry.Note = text
+		entry.RecordedAt = time.Now()
+		err, action = tx.Model(&entry).Updates(map[string]interface{}{"note": entry.Note, "recorded_at": entry.RecordedAt}).Error, models.AllergyUpdated
+	}
+	if err != nil {
+		return err
+	}
+	history := entry.Snapshot(action, accountID)
+	return tx.Create(&history).Error
+}
@@ -0,0 +1,63 @@
+package account
+
+import (
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/labstack/echo/v4"
+)
+
+/**
+ * @brief middleware only letting accounts of the given types through.
+ * Requests with an API key pass, their scopes were checked by CheckAccountID.
+ * It relies on the type set by CheckAccountID, so it must come after it.
+ */
+func RequireRole(types ...models.AcountType) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			accountType, ok := c.Get("type").(models.AcountType)
+			if !ok {
+				return api.Fail(c, api.InvalidToken, nil)
+			}
+			// CheckAccountID already limited API keys to the route groups of their scopes, which never write cases
+			if accountType == models.ServiceType {
+				return next(c)
+			}
+			for _, t := range types {
+				if accountType == t {
+					return next(c)
+				}
+			}
+			return api.Fail(c, api.PermissionDenied, echo.Map{"required": types})
+		}
+	}
+}
+
+/**
+ * @brief middleware refusing accounts whose email has not been verified yet.
+ * It must come after CheckAccountID.
+ */
+func RequireVerified(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if verified, _ := c.Get("verified").(bool); !verified {
+			return api.Fail(c, api.EmailNotVerified, nil)
+		}
+		return next(c)
+	}
+}
+
+/**
+ * @brief middleware refusing doctors whose credentials have not been approved by an admin.
+ * Other account types pass. It must come after CheckAccountID.
+ */
+func RequireApproved(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, _ := c.Get("claims").(*models.TokenClaims)
+		if claims == nil {
+			return api.Fail(c, api.InvalidToken, nil)
+		}
+		if claims.Type == models.DoctorType && !claims.Approved {
+			return api.Fail(c, api.DoctorNotApproved, nil)
+		}
+		return next(c)
+	}
+}
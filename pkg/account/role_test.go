@@ -0,0 +1,64 @@
+package account
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireRole(t *testing.T) {
+	e := echo.New()
+	next := func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}
+	h := RequireRole(models.DoctorType, models.AdminType)(next)
+
+	for accountType, code := range map[models.AcountType]int{
+		models.DoctorType:  http.StatusOK,
+		models.AdminType:   http.StatusOK,
+		models.PatientType: http.StatusForbidden,
+	} {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		c.Set("type", accountType)
+		if assert.NoError(t, h(c)) {
+			assert.Equal(t, code, rec.Code, accountType)
+		}
+	}
+
+	// Without CheckAccountID in front there are no claims at all
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	if assert.NoError(t, h(c)) {
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	}
+}
+
+func TestRequireApproved(t *testing.T) {
+	e := echo.New()
+	next := func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}
+	h := RequireApproved(next)
+
+	for _, tc := range []struct {
+		claims models.TokenClaims
+		code   int
+	}{
+		{models.TokenClaims{Type: models.DoctorType}, http.StatusForbidden},
+		{models.TokenClaims{Type: models.DoctorType, Approved: true}, http.StatusOK},
+		{models.TokenClaims{Type: models.PatientType}, http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		claims := tc.claims
+		c.Set("claims", &claims)
+		if assert.NoError(t, h(c)) {
+			assert.Equal(t, tc.code, rec.Code, tc.claims)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package account
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/mail"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Every login starts a session, which lives as long as its refresh tokens.
+// Its last-seen time is bumped by requests at most once a minute.
+const lastSeenPrecision = time.Minute
+
+// @Summary list the active sessions of the current account
+// @Description the session of the token in use has current set
+// @Tags Account
+// @Produce json
+// @Success 200 {object} api.ReturnedData{data=[]models.Session}
+// @Router /account/sessions [GET]
+func (h *AccountHandler) ListSessions(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	var sessions []models.Session
+	err := db.Where("account_id = ? AND revoked_at IS NULL AND expires_at > ?", c.Get("id"), time.Now()).
+		Order("last_seen_at DESC").Find(&sessions).Error
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	claims, _ := c.Get("claims").(*models.TokenClaims)
+	for i := range sessions {
+		sessions[i].Current = claims != nil && sessions[i].ID == claims.SessionID
+	}
+	return c.JSON(http.StatusOK, api.Return("ok", sessions))
+}
+
+// @Summary revoke a session of the current account
+// @Description its refresh and access tokens stop working at once
+// @Tags Account
+// @Produce json
+// @Param sessionID path uint true "session ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /account/sessions/{sessionID} [DELETE]
+func (h *AccountHandler) RevokeSession(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	var session models.Session
+	if err := db.Where("account_id = ?", c.Get("id")).First(&session, c.Param("sessionID")).Error; err != nil {
+		return api.Fail(c, api.SessionNotFound, nil)
+	}
+	revokeFamily(db, session.Family)
+	return c.JSON(http.StatusOK, api.Return("Session revoked", nil))
+}
+
+/**
+ * @brief record a login, or the refresh of one, in the session of family.
+ * The owner is told by email when a login comes from a device the account has not used before.
+ */
+func touchSession(c echo.Context, db *gorm.DB, account *models.Account, family string, newLogin bool, expiresAt time.Time) (*models.Session, error) {
+	now := time.Now()
+	userAgent := c.Request().UserAgent()
+	session := models.Session{
+		AccountID:  account.ID,
+		Family:     family,
+		UserAgent:  userAgent,
+		IP:         c.RealIP(),
+		LastSeenAt: now,
+		ExpiresAt:  expiresAt,
+	}
+	if !newLogin {
+		// Families from before sessions existed get one on their next refresh
+		err := db.Where(models.Session{Family: family}).
+			Attrs(models.Session{AccountID: account.ID, UserAgent: userAgent}).
+			Assign(models.Session{IP: session.IP, LastSeenAt: now, ExpiresAt: expiresAt}).
+			FirstOrCreate(&session).Error
+		return &session, err
+	}
+
+	var seen, known int64
+	db.Model(&models.Session{}).Where("account_id = ?", account.ID).Count(&seen)
+	db.Model(&models.Session{}).Where("account_id = ? AND user_agent = ?", account.ID, userAgent).Count(&known)
+	if err := db.Create(&session).Error; err != nil {
+		return nil, err
+	}
+	// The very first login of an account is no news
+	if seen > 0 && known == 0 {
+		notifyNewLogin(c, account, &session)
+	}
+	return &session, nil
+}
+
+/**
+ * @brief check that a session is not revoked, bumping its last-seen time on the way.
+ */
+func sessionAlive(db *gorm.DB, sessionID uint) bool {
+	var session models.Session
+	if err := db.Select("id", "last_seen_at", "revoked_at").First(&session, sessionID).Error; err != nil || session.RevokedAt != nil {
+		return false
+	}
+	if now := time.Now(); now.Sub(session.LastSeenAt) > lastSeenPrecision {
+		db.Model(&session).Update("last_seen_at", now)
+	}
+	return true
+}
+
+func notifyNewLogin(c echo.Context, account *models.Account, session *models.Session) {
+	lang := mail.Language(c.Request().Header.Get("Accept-Language"))
+	err := mail.SendTemplate(account.Email, lang, "new_login", echo.Map{
+		"UserAgent": session.UserAgent,
+		"IP":        session.IP,
+		"Time":      session.CreatedAt.Format("2006-01-02 15:04:05 MST"),
+	})
+	if err != nil {
+		c.Logger().Error("fail to send new login email: ", err)
+	}
+}
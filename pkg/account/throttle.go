@@ -0,0 +1,134 @@
+package account
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Failures are counted per email and per client IP. After a few failures every
+// further attempt has to wait exponentially longer, and an email with too many
+// failures is locked for a while. Successful attempts reset the email counter,
+// and a failure LOGIN_WINDOW_MIN minutes after the previous one restarts either counter.
+
+func emailKey(email string) string {
+	return "email:" + email
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+/**
+ * @brief how long the client has to wait before trying email again, 0 if it may go ahead.
+ */
+func retryAfter(c echo.Context, db *gorm.DB, email string) time.Duration {
+	var attempts []models.AuthAttempt
+	db.Where("key IN ?", []string{emailKey(email), ipKey(c.RealIP())}).Find(&attempts)
+
+	now := time.Now()
+	var wait time.Duration
+	for _, attempt := range attempts {
+		until := attempt.LastFailure.Add(backoff(attempt))
+		if attempt.LockedUntil.After(until) {
+			until = attempt.LockedUntil
+		}
+		if d := until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+/**
+ * @brief count a failed attempt of endpoint against email and the client IP.
+ * Locks the email once it reaches LOCKOUT_THRESHOLD failures.
+ */
+func recordFailure(c echo.Context, db *gorm.DB, endpoint string, email string) {
+	now := time.Now()
+	// Otherwise a shared IP, e.g. behind the hospital NAT, would back off for good
+	windowStart := now.Add(-time.Duration(envInt("LOGIN_WINDOW_MIN", 15)) * time.Minute)
+	for _, key := range []string{emailKey(email), ipKey(c.RealIP())} {
+		db.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "key"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"failures":     gorm.Expr("CASE WHEN auth_attempts.last_failure < ? THEN 1 ELSE auth_attempts.failures + 1 END", windowStart),
+				"last_failure": now,
+			}),
+		}).Create(&models.AuthAttempt{Key: key, Failures: 1, LastFailure: now})
+	}
+
+	var attempt models.AuthAttempt
+	if err := db.Where("key = ?", emailKey(email)).First(&attempt).Error; err != nil {
+		return
+	}
+	if attempt.Failures < envInt("LOCKOUT_THRESHOLD", 10) || attempt.LockedUntil.After(now) {
+		return
+	}
+
+	lockedUntil := now.Add(time.Duration(envInt("LOCKOUT_MIN", 30)) * time.Minute)
+	db.Model(&attempt).Update("locked_until", lockedUntil)
+	db.Create(&models.LockoutEvent{
+		Email:       email,
+		IP:          c.RealIP(),
+		Endpoint:    endpoint,
+		Failures:    attempt.Failures,
+		LockedUntil: lockedUntil,
+	})
+	c.Logger().Warnf("account %s locked until %s after %d failures", email, lockedUntil, attempt.Failures)
+}
+
+/**
+ * @brief reset the failure counter of email after a successful attempt.
+ */
+func clearFailures(db *gorm.DB, email string) {
+	db.Where("key = ?", emailKey(email)).Delete(&models.AuthAttempt{})
+}
+
+func tooManyAttempts(c echo.Context, wait time.Duration) error {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return api.Fail(c, api.TooManyAttempts, echo.Map{"retry_after": seconds})
+}
+
+/**
+ * @brief the delay imposed after the latest failure of attempt.
+ * Emails start backing off after LOGIN_BACKOFF_AFTER failures, IPs after IP_BACKOFF_AFTER,
+ * doubling from LOGIN_BACKOFF_BASE_SEC up to LOGIN_BACKOFF_MAX_SEC.
+ */
+func backoff(attempt models.AuthAttempt) time.Duration {
+	after := envInt("LOGIN_BACKOFF_AFTER", 3)
+	if strings.HasPrefix(attempt.Key, "ip:") {
+		after = envInt("IP_BACKOFF_AFTER", 20)
+	}
+	excess := attempt.Failures - after
+	if excess < 0 {
+		return 0
+	}
+
+	base := time.Duration(envInt("LOGIN_BACKOFF_BASE_SEC", 1)) * time.Second
+	max := time.Duration(envInt("LOGIN_BACKOFF_MAX_SEC", 300)) * time.Second
+	if excess > 30 {
+		return max
+	}
+	if d := base << uint(excess); d < max {
+		return d
+	}
+	return max
+}
+
+func envInt(key string, fallback int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n <= 0 {
+		return fallback
+	}
+	return n
+}
@@ -0,0 +1,281 @@
+package account
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/keyring"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errTokenRevoked    = errors.New("token has been revoked")
+	errAccountDisabled = errors.New("account has been disabled")
+)
+
+// @Summary public keys verifying access tokens
+// @Description a JWK Set for other services; tokens name their key in the kid header. Tokens signed with the JWT_KEY secret cannot be verified with it
+// @Tags Account
+// @Produce json
+// @Success 200 {object} keyring.JWKS
+// @Router /.well-known/jwks.json [GET]
+func (h *AccountHandler) JWKS(c echo.Context) error {
+	// Clients may cache the keys for a while, but must see a new key before tokens signed with it
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return c.JSON(http.StatusOK, keyring.Current().JWKS())
+}
+
+// @Summary exchange a refresh token for a new token pair
+// @Description the given refresh token is consumed; presenting it again revokes every token rotated from the same login
+// @Tags Account
+// @Produce json
+// @Param refresh_token body string true "refresh token"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 401 {object} api.ReturnedData{}
+// @Router /account/refresh [POST]
+func (h *AccountHandler) RefreshToken(c echo.Context) error {
+	type RequestBody struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	var token models.RefreshToken
+	if err := db.Where("token_hash = ?", hashToken(body.RefreshToken)).First(&token).Error; err != nil {
+		return api.Fail(c, api.InvalidRefreshToken, nil)
+	}
+	if token.RevokedAt != nil {
+		// A rotated token showing up again means it leaked, so kill the whole family.
+		revokeFamily(db, token.Family)
+		return api.Fail(c, api.InvalidRefreshToken, nil)
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return api.Fail(c, api.RefreshTokenExpired, nil)
+	}
+
+	// Consume the token; losing the race to a concurrent refresh counts as reuse.
+	result := db.Model(&models.RefreshToken{}).Where("id = ? AND revoked_at IS NULL", token.ID).Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return api.Fail(c, api.DBError, result.Error.Error())
+	}
+	if result.RowsAffected != 1 {
+		revokeFamily(db, token.Family)
+		return api.Fail(c, api.InvalidRefreshToken, nil)
+	}
+
+	var account models.Account
+	if err := db.First(&account, token.AccountID).Error; err != nil {
+		return api.Fail(c, api.InvalidRefreshToken, nil)
+	}
+	if account.Disabled {
+		return api.Fail(c, api.AccountDisabled, nil)
+	}
+	data, err := issueTokens(c, db, &account, token.Family, token.MFA)
+	if err != nil {
+		return api.Fail(c, api.TokenError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Refreshed", data))
+}
+
+// @Summary log out the current session
+// @Description revokes the access token in use and its session; the refresh token, if given, is revoked as well
+// @Tags Account
+// @Produce json
+// @Param refresh_token body string false "refresh token of this session"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /account/logout [POST]
+func (h *AccountHandler) Logout(c echo.Context) error {
+	type RequestBody struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	var body RequestBody
+	if err := c.Bind(&body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	claims, _ := c.Get("claims").(*models.TokenClaims)
+	if err := revokeAccessToken(db, claims); err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+
+	if claims.SessionID != 0 {
+		var session models.Session
+		if err := db.First(&session, claims.SessionID).Error; err == nil {
+			revokeFamily(db, session.Family)
+		}
+	}
+	if body.RefreshToken != "" {
+		var token models.RefreshToken
+		err := db.Where("token_hash = ? AND account_id = ?", hashToken(body.RefreshToken), claims.AccountID).First(&token).Error
+		if err == nil {
+			revokeFamily(db, token.Family)
+		}
+	}
+	return c.JSON(http.StatusOK, api.Return("Account logged out", nil))
+}
+
+// @Summary log out everywhere
+// @Description revokes every access and refresh token issued to the current account
+// @Tags Account
+// @Produce json
+// @Success 200 {object} api.ReturnedData{}
+// @Router /account/logoutall [POST]
+func (h *AccountHandler) LogoutAll(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	if err := revokeAllTokens(db, c.Get("id").(uint)); err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Account logged out everywhere", nil))
+}
+
+/**
+ * @brief issue an access token and a refresh token for account.
+ * An empty family starts a new one, i.e. a new login and session. mfa tells whether the login passed the second factor.
+ */
+func issueTokens(c echo.Context, db *gorm.DB, account *models.Account, family string, mfa bool) (echo.Map, error) {
+	var doctor models.Doctor
+	var patient models.Patient
+	switch account.Type {
+	case models.DoctorType:
+		db.Where("account_id = ?", account.ID).First(&doctor)
+	case models.PatientType:
+		db.Where("account_id = ?", account.ID).First(&patient)
+	}
+
+	newLogin := family == ""
+	if newLogin {
+		var err error
+		if family, err = utils.RandomString(16); err != nil {
+			return nil, err
+		}
+	}
+	expiresAt := time.Now().Add(models.RefreshTokenLifetime())
+	session, err := touchSession(c, db, account, family, newLogin, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := account.GenerateToken(models.TokenClaims{
+		DoctorID:  doctor.ID,
+		PatientID: patient.ID,
+		MFA:       mfa,
+		Approved:  doctor.Status == models.DoctorApproved,
+		SessionID: session.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := utils.RandomString(32)
+	if err != nil {
+		return nil, err
+	}
+	record := models.RefreshToken{
+		AccountID: account.ID,
+		Family:    family,
+		TokenHash: hashToken(refreshToken),
+		ExpiresAt: expiresAt,
+		MFA:       mfa,
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return nil, err
+	}
+
+	return echo.Map{
+		"account":       account,
+		"token":         accessToken,
+		"refresh_token": refreshToken,
+		"expires_in":    int(models.AccessTokenLifetime().Seconds()),
+		"session_id":    session.ID,
+	}, nil
+}
+
+/**
+ * @brief load the state of the account behind claims, rejecting tokens revoked one way or another.
+ * Only the columns needed per request are loaded.
+ */
+func loadTokenAccount(db *gorm.DB, claims *models.TokenClaims) (*models.Account, error) {
+	var account models.Account
+	if err := db.Select("id", "token_version", "disabled", "email_verified").First(&account, claims.AccountID).Error; err != nil {
+		return nil, errors.New("account not found")
+	}
+	if account.Disabled {
+		return nil, errAccountDisabled
+	}
+	if account.TokenVersion != claims.Version {
+		return nil, errTokenRevoked
+	}
+	if err := db.Where("jti = ?", claims.Id).First(&models.RevokedToken{}).Error; err == nil {
+		return nil, errTokenRevoked
+	}
+	// Tokens from before sessions existed have no sid
+	if claims.SessionID != 0 && !sessionAlive(db, claims.SessionID) {
+		return nil, errTokenRevoked
+	}
+	return &account, nil
+}
+
+/**
+ * @brief put a single access token into the revocation store.
+ */
+func revokeAccessToken(db *gorm.DB, claims *models.TokenClaims) error {
+	// Entries are only needed until the token would have expired anyway.
+	db.Where("expires_at < ?", time.Now()).Delete(&models.RevokedToken{})
+
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.RevokedToken{
+		JTI:       claims.Id,
+		AccountID: claims.AccountID,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}).Error
+}
+
+/**
+ * @brief invalidate every access and refresh token of an account.
+ */
+func revokeAllTokens(db *gorm.DB, accountID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := bumpTokenVersion(tx, accountID); err != nil {
+			return err
+		}
+		err := tx.Model(&models.RefreshToken{}).Where("account_id = ? AND revoked_at IS NULL", accountID).
+			Update("revoked_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&models.Session{}).Where("account_id = ? AND revoked_at IS NULL", accountID).
+			Update("revoked_at", time.Now()).Error
+	})
+}
+
+/**
+ * @brief invalidate the access tokens of an account, e.g. because their claims are stale.
+ * Refresh tokens stay valid and will issue access tokens with up to date claims.
+ */
+func bumpTokenVersion(db *gorm.DB, accountID uint) error {
+	return db.Model(&models.Account{}).Where("id = ?", accountID).
+		Update("token_version", gorm.Expr("token_version + 1")).Error
+}
+
+/**
+ * @brief revoke every refresh token of a login, and its session with the access tokens naming it.
+ */
+func revokeFamily(db *gorm.DB, family string) {
+	db.Model(&models.RefreshToken{}).Where("family = ? AND revoked_at IS NULL", family).Update("revoked_at", time.Now())
+	db.Model(&models.Session{}).Where("family = ? AND revoked_at IS NULL", family).Update("revoked_at", time.Now())
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
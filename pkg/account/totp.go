@@ -0,0 +1,421 @@
+package account
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/totp"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// A login with TOTP enabled takes two steps: the password is exchanged for a
+// short-lived challenge, which together with a TOTP or recovery code is
+// exchanged for the real tokens.
+
+const (
+	challengeLifetime = 5 * time.Minute
+	recoveryCodeCount = 10
+	totpSkew          = 1 // Steps of clock drift tolerated either way
+)
+
+// @Summary second step of a login with TOTP enabled
+// @Description takes the challenge returned by /account/login and either a TOTP code or a recovery code
+// @Tags Account
+// @Produce json
+// @Param challenge body string true "challenge from /account/login"
+// @Param code body string false "TOTP code"
+// @Param recoverycode body string false "one-time recovery code"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Failure 401 {object} api.ReturnedData{}
+// @Router /account/login/totp [POST]
+func (h *AccountHandler) LoginTOTP(c echo.Context) error {
+	type RequestBody struct {
+		Challenge    string `json:"challenge" validate:"required"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoverycode"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+	if body.Code == "" && body.RecoveryCode == "" {
+		return api.Fail(c, api.TOTPCodeRequired, nil)
+	}
+
+	claims, err := parseChallenge(body.Challenge)
+	if err != nil {
+		return api.Fail(c, api.InvalidChallenge, err.Error())
+	}
+	db, _ := c.Get("db").(*gorm.DB)
+	var account models.Account
+	if err := db.First(&account, claims.AccountID).Error; err != nil {
+		return api.Fail(c, api.InvalidChallenge, nil)
+	}
+	// A password change since the first step voids the challenge
+	if account.TokenVersion != claims.Version || !account.TOTPEnabled {
+		return api.Fail(c, api.InvalidChallenge, nil)
+	}
+	if account.Disabled {
+		return api.Fail(c, api.AccountDisabled, nil)
+	}
+	if wait := retryAfter(c, db, account.Email); wait > 0 {
+		return tooManyAttempts(c, wait)
+	}
+
+	var ok bool
+	if body.Code != "" {
+		ok = checkTOTP(db, &account, body.Code)
+	} else {
+		ok = useRecoveryCode(db, account.ID, body.RecoveryCode)
+	}
+	if !ok {
+		recordFailure(c, db, "login/totp", account.Email)
+		return api.Fail(c, api.WrongTOTPCode, nil)
+	}
+	clearFailures(db, account.Email)
+
+	data, err := issueTokens(c, db, &account, "", true)
+	if err != nil {
+		return api.Fail(c, api.TokenError, err.Error())
+	}
+	if body.Code == "" {
+		var left int64
+		db.Model(&models.RecoveryCode{}).Where("account_id = ? AND used_at IS NULL", account.ID).Count(&left)
+		data["recovery_codes_left"] = left
+	}
+	return c.JSON(http.StatusOK, api.Return("Logged in", data))
+}
+
+// @Summary start TOTP enrollment
+// @Description generates a secret and its otpauth:// provisioning URI, to be shown as a QR code; TOTP is enabled once /account/totp/confirm succeeds
+// @Tags Account
+// @Produce json
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/totp/enroll [POST]
+func (h *AccountHandler) EnrollTOTP(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	var account models.Account
+	if err := db.First(&account, c.Get("id")).Error; err != nil {
+		return api.Fail(c, api.NotLoggedIn, nil)
+	}
+	if account.TOTPEnabled {
+		return api.Fail(c, api.TOTPAlreadyEnabled, nil)
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return api.Fail(c, api.InternalError, err.Error())
+	}
+	if err := db.Model(&account).Update("totp_secret", secret).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("TOTP enrollment started", echo.Map{
+		"secret": secret,
+		"uri":    totp.URI(totpIssuer(), account.Email, secret),
+	}))
+}
+
+// @Summary finish TOTP enrollment
+// @Description enables TOTP with a code from the enrolled device, returns the recovery codes (shown only once) and tokens that passed the second factor
+// @Tags Account
+// @Produce json
+// @Param code body string true "TOTP code"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/totp/confirm [POST]
+func (h *AccountHandler) ConfirmTOTP(c echo.Context) error {
+	type RequestBody struct {
+		Code string `json:"code" validate:"required"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	var account models.Account
+	if err := db.First(&account, c.Get("id")).Error; err != nil {
+		return api.Fail(c, api.NotLoggedIn, nil)
+	}
+	if account.TOTPEnabled {
+		return api.Fail(c, api.TOTPAlreadyEnabled, nil)
+	}
+	if account.TOTPSecret == "" {
+		return api.Fail(c, api.TOTPNotStarted, nil)
+	}
+	if wait := retryAfter(c, db, account.Email); wait > 0 {
+		return tooManyAttempts(c, wait)
+	}
+	if !checkTOTP(db, &account, body.Code) {
+		recordFailure(c, db, "totp/confirm", account.Email)
+		return api.Fail(c, api.WrongTOTPCode, nil)
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&account).Update("totp_enabled", true).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = newRecoveryCodes(tx, account.ID)
+		return err
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+
+	data, err := issueTokens(c, db, &account, "", true)
+	if err != nil {
+		return api.Fail(c, api.TokenError, err.Error())
+	}
+	data["recovery_codes"] = codes
+	return c.JSON(http.StatusOK, api.Return("TOTP enabled", data))
+}
+
+// @Summary disable TOTP
+// @Description needs the password and a current TOTP code; refused for roles in TOTP_REQUIRED_ROLES
+// @Tags Account
+// @Produce json
+// @Param passwd body string true "user password"
+// @Param code body string true "TOTP code"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/totp/disable [POST]
+func (h *AccountHandler) DisableTOTP(c echo.Context) error {
+	type RequestBody struct {
+		Passwd string `json:"passwd" validate:"required"`
+		Code   string `json:"code" validate:"required"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	var account models.Account
+	if err := db.First(&account, c.Get("id")).Error; err != nil {
+		return api.Fail(c, api.NotLoggedIn, nil)
+	}
+	if !account.TOTPEnabled {
+		return api.Fail(c, api.TOTPNotEnabled, nil)
+	}
+	if totpRequired(account.Type) {
+		return api.Fail(c, api.TOTPRequired, nil)
+	}
+	if wait := retryAfter(c, db, account.Email); wait > 0 {
+		return tooManyAttempts(c, wait)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(account.Passwd), []byte(body.Passwd)) != nil || !checkTOTP(db, &account, body.Code) {
+		recordFailure(c, db, "totp/disable", account.Email)
+		return api.Fail(c, api.WrongPasswordOrTOTP, nil)
+	}
+
+	if err := clearTOTP(db, account.ID); err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("TOTP disabled", nil))
+}
+
+// @Summary replace the recovery codes
+// @Description invalidates every unused recovery code and returns a new set
+// @Tags Account
+// @Produce json
+// @Param code body string true "TOTP code"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/totp/recoverycodes [POST]
+func (h *AccountHandler) RegenerateRecoveryCodes(c echo.Context) error {
+	type RequestBody struct {
+		Code string `json:"code" validate:"required"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	var account models.Account
+	if err := db.First(&account, c.Get("id")).Error; err != nil {
+		return api.Fail(c, api.NotLoggedIn, nil)
+	}
+	if !account.TOTPEnabled {
+		return api.Fail(c, api.TOTPNotEnabled, nil)
+	}
+	if wait := retryAfter(c, db, account.Email); wait > 0 {
+		return tooManyAttempts(c, wait)
+	}
+	if !checkTOTP(db, &account, body.Code) {
+		recordFailure(c, db, "totp/recoverycodes", account.Email)
+		return api.Fail(c, api.WrongTOTPCode, nil)
+	}
+
+	codes, err := newRecoveryCodes(db, account.ID)
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("Recovery codes replaced", echo.Map{"recovery_codes": codes}))
+}
+
+// @Summary reset an account's TOTP, e.g. after the device got lost
+// @Description disables TOTP and logs the account out everywhere; roles in TOTP_REQUIRED_ROLES will have to enroll again
+// @Tags Admin
+// @Produce json
+// @Param accountID path uint true "account ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/accounts/{accountID}/totp/reset [PUT]
+func (h *AdminHandler) ResetTOTP(c echo.Context) error {
+	account, code := h.targetAccount(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	if err := clearTOTP(db, account.ID); err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	if err := revokeAllTokens(db, account.ID); err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("TOTP reset", nil))
+}
+
+/**
+ * @brief whether accounts of type must pass TOTP, according to TOTP_REQUIRED_ROLES.
+ */
+func totpRequired(accountType models.AcountType) bool {
+	return roleListed("TOTP_REQUIRED_ROLES", accountType)
+}
+
+/**
+ * @brief whether the comma separated account types in the environment variable key include accountType.
+ */
+func roleListed(key string, accountType models.AcountType) bool {
+	for _, role := range strings.Split(os.Getenv(key), ",") {
+		if models.AcountType(strings.TrimSpace(role)) == accountType {
+			return true
+		}
+	}
+	return false
+}
+
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "MediConnect"
+}
+
+/**
+ * @brief check code against the TOTP secret of account.
+ * A step is accepted at most once, so a code seen by someone else cannot be replayed.
+ */
+func checkTOTP(db *gorm.DB, account *models.Account, code string) bool {
+	if account.TOTPSecret == "" {
+		return false
+	}
+	step, ok := totp.Validate(account.TOTPSecret, strings.TrimSpace(code), time.Now(), totpSkew)
+	if !ok || step <= account.TOTPLastStep {
+		return false
+	}
+	// Conditional so that two concurrent requests cannot both use the step
+	result := db.Model(&models.Account{}).Where("id = ? AND totp_last_step < ?", account.ID, step).Update("totp_last_step", step)
+	if result.Error != nil || result.RowsAffected != 1 {
+		return false
+	}
+	account.TOTPLastStep = step
+	return true
+}
+
+/**
+ * @brief consume an unused recovery code of the account.
+ */
+func useRecoveryCode(db *gorm.DB, accountID uint, code string) bool {
+	result := db.Model(&models.RecoveryCode{}).
+		Where("account_id = ? AND code_hash = ? AND used_at IS NULL", accountID, hashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+/**
+ * @brief replace the recovery codes of an account, returning the new ones in plaintext.
+ */
+func newRecoveryCodes(db *gorm.DB, accountID uint) ([]string, error) {
+	if err := db.Where("account_id = ?", accountID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	records := make([]models.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b)) // 8 characters
+		codes[i] = code[:4] + "-" + code[4:]
+		records[i] = models.RecoveryCode{AccountID: accountID, CodeHash: hashToken(code)}
+	}
+	if err := db.Create(&records).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+/**
+ * @brief turn TOTP off for an account and drop its recovery codes.
+ */
+func clearTOTP(db *gorm.DB, accountID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.Account{}).Where("id = ?", accountID).Updates(map[string]interface{}{
+			"totp_enabled":   false,
+			"totp_secret":    "",
+			"totp_last_step": 0,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("account_id = ?", accountID).Delete(&models.RecoveryCode{}).Error
+	})
+}
+
+/**
+ * @brief sign the challenge standing for a verified password of account.
+ */
+func newChallenge(account *models.Account) (string, error) {
+	now := time.Now()
+	claims := models.TokenClaims{
+		AccountID: account.ID,
+		Version:   account.TokenVersion,
+		Type:      account.Type,
+		Purpose:   models.ChallengePurpose,
+	}
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(challengeLifetime).Unix()
+	return models.SignToken(claims)
+}
+
+func parseChallenge(challenge string) (*models.TokenClaims, error) {
+	claims, err := parseSigned(challenge)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != models.ChallengePurpose {
+		return nil, errors.New("not a login challenge")
+	}
+	return claims, nil
+}
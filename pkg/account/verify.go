@@ -0,0 +1,107 @@
+package account
+
+import (
+	"net/http"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// @Summary verify the ownership of an email
+// @Description takes the code mailed on account creation or by /account/sendverification
+// @Tags Account
+// @Produce json
+// @Param email body string true "user e-mail"
+// @Param authcode body string true "given auth code"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/verifyemail [POST]
+func (h *AccountHandler) VerifyEmail(c echo.Context) error {
+	type RequestBody struct {
+		Email    string `json:"email" validate:"required"`
+		AuthCode string `json:"authcode" validate:"required"`
+	}
+	var body RequestBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	if wait := retryAfter(c, db, body.Email); wait > 0 {
+		return tooManyAttempts(c, wait)
+	}
+	if !verifyAuthCode(c, db, "verifyemail", body.Email, body.AuthCode, models.VerifyPurpose) {
+		return api.Fail(c, api.WrongAuthCode, echo.Map{"authcodeok": false})
+	}
+
+	if result := db.Model(&models.Account{}).Where("email = ?", body.Email).Update("email_verified", true); result.Error != nil {
+		return api.Fail(c, api.DBError, result.Error.Error())
+	}
+	db.Where("email = ? AND purpose = ?", body.Email, models.VerifyPurpose).Delete(&models.Auth{})
+	clearFailures(db, body.Email)
+	return c.JSON(http.StatusOK, api.Return("E-Mail verified", nil))
+}
+
+// @Summary send a new verification code to the current account's email
+// @Tags Account
+// @Produce json
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /account/sendverification [POST]
+func (h *AccountHandler) SendVerification(c echo.Context) error {
+	db, _ := c.Get("db").(*gorm.DB)
+	var account models.Account
+	if err := db.First(&account, c.Get("id")).Error; err != nil {
+		return api.Fail(c, api.NotLoggedIn, nil)
+	}
+	return sendVerification(c, db, &account)
+}
+
+// @Summary mark an account's email as verified
+// @Tags Admin
+// @Produce json
+// @Param accountID path uint true "account ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/accounts/{accountID}/verify [PUT]
+func (h *AdminHandler) VerifyAccount(c echo.Context) error {
+	account, code := h.targetAccount(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	if err := db.Model(&account).Update("email_verified", true).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	return c.JSON(http.StatusOK, api.Return("E-Mail verified", nil))
+}
+
+// @Summary send a new verification code to an account's email
+// @Tags Admin
+// @Produce json
+// @Param accountID path uint true "account ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /admin/accounts/{accountID}/sendverification [POST]
+func (h *AdminHandler) SendVerification(c echo.Context) error {
+	account, code := h.targetAccount(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	db, _ := c.Get("db").(*gorm.DB)
+	return sendVerification(c, db, &account)
+}
+
+func sendVerification(c echo.Context, db *gorm.DB, account *models.Account) error {
+	if account.EmailVerified {
+		return api.Fail(c, api.EmailAlreadyVerified, nil)
+	}
+	if err := sendAuthCode(c, db, account.Email, models.VerifyPurpose, "verify_email"); err != nil {
+		c.Logger().Error("fail to send verification email: ", err)
+		return api.Fail(c, api.MailServerError, nil)
+	}
+	return c.JSON(http.StatusOK, api.Return("Successfully send verification email", nil))
+}
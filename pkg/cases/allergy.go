@@ -0,0 +1,243 @@
+package cases
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// allergyBody is what doctors send to record an allergy, either MedicineID or Ingredient is required.
+type allergyBody struct {
+	MedicineID *uint                  `json:"medicine_id"`
+	Ingredient string                 `json:"ingredient"`
+	Reaction   string                 `json:"reaction"`
+	Severity   models.AllergySeverity `json:"severity" validate:"omitempty,oneof=unknown mild moderate severe"`
+	Note       string                 `json:"note"`
+}
+
+// @Summary Get the allergies of a patient
+// @Description unstructured entries come from the free-text allergy of the patient and only carry a note
+// @Tags Case
+// @Produce json
+// @Param patientID path uint true "patient account ID"
+// @Success 200 {object} api.ReturnedData{data=[]models.Allergy}
+// @Router /patient/{patientID}/allergies [GET]
+func (h *CaseHandler) GetAllergies(c echo.Context) error {
+	patient, code := patientFromParam(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	var allergies []models.Allergy
+	utils.GetDB().Preload("Medicine").Where("patient_id = ?", patient.ID).Order("recorded_at").Find(&allergies)
+	c.Logger().Debug("GetAllergies")
+	return c.JSON(200, api.Return("ok", allergies))
+}
+
+// @Summary Get the allergy history of a patient
+// @Description every change of every allergy, deleted ones included, oldest first
+// @Tags Case
+// @Produce json
+// @Param patientID path uint true "patient account ID"
+// @Param allergyID query uint false "only this allergy" nil
+// @Success 200 {object} api.ReturnedData{data=[]models.AllergyHistory}
+// @Router /patient/{patientID}/allergies/history [GET]
+func (h *CaseHandler) GetAllergyHistory(c echo.Context) error {
+	patient, code := patientFromParam(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	db := utils.GetDB().Where("patient_id = ?", patient.ID)
+	if c.QueryParam("allergyID") != "" {
+		db = db.Where("allergy_id = ?", c.QueryParam("allergyID"))
+	}
+	var history []models.AllergyHistory
+	db.Order("id").Find(&history)
+	c.Logger().Debug("GetAllergyHistory")
+	return c.JSON(200, api.Return("ok", history))
+}
+
+// @Summary Record an allergy
+// @Description the allergen is either a medicine or an ingredient; severity is one of unknown, mild, moderate, severe
+// @Tags Case
+// @Produce json
+// @Param patientID path uint true "patient account ID"
+// @Param medicine_id body uint false "allergen medicine ID"
+// @Param ingredient body string false "allergen ingredient"
+// @Param reaction body string false "reaction"
+// @Param severity body string false "severity, unknown if omitted"
+// @Param note body string false "note"
+// @Success 200 {object} api.ReturnedData{data=models.Allergy}
+// @Router /patient/{patientID}/allergies [POST]
+func (h *CaseHandler) NewAllergy(c echo.Context) error {
+	patient, code := patientFromParam(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	var body allergyBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+	if code = body.check(); code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	allergy := models.Allergy{PatientID: patient.ID}
+	body.applyTo(c, &allergy)
+	err := utils.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&allergy).Error; err != nil {
+			return err
+		}
+		history := allergy.Snapshot(models.AllergyCreated, c.Get("id").(uint))
+		return tx.Create(&history).Error
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	c.Logger().Debug("NewAllergy")
+	return c.JSON(200, api.Return("ok", allergy))
+}
+
+// @Summary Update an allergy
+// @Description replaces the entry with the given fields; an updated unstructured entry becomes structured
+// @Tags Case
+// @Produce json
+// @Param patientID path uint true "patient account ID"
+// @Param allergyID path uint true "allergy ID"
+// @Param medicine_id body uint false "allergen medicine ID"
+// @Param ingredient body string false "allergen ingredient"
+// @Param reaction body string false "reaction"
+// @Param severity body string false "severity, unknown if omitted"
+// @Param note body string false "note"
+// @Success 200 {object} api.ReturnedData{data=models.Allergy}
+// @Router /patient/{patientID}/allergies/{allergyID} [PUT]
+func (h *CaseHandler) UpdateAllergy(c echo.Context) error {
+	allergy, code := allergyFromParam(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	var body allergyBody
+	if err := utils.ExtractDataWithValidating(c, &body); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+	if code = body.check(); code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	body.applyTo(c, allergy)
+	err := utils.GetDB().Transaction(func(tx *gorm.DB) error {
+		// Select every column, zero values included, so that cleared fields are written too
+		if err := tx.Model(allergy).Select("*").Omit("Medicine").Updates(allergy).Error; err != nil {
+			return err
+		}
+		history := allergy.Snapshot(models.AllergyUpdated, c.Get("id").(uint))
+		return tx.Create(&history).Error
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	c.Logger().Debug("UpdateAllergy")
+	return c.JSON(200, api.Return("ok", allergy))
+}
+
+// @Summary Delete an allergy
+// @Description the entry stays in the allergy history
+// @Tags Case
+// @Produce json
+// @Param patientID path uint true "patient account ID"
+// @Param allergyID path uint true "allergy ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Router /patient/{patientID}/allergies/{allergyID} [DELETE]
+func (h *CaseHandler) DeleteAllergy(c echo.Context) error {
+	allergy, code := allergyFromParam(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+
+	err := utils.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(allergy).Error; err != nil {
+			return err
+		}
+		history := allergy.Snapshot(models.AllergyDeleted, c.Get("id").(uint))
+		return tx.Create(&history).Error
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	c.Logger().Debug("DeleteAllergy")
+	return c.JSON(200, api.Return("ok", nil))
+}
+
+/**
+ * @brief load the patient named by the patientID path param, which is an account ID like on the other /patient routes.
+ * The current account must be allowed to access the patient.
+ */
+func patientFromParam(c echo.Context) (*models.Patient, api.Code) {
+	accountID, err := strconv.Atoi(c.Param("patientID"))
+	if err != nil {
+		return nil, api.InvalidID
+	}
+	if !FromPatient(c, uint(accountID)) {
+		return nil, api.PermissionDenied
+	}
+	var patient models.Patient
+	if err := utils.GetDB().Where("account_id = ?", accountID).First(&patient).Error; err != nil {
+		return nil, api.PatientNotFound
+	}
+	return &patient, ""
+}
+
+/**
+ * @brief load the allergy named by the allergyID path param, which must belong to the patient of the patientID param.
+ */
+func allergyFromParam(c echo.Context) (*models.Allergy, api.Code) {
+	patient, code := patientFromParam(c)
+	if code != "" {
+		return nil, code
+	}
+	var allergy models.Allergy
+	if err := utils.GetDB().Where("patient_id = ?", patient.ID).First(&allergy, c.Param("allergyID")).Error; err != nil {
+		return nil, api.AllergyNotFound
+	}
+	return &allergy, ""
+}
+
+/**
+ * @brief check the medicine or ingredient of an allergy, and default its severity to unknown.
+ */
+func (body *allergyBody) check() api.Code {
+	if body.MedicineID == nil && body.Ingredient == "" {
+		return api.AllergyTargetRequired
+	}
+	if body.MedicineID != nil {
+		if err := utils.GetDB().First(&models.Medicine{}, *body.MedicineID).Error; err != nil {
+			return api.MedicineNotFound
+		}
+	}
+	if body.Severity == "" {
+		body.Severity = models.SeverityUnknown
+	}
+	return ""
+}
+
+/**
+ * @brief fill allergy in from body, recorded by the current doctor just now
+ */
+func (body *allergyBody) applyTo(c echo.Context, allergy *models.Allergy) {
+	doctorID, _ := c.Get("doctorID").(uint)
+	allergy.MedicineID = body.MedicineID
+	allergy.Medicine = nil
+	allergy.Ingredient = body.Ingredient
+	allergy.Reaction = body.Reaction
+	allergy.Severity = body.Severity
+	allergy.Note = body.Note
+	allergy.Unstructured = false
+	allergy.RecordedBy = doctorID
+	allergy.RecordedAt = time.Now()
+}
@@ -0,0 +1,210 @@
+package cases
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+/**
+ * @brief how long deleted cases and prescriptions are kept before they may be purged, RETENTION_DAY days.
+ * Medical records are kept 15 years by default.
+ */
+func retention() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("RETENTION_DAY"))
+	if err != nil || days <= 0 {
+		days = 15 * 365
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+/**
+ * @brief whether a record deleted at deletedAt may be purged, and from when.
+ */
+func purgeable(deletedAt gorm.DeletedAt) (bool, time.Time) {
+	at := deletedAt.Time.Add(retention())
+	return deletedAt.Valid && !time.Now().Before(at), at
+}
+
+// @Summary List deleted cases
+// @Description most recently deleted first
+// @Tags Admin
+// @Produce json
+// @Param page query int false "page number, starting from 1"
+// @Param size query int false "page size, at most 100"
+// @Success 200 {string} api.ReturnedData{data=echo.Map{"total": int, "cases": []models.Case}}
+// @Router /admin/cases/deleted [GET]
+func (h *CaseHandler) ListDeletedCases(c echo.Context) error {
+	query := utils.GetDB().Unscoped().Model(&models.Case{}).Where("deleted_at IS NOT NULL")
+	var total int64
+	query.Count(&total)
+	page, size := utils.Pagination(c)
+	var cases []models.Case
+	if err := query.Order("deleted_at DESC").Offset((page - 1) * size).Limit(size).Find(&cases).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	c.Logger().Debug("ListDeletedCases")
+	return c.JSON(200, api.Return("ok", echo.Map{"total": total, "cases": cases}))
+}
+
+// @Summary List deleted prescriptions
+// @Description most recently deleted first, prescriptions of deleted cases come back with their case
+// @Tags Admin
+// @Produce json
+// @Param page query int false "page number, starting from 1"
+// @Param size query int false "page size, at most 100"
+// @Success 200 {string} api.ReturnedData{data=echo.Map{"total": int, "prescriptions": []models.Prescription}}
+// @Router /admin/prescriptions/deleted [GET]
+func (h *CaseHandler) ListDeletedPrescriptions(c echo.Context) error {
+	query := utils.GetDB().Unscoped().Model(&models.Prescription{}).Where("deleted_at IS NOT NULL")
+	var total int64
+	query.Count(&total)
+	page, size := utils.Pagination(c)
+	var pres []models.Prescription
+	if err := query.Preload("Guidelines").Order("deleted_at DESC").Offset((page - 1) * size).Limit(size).Find(&pres).Error; err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	c.Logger().Debug("ListDeletedPrescriptions")
+	return c.JSON(200, api.Return("ok", echo.Map{"total": total, "prescriptions": pres}))
+}
+
+// @Summary Restore a deleted case
+// @Description recorded as a revision
+// @Tags Admin
+// @Produce json
+// @Param caseID path uint true "case ID"
+// @Param reason query string true "reason of the restoration"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /admin/cases/{caseID}/restore [PUT]
+func (h *CaseHandler) RestoreCase(c echo.Context) error {
+	reason, code := amendmentReason(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	db := utils.GetDB()
+	var cas models.Case
+	if err := db.Unscoped().Where("deleted_at IS NOT NULL").First(&cas, c.Param("caseID")).Error; err != nil {
+		return api.Fail(c, api.CaseNotFound, nil)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		restore := map[string]interface{}{"deleted_at": nil, "deleted_by": nil, "delete_reason": ""}
+		if err := tx.Unscoped().Model(&cas).Updates(restore).Error; err != nil {
+			return err
+		}
+		return models.RecordCaseRevision(tx, cas.ID, models.CaseRestored, c.Get("id").(uint), reason)
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	c.Logger().Debug("RestoreCase")
+	return c.JSON(200, api.Return("ok", nil))
+}
+
+// @Summary Restore a deleted prescription
+// @Description its case must not be deleted, recorded as a revision of the case
+// @Tags Admin
+// @Produce json
+// @Param prescriptionID path uint true "prescription ID"
+// @Param reason query string true "reason of the restoration"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /admin/prescriptions/{prescriptionID}/restore [PUT]
+func (h *CaseHandler) RestorePrescription(c echo.Context) error {
+	reason, code := amendmentReason(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	db := utils.GetDB()
+	var pre models.Prescription
+	if err := db.Unscoped().Where("deleted_at IS NOT NULL").First(&pre, c.Param("prescriptionID")).Error; err != nil {
+		return api.Fail(c, api.PrescriptionNotFound, nil)
+	}
+	if err := db.First(&models.Case{}, pre.CaseID).Error; err != nil {
+		return api.Fail(c, api.CaseDeleted, nil)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		restore := map[string]interface{}{"deleted_at": nil, "deleted_by": nil, "delete_reason": ""}
+		if err := tx.Unscoped().Model(&pre).Updates(restore).Error; err != nil {
+			return err
+		}
+		return models.RecordCaseRevision(tx, pre.CaseID, models.PrescriptionRestored, c.Get("id").(uint), reason)
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	c.Logger().Debug("RestorePrescription")
+	return c.JSON(200, api.Return("ok", nil))
+}
+
+// @Summary Purge a deleted case
+// @Description for good, with its prescriptions, once RETENTION_DAY days have passed since the deletion. Its revisions are kept
+// @Tags Admin
+// @Produce json
+// @Param caseID path uint true "case ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {string} api.ReturnedData{data=echo.Map{"purgeable_at": time.Time}}
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /admin/cases/{caseID}/purge [DELETE]
+func (h *CaseHandler) PurgeCase(c echo.Context) error {
+	db := utils.GetDB()
+	var cas models.Case
+	if err := db.Unscoped().Where("deleted_at IS NOT NULL").First(&cas, c.Param("caseID")).Error; err != nil {
+		return api.Fail(c, api.CaseNotFound, nil)
+	}
+	if ok, at := purgeable(cas.DeletedAt); !ok {
+		return api.Fail(c, api.RetentionNotElapsed, echo.Map{"purgeable_at": at})
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		prescriptions := tx.Unscoped().Model(&models.Prescription{}).Select("id").Where("case_id = ?", cas.ID)
+		if err := tx.Where("prescription_id IN (?)", prescriptions).Delete(&models.Guideline{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("case_id = ?", cas.ID).Delete(&models.Prescription{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&cas).Error
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	c.Logger().Debug("PurgeCase")
+	return c.JSON(200, api.Return("ok", nil))
+}
+
+// @Summary Purge a deleted prescription
+// @Description for good, once RETENTION_DAY days have passed since the deletion
+// @Tags Admin
+// @Produce json
+// @Param prescriptionID path uint true "prescription ID"
+// @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {string} api.ReturnedData{data=echo.Map{"purgeable_at": time.Time}}
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /admin/prescriptions/{prescriptionID}/purge [DELETE]
+func (h *CaseHandler) PurgePrescription(c echo.Context) error {
+	db := utils.GetDB()
+	var pre models.Prescription
+	if err := db.Unscoped().Where("deleted_at IS NOT NULL").First(&pre, c.Param("prescriptionID")).Error; err != nil {
+		return api.Fail(c, api.PrescriptionNotFound, nil)
+	}
+	if ok, at := purgeable(pre.DeletedAt); !ok {
+		return api.Fail(c, api.RetentionNotElapsed, echo.Map{"purgeable_at": at})
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("prescription_id = ?", pre.ID).Delete(&models.Guideline{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&pre).Error
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+	c.Logger().Debug("PurgePrescription")
+	return c.JSON(200, api.Return("ok", nil))
+}
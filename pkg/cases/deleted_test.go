@@ -0,0 +1,33 @@
+package cases
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestPurgeable(t *testing.T) {
+	os.Setenv("RETENTION_DAY", "30")
+	defer os.Unsetenv("RETENTION_DAY")
+
+	deleted := func(ago time.Duration) gorm.DeletedAt {
+		return gorm.DeletedAt{Time: time.Now().Add(-ago), Valid: true}
+	}
+	ok, at := purgeable(deleted(29 * 24 * time.Hour))
+	assert.False(t, ok)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), at, time.Minute)
+
+	ok, _ = purgeable(deleted(31 * 24 * time.Hour))
+	assert.True(t, ok)
+
+	// Records which are not deleted are never purged
+	ok, _ = purgeable(gorm.DeletedAt{})
+	assert.False(t, ok)
+
+	os.Setenv("RETENTION_DAY", "")
+	ok, _ = purgeable(deleted(31 * 24 * time.Hour))
+	assert.False(t, ok, "15 years by default")
+}
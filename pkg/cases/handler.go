@@ -30,10 +30,6 @@ type MedicineHandler struct {
 // @Router /cases [GET]
 func (h *CaseHandler) GetAllCases(c echo.Context) error {
 
-	if !FromDoctor(c) {
-		return c.JSON(403, api.Return("only doctor can access this endpoint", nil))
-	}
-
 	db := utils.GetDB()
 
 	if c.QueryParam(("patientID")) != "" {
@@ -74,7 +70,7 @@ func (h *CaseHandler) GetCaseByCaseID(c echo.Context) error {
 	db.Preload("Prescriptions").Preload("Prescriptions.Guidelines").Preload("Prescriptions.Guidelines.Medicine").First(&case1, c.Param("caseID"))
 
 	if !FromPatient(c, case1.PatientID) {
-		return c.JSON(403, api.Return("you cannot access this case", nil))
+		return api.Fail(c, api.PermissionDenied, nil)
 	}
 
 	c.Logger().Debug("GetCasebyCaseID")
@@ -93,7 +89,7 @@ func (h *CaseHandler) GetLastCaseByPatientID(c echo.Context) error {
 	var patID int
 	patID, _ = strconv.Atoi(c.Param("patientID"))
 	if !FromPatient(c, uint(patID)) {
-		return c.JSON(403, api.Return("you cannot access this case", nil))
+		return api.Fail(c, api.PermissionDenied, nil)
 	}
 
 	db := utils.GetDB()
@@ -122,7 +118,7 @@ func (h *CaseHandler) GetCasesByPatientID(c echo.Context) error {
 	var patID int
 	patID, _ = strconv.Atoi(c.Param("patientID"))
 	if !FromPatient(c, uint(patID)) {
-		return c.JSON(403, api.Return("you cannot access this case", nil))
+		return api.Fail(c, api.PermissionDenied, nil)
 	}
 
 	db := utils.GetDB()
@@ -152,44 +148,79 @@ func (h *CaseHandler) GetCasesByPatientID(c echo.Context) error {
 // @Tags Case
 // @Produce json
 // @Param caseDetail body models.Case true "patient ID, doctor ID, department name and other case details"
+// @Param reason query string false "reason recorded in the first revision"
+// @Param justification query string false "justification of prescribing through the safety warnings"
 // @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{data=[]SafetyIssue}
 // @Router /patient/{patientID}/case [POST]
 func (h *CaseHandler) NewCase(c echo.Context) error {
 
-	if !FromDoctor(c) {
-		return c.JSON(403, api.Return("only doctor can access this endpoint", nil))
-	}
-
 	db := utils.GetDB()
 	var cas models.Case
 	err := utils.ExtractDataWithValidating(c, &cas)
 	if err != nil {
-		return c.JSON(400, api.Return("error", err.Error()))
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+	// Prescriptions sent along with the case go through the same safety check
+	justification := c.QueryParam("justification")
+	overridden, issues, code := checkCasePrescriptions(db, &cas, justification)
+	if code != "" {
+		return api.Fail(c, code, issues)
 	}
 	cas.Date = time.Now()
-	result := db.Create(&cas)
-	if result.Error != nil {
-		return c.JSON(400, api.Return("error", result.Error.Error()))
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&cas).Error; err != nil {
+			return err
+		}
+		for i := range cas.Prescriptions {
+			if err := recordOverrides(tx, &cas.Prescriptions[i], overridden[i], justification, c.Get("id").(uint)); err != nil {
+				return err
+			}
+		}
+		return models.RecordCaseRevision(tx, cas.ID, models.CaseCreated, c.Get("id").(uint), c.QueryParam("reason"))
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
 	}
 	c.Logger().Debug("NewCase")
 	return c.JSON(200, api.Return("ok", cas.ID))
 }
 
 // @Summary Delete a case
-// @Description
+// @Description only its doctor or an admin may. The case is hidden, admins can restore it; its revisions are kept, the last one records the deletion
 // @Tags Case
 // @Produce json
 // @Param caseID path uint true "case ID"
+// @Param reason query string true "reason of the deletion"
 // @Success 200 {object} api.ReturnedData{}
 // @Router /patient/{patientID}/case/{caseID} [DELETE]
 func (h *CaseHandler) DeleteCaseByCaseID(c echo.Context) error {
-
-	if !FromDoctor(c) {
-		return c.JSON(403, api.Return("only doctor can access this endpoint", nil))
+	reason, code := amendmentReason(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
 	}
 
 	db := utils.GetDB()
-	db.Session(&gorm.Session{FullSaveAssociations: true}).Omit("Prescriptions.Guidelines.Medicine").Delete(&models.Case{}, c.Param("caseID"))
+	var cas models.Case
+	if err := db.First(&cas, c.Param("caseID")).Error; err != nil {
+		return api.Fail(c, api.CaseNotFound, nil)
+	}
+	if !FromCaseDoctor(c, cas.DoctorID) {
+		return api.Fail(c, api.PermissionDenied, nil)
+	}
+	by := c.Get("id").(uint)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := models.RecordCaseRevision(tx, cas.ID, models.CaseDeleted, by, reason); err != nil {
+			return err
+		}
+		if err := tx.Model(&cas).Updates(models.Case{DeletedBy: &by, DeleteReason: reason}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&cas).Error
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
 	c.Logger().Debug("DeleteCaseByCaseID")
 	return c.JSON(200, api.Return("ok", nil))
 }
@@ -207,7 +238,7 @@ func (h *CaseHandler) GetPreviousCases(c echo.Context) error {
 	var cases []models.Case
 	db.First(&case1, c.Param("caseID"))
 	if !FromPatient(c, case1.PatientID) {
-		return c.JSON(403, api.Return("you cannot access this case", nil))
+		return api.Fail(c, api.PermissionDenied, nil)
 	}
 	for case1.PreviousCaseID != nil {
 		case1.ID = *case1.PreviousCaseID
@@ -223,30 +254,51 @@ func (h *CaseHandler) GetPreviousCases(c echo.Context) error {
 // @Tags Case
 // @Produce json
 // @Param caseDetail body models.Case true "case ID and updated details"
+// @Param reason query string true "reason of the amendment"
+// @Param justification query string false "justification of prescribing through the safety warnings"
 // @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{data=[]SafetyIssue}
 // @Router /patient/{patientID}/case/{caseID} [PUT]
 func (h *CaseHandler) UpdateCase(c echo.Context) error {
-	if !FromDoctor(c) {
-		return c.JSON(403, api.Return("only doctor can access this endpoint", nil))
+	reason, code := amendmentReason(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
 	}
-
 	db := utils.GetDB()
 	var cas models.Case
 	err := utils.ExtractDataWithValidating(c, &cas)
 	if err != nil {
-		return c.JSON(400, api.Return("error", err.Error()))
+		return api.Fail(c, api.InvalidRequest, err.Error())
 	}
 
 	var case1 models.Case
 	db.Preload("Registration").Where("id = ?", cas.ID).First(&case1)
 
 	if case1.Registration.Status != models.Accepted {
-		return c.JSON(400, api.Return("cannot update finished case", nil))
-	}
-
-	result := db.Session(&gorm.Session{FullSaveAssociations: true}).Omit("Prescriptions.Guidelines.Medicine").Model(&cas).Updates(cas)
-	if result.Error != nil {
-		return c.JSON(400, api.Return("error", result.Error.Error()))
+		return api.Fail(c, api.CaseFinished, nil)
+	}
+	// Prescriptions sent along with the case go through the same safety check, against its stored patient
+	justification := c.QueryParam("justification")
+	checked := cas
+	checked.PatientID = case1.PatientID
+	overridden, issues, code := checkCasePrescriptions(db, &checked, justification)
+	if code != "" {
+		return api.Fail(c, code, issues)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Session(&gorm.Session{FullSaveAssociations: true}).Omit("Prescriptions.Guidelines.Medicine").Model(&cas).Updates(cas).Error; err != nil {
+			return err
+		}
+		for i := range cas.Prescriptions {
+			if err := recordOverrides(tx, &cas.Prescriptions[i], overridden[i], justification, c.Get("id").(uint)); err != nil {
+				return err
+			}
+		}
+		return models.RecordCaseRevision(tx, cas.ID, models.CaseUpdated, c.Get("id").(uint), reason)
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
 	}
 	c.Logger().Debug("UpdateCase")
 	return c.JSON(200, api.Return("ok", nil))
@@ -257,43 +309,82 @@ func (h *CaseHandler) UpdateCase(c echo.Context) error {
 // @Tags Case
 // @Produce json
 // @Param prescriptionDetail body models.Prescription true "case ID and prescription details"
+// @Param reason query string false "reason recorded in the revision"
+// @Param justification query string false "justification of prescribing through the safety warnings"
 // @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{data=[]SafetyIssue}
 // @Router /patient/{patientID}/case/{caseID}/prescription [POST]
 func (h *CaseHandler) NewPrescription(c echo.Context) error {
 	db := utils.GetDB()
 	var pre models.Prescription
 	err := utils.ExtractDataWithValidating(c, &pre)
 	if err != nil {
-		return c.JSON(400, api.Return("error", err.Error()))
+		return api.Fail(c, api.InvalidRequest, err.Error())
 	}
-	var oldCase models.Case
-	db.First(&oldCase, pre.CaseID)
-	if !FromDoctor(c) {
-		return c.JSON(403, api.Return("only doctor can access this endpoint", nil))
-	}
-	result := db.Create(&pre)
-	if result.Error != nil {
-		return c.JSON(400, api.Return("error", result.Error.Error()))
+	var cas models.Case
+	if err := db.First(&cas, pre.CaseID).Error; err != nil {
+		return api.Fail(c, api.CaseNotFound, nil)
+	}
+	justification := c.QueryParam("justification")
+	issues, code := checkPrescription(db, &cas, &pre, justification)
+	if code != "" {
+		return api.Fail(c, code, issues)
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&pre).Error; err != nil {
+			return err
+		}
+		if err := recordOverrides(tx, &pre, issues, justification, c.Get("id").(uint)); err != nil {
+			return err
+		}
+		return models.RecordCaseRevision(tx, pre.CaseID, models.PrescriptionCreated, c.Get("id").(uint), c.QueryParam("reason"))
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
 	}
 	c.Logger().Debug("NewPrescription")
 	return c.JSON(200, api.Return("ok", pre.ID))
 }
 
 // @Summary Delete a prescrition
-// @Description
+// @Description only the doctor of the case or an admin may. The prescription is hidden, admins can restore it
 // @Tags Case
 // @Produce json
 // @Param prescriptionID path uint true "prescription ID"
+// @Param reason query string true "reason of the deletion"
 // @Success 200 {object} api.ReturnedData{}
 // @Router /patient/{patientID}/case/{caseID}/prescription/{prescriptionID} [DELETE]
 func (h *CaseHandler) DeletePrescription(c echo.Context) error {
-
-	if !FromDoctor(c) {
-		return c.JSON(403, api.Return("only doctor can access this endpoint", nil))
+	reason, code := amendmentReason(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
 	}
 
 	db := utils.GetDB()
-	db.Session(&gorm.Session{FullSaveAssociations: true}).Omit("Guidelines.Medicine").Delete(&models.Prescription{}, c.Param("prescriptionID"))
+	var pre models.Prescription
+	if err := db.First(&pre, c.Param("prescriptionID")).Error; err != nil {
+		return api.Fail(c, api.PrescriptionNotFound, nil)
+	}
+	var cas models.Case
+	if err := db.First(&cas, pre.CaseID).Error; err != nil {
+		return api.Fail(c, api.CaseNotFound, nil)
+	}
+	if !FromCaseDoctor(c, cas.DoctorID) {
+		return api.Fail(c, api.PermissionDenied, nil)
+	}
+	by := c.Get("id").(uint)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&pre).Updates(models.Prescription{DeletedBy: &by, DeleteReason: reason}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&pre).Error; err != nil {
+			return err
+		}
+		return models.RecordCaseRevision(tx, pre.CaseID, models.PrescriptionDeleted, by, reason)
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
 	c.Logger().Debug("DeletePrescription")
 	return c.JSON(200, api.Return("ok", nil))
 }
@@ -303,37 +394,53 @@ func (h *CaseHandler) DeletePrescription(c echo.Context) error {
 // @Tags Case
 // @Produce json
 // @Param prescriptionDetails body models.Prescription true "prescription ID and updated details"
+// @Param reason query string true "reason of the amendment"
+// @Param justification query string false "justification of prescribing through the safety warnings"
 // @Success 200 {object} api.ReturnedData{}
+// @Failure 400 {object} api.ReturnedData{data=[]SafetyIssue}
 // @Router /patient/{patientID}/case/{caseID}/prescription/{prescriptionID} [PUT]
 func (h *CaseHandler) UpdatePrescription(c echo.Context) error {
-	if !FromDoctor(c) {
-		return c.JSON(403, api.Return("only doctor can access this endpoint", nil))
+	reason, code := amendmentReason(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
 	}
-
 	db := utils.GetDB()
 	var pre models.Prescription
 	err := utils.ExtractDataWithValidating(c, &pre)
 	if err != nil {
-		return c.JSON(400, api.Return("validation fails", err.Error()))
+		return api.Fail(c, api.InvalidRequest, err.Error())
 	}
 
 	var origPrescription models.Prescription
 	db.Where("id = ?", pre.ID).First(&origPrescription)
 
 	if origPrescription.CaseID != pre.CaseID {
-		return c.JSON(400, api.Return("cannot update caseID of prescription", nil))
+		return api.Fail(c, api.PrescriptionCaseChanged, nil)
 	}
 
 	var case1 models.Case
 	db.Preload("Registration").Where("id = ?", pre.CaseID).First(&case1)
 
 	if case1.Registration.Status != models.Accepted {
-		return c.JSON(400, api.Return("cannot update prescription of finished case", nil))
-	}
-
-	result := db.Session(&gorm.Session{FullSaveAssociations: true}).Omit("Guidelines.Medicine").Model(&pre).Updates(pre)
-	if result.Error != nil {
-		return c.JSON(400, api.Return("error while quering db", result.Error.Error()))
+		return api.Fail(c, api.CaseFinished, nil)
+	}
+	justification := c.QueryParam("justification")
+	issues, code := checkPrescription(db, &case1, &pre, justification)
+	if code != "" {
+		return api.Fail(c, code, issues)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Session(&gorm.Session{FullSaveAssociations: true}).Omit("Guidelines.Medicine").Model(&pre).Updates(pre).Error; err != nil {
+			return err
+		}
+		if err := recordOverrides(tx, &pre, issues, justification, c.Get("id").(uint)); err != nil {
+			return err
+		}
+		return models.RecordCaseRevision(tx, pre.CaseID, models.PrescriptionUpdated, c.Get("id").(uint), reason)
+	})
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
 	}
 	c.Logger().Debug("UpdatePrescription")
 	return c.JSON(200, api.Return("ok", nil))
@@ -353,7 +460,7 @@ func (h *CaseHandler) GetPrescriptionByPrescriptionID(c echo.Context) error {
 	var oldCase models.Case
 	db.First(&oldCase, pre.CaseID)
 	if !FromPatient(c, oldCase.PatientID) {
-		return c.JSON(403, api.Return("you cannot access this prescription", nil))
+		return api.Fail(c, api.PermissionDenied, nil)
 	}
 	// var jsonStu []byte
 	// jsonStu, _ = json.Marshal(pre)
@@ -376,7 +483,7 @@ func (h *CaseHandler) GetPrescriptionByCaseID(c echo.Context) error {
 	var oldCase models.Case
 	db.First(&oldCase, c.Param("caseID"))
 	if !FromPatient(c, oldCase.PatientID) {
-		return c.JSON(403, api.Return("you cannot access this prescription", nil))
+		return api.Fail(c, api.PermissionDenied, nil)
 	}
 	db.Where("case_id = ?", c.Param("caseID")).Preload("Guidelines").Preload("Guidelines.Medicine").Find(&pres)
 	c.Logger().Debug("GetPrescriptionByCaseID")
@@ -0,0 +1,178 @@
+package cases
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+)
+
+// FieldChange is a field which differs between two revisions of a case.
+// From is nil for an added prescription, To for a removed one.
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+/**
+ * @brief read the reason query param, which amendments of a case must give.
+ */
+func amendmentReason(c echo.Context) (string, api.Code) {
+	reason := c.QueryParam("reason")
+	if reason == "" {
+		return "", api.ReasonRequired
+	}
+	return reason, ""
+}
+
+/**
+ * @brief load the revisions of the case named by the caseID path param, oldest first.
+ * They are kept after the case is deleted, so the access is checked against the latest one.
+ */
+func revisionsFromParam(c echo.Context) ([]models.CaseRevision, api.Code) {
+	var revisions []models.CaseRevision
+	utils.GetDB().Where("case_id = ?", c.Param("caseID")).Order("number").Find(&revisions)
+	if len(revisions) == 0 {
+		return nil, api.RevisionNotFound
+	}
+	if !FromPatient(c, revisions[len(revisions)-1].PatientID) {
+		return nil, api.PermissionDenied
+	}
+	return revisions, ""
+}
+
+func findRevision(revisions []models.CaseRevision, number string) *models.CaseRevision {
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		return nil
+	}
+	for i := range revisions {
+		if revisions[i].Number == uint(n) {
+			return &revisions[i]
+		}
+	}
+	return nil
+}
+
+// @Summary List the revisions of a case
+// @Description every change of the case or its prescriptions, oldest first, kept after the case is deleted
+// @Tags Case
+// @Produce json
+// @Param patientID path uint true "patient ID"
+// @Param caseID path uint true "case ID"
+// @Success 200 {object} api.ReturnedData{data=[]models.CaseRevision}
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /patient/{patientID}/case/{caseID}/revisions [GET]
+func (h *CaseHandler) GetCaseRevisions(c echo.Context) error {
+	revisions, code := revisionsFromParam(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	c.Logger().Debug("GetCaseRevisions")
+	return c.JSON(200, api.Return("ok", revisions))
+}
+
+// @Summary Get a revision of a case
+// @Description
+// @Tags Case
+// @Produce json
+// @Param patientID path uint true "patient ID"
+// @Param caseID path uint true "case ID"
+// @Param number path uint true "revision number, from 1"
+// @Success 200 {object} api.ReturnedData{data=models.CaseRevision}
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /patient/{patientID}/case/{caseID}/revisions/{number} [GET]
+func (h *CaseHandler) GetCaseRevision(c echo.Context) error {
+	revisions, code := revisionsFromParam(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	revision := findRevision(revisions, c.Param("number"))
+	if revision == nil {
+		return api.Fail(c, api.RevisionNotFound, nil)
+	}
+	c.Logger().Debug("GetCaseRevision")
+	return c.JSON(200, api.Return("ok", revision))
+}
+
+// @Summary Diff two revisions of a case
+// @Description the fields which differ, prescriptions compared by ID
+// @Tags Case
+// @Produce json
+// @Param patientID path uint true "patient ID"
+// @Param caseID path uint true "case ID"
+// @Param from query uint true "older revision number"
+// @Param to query uint false "newer revision number, the latest if omitted"
+// @Success 200 {object} api.ReturnedData{data=[]FieldChange}
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /patient/{patientID}/case/{caseID}/revisions/diff [GET]
+func (h *CaseHandler) DiffCaseRevisions(c echo.Context) error {
+	revisions, code := revisionsFromParam(c)
+	if code != "" {
+		return api.Fail(c, code, nil)
+	}
+	from := findRevision(revisions, c.QueryParam("from"))
+	to := &revisions[len(revisions)-1]
+	if c.QueryParam("to") != "" {
+		to = findRevision(revisions, c.QueryParam("to"))
+	}
+	if from == nil || to == nil {
+		return api.Fail(c, api.RevisionNotFound, nil)
+	}
+	c.Logger().Debug("DiffCaseRevisions")
+	return c.JSON(200, api.Return("ok", diffRevisions(from, to)))
+}
+
+/**
+ * @brief compare two revisions field by field. Prescriptions are matched by ID,
+ * an added or removed one is a single change of the whole prescription.
+ */
+func diffRevisions(from *models.CaseRevision, to *models.CaseRevision) []FieldChange {
+	changes := []FieldChange{}
+	for _, field := range []struct {
+		name     string
+		from, to string
+	}{
+		{"department", from.Department, to.Department},
+		{"complaint", from.Complaint, to.Complaint},
+		{"diagnosis", from.Diagnosis, to.Diagnosis},
+		{"treatment", from.Treatment, to.Treatment},
+		{"history", from.History, to.History},
+	} {
+		if field.from != field.to {
+			changes = append(changes, FieldChange{Field: field.name, From: field.from, To: field.to})
+		}
+	}
+
+	before := map[uint]models.PrescriptionSnapshot{}
+	for _, p := range from.Prescriptions {
+		before[p.ID] = p
+	}
+	after := map[uint]bool{}
+	for _, p := range to.Prescriptions {
+		after[p.ID] = true
+		name := fmt.Sprintf("prescriptions[%d]", p.ID)
+		old, ok := before[p.ID]
+		if !ok {
+			changes = append(changes, FieldChange{Field: name, From: nil, To: p})
+			continue
+		}
+		if old.Advice != p.Advice {
+			changes = append(changes, FieldChange{Field: name + ".advice", From: old.Advice, To: p.Advice})
+		}
+		if !reflect.DeepEqual(old.Guidelines, p.Guidelines) {
+			changes = append(changes, FieldChange{Field: name + ".guidelines", From: old.Guidelines, To: p.Guidelines})
+		}
+	}
+	for _, p := range from.Prescriptions {
+		if !after[p.ID] {
+			changes = append(changes, FieldChange{Field: fmt.Sprintf("prescriptions[%d]", p.ID), From: p, To: nil})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,50 @@
+package cases
+
+import (
+	"testing"
+
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffRevisions(t *testing.T) {
+	cas := models.Case{
+		ID:        7,
+		PatientID: 3,
+		Complaint: "headache",
+		Diagnosis: "migraine",
+		Prescriptions: []models.Prescription{
+			{ID: 1, Advice: "rest", Guidelines: []models.Guideline{
+				{MedicineID: 2, Medicine: models.Medicine{Name: "ibuprofen"}, Dosage: "200mg", Quantity: 10},
+			}},
+			{ID: 2, Advice: "drink water"},
+		},
+	}
+	first := cas.Snapshot(1, models.CaseCreated, 5, "")
+
+	cas.Diagnosis = "tension headache"
+	cas.Prescriptions[0].Guidelines[0].Quantity = 20
+	cas.Prescriptions = append(cas.Prescriptions[:1], models.Prescription{ID: 3, Advice: "sleep"})
+	second := cas.Snapshot(2, models.CaseUpdated, 5, "wrong diagnosis")
+
+	// Revisions go through the database as JSON
+	value, err := second.Prescriptions.Value()
+	require.NoError(t, err)
+	var stored models.PrescriptionSnapshots
+	require.NoError(t, stored.Scan(value))
+	second.Prescriptions = stored
+
+	changes := diffRevisions(&first, &second)
+	fields := []string{}
+	for _, change := range changes {
+		fields = append(fields, change.Field)
+	}
+	assert.Equal(t, []string{"diagnosis", "prescriptions[1].guidelines", "prescriptions[3]", "prescriptions[2]"}, fields)
+	assert.Equal(t, "migraine", changes[0].From)
+	assert.Nil(t, changes[2].From)
+	assert.Nil(t, changes[3].To)
+	assert.Equal(t, "ibuprofen", second.Prescriptions[0].Guidelines[0].Medicine)
+
+	assert.Empty(t, diffRevisions(&second, &second))
+}
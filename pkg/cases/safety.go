@@ -0,0 +1,241 @@
+package cases
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Kinds of SafetyIssue
+const (
+	IssueAllergy          = "allergy"          // the patient is allergic to the medicine itself
+	IssueIngredient       = "ingredient"       // the medicine names an ingredient the patient is allergic to
+	IssueContraindication = "contraindication" // the contraindication of the medicine matches an allergy or the case
+)
+
+// SafetyIssue is a finding of the prescription safety check on a prescribed medicine.
+// Blocking issues stop the prescription, the others may be overridden with a justification.
+type SafetyIssue struct {
+	MedicineID uint                   `json:"medicine_id"`
+	Medicine   string                 `json:"medicine"`
+	Kind       string                 `json:"kind"`
+	AllergyID  *uint                  `json:"allergy_id,omitempty"`
+	Severity   models.AllergySeverity `json:"severity,omitempty"`
+	Blocking   bool                   `json:"blocking"`
+	Detail     string                 `json:"detail"`
+}
+
+// Words of a contraindication which only say that it is one
+var contraindicationMarkers = strings.NewReplacer(
+	"禁用", "", "慎用", "", "忌用", "", "患者", "", "者", "", "过敏", "",
+	"contraindicated in", "", "contraindicated", "", "patients with", "", "allergy to", "", "allergic to", "",
+)
+
+/**
+ * @brief the conditions a contraindication text names, one per clause, "孕妇禁用；对青霉素过敏者禁用" names 孕妇 and 青霉素.
+ */
+func contraindicationTerms(text string) []string {
+	clauses := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return strings.ContainsRune(",，;；.。、\n", r)
+	})
+	terms := []string{}
+	for _, clause := range clauses {
+		term := strings.TrimSpace(contraindicationMarkers.Replace(clause))
+		term = strings.TrimPrefix(term, "对")
+		if len([]rune(term)) >= 2 {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+func mentions(text string, word string) bool {
+	word = strings.TrimSpace(word)
+	return word != "" && strings.Contains(strings.ToLower(text), strings.ToLower(word))
+}
+
+/**
+ * @brief check the medicines against the allergies of the patient and the case they are prescribed in.
+ * An allergy matches a medicine when it is to the medicine itself, when its ingredient is in the name or
+ * the contraindication of the medicine, or when a condition of the contraindication is in its ingredient,
+ * allergen or note. A severe allergy blocks the medicine, anything else is a warning, the case matching
+ * a condition of the contraindication by its diagnosis or history too. Each allergy is reported once per medicine.
+ */
+func safetyIssues(cas *models.Case, allergies []models.Allergy, medicines []models.Medicine) []SafetyIssue {
+	issues := []SafetyIssue{}
+	for _, m := range medicines {
+		terms := contraindicationTerms(m.Contraindication)
+		for i := range allergies {
+			a := &allergies[i]
+			issue := SafetyIssue{MedicineID: m.ID, Medicine: m.Name, AllergyID: &a.ID, Severity: a.Severity, Blocking: a.Severity == models.SeveritySevere}
+			allergen := a.Ingredient
+			if a.Medicine != nil {
+				allergen = a.Medicine.Name
+			}
+			switch {
+			case a.MedicineID != nil && *a.MedicineID == m.ID:
+				issue.Kind, issue.Detail = IssueAllergy, fmt.Sprintf("allergic to %s", m.Name)
+			case mentions(m.Name, a.Ingredient) || mentions(m.Contraindication, a.Ingredient):
+				issue.Kind, issue.Detail = IssueIngredient, fmt.Sprintf("allergic to %s", a.Ingredient)
+			case a.Unstructured && mentions(a.Note, m.Name):
+				issue.Kind, issue.Detail = IssueAllergy, fmt.Sprintf("allergy noted: %s", a.Note)
+			default:
+				for _, term := range terms {
+					if mentions(allergen, term) || mentions(a.Note, term) {
+						issue.Kind, issue.Detail = IssueContraindication, fmt.Sprintf("contraindicated: %s", term)
+						break
+					}
+				}
+			}
+			if issue.Kind == "" {
+				continue
+			}
+			if a.Reaction != "" {
+				issue.Detail += ", reaction: " + a.Reaction
+			}
+			issues = append(issues, issue)
+		}
+		for _, term := range terms {
+			if mentions(cas.Diagnosis, term) || mentions(cas.History, term) {
+				issues = append(issues, SafetyIssue{
+					MedicineID: m.ID,
+					Medicine:   m.Name,
+					Kind:       IssueContraindication,
+					Detail:     fmt.Sprintf("contraindicated: %s", term),
+				})
+			}
+		}
+	}
+	return issues
+}
+
+/**
+ * @brief run the safety check on a prescription of the case cas, before it is saved.
+ * It fails with PrescriptionBlocked if an issue is blocking, and with PrescriptionWarnings
+ * if there are warnings and no justification; the issues are the data in both cases.
+ * Otherwise it returns the warnings the justification overrides.
+ */
+func checkPrescription(db *gorm.DB, cas *models.Case, pre *models.Prescription, justification string) ([]SafetyIssue, api.Code) {
+	medicines := []models.Medicine{}
+	for _, g := range pre.Guidelines {
+		var m models.Medicine
+		if err := db.First(&m, g.MedicineID).Error; err != nil {
+			return nil, api.MedicineNotFound
+		}
+		medicines = append(medicines, m)
+	}
+	var allergies []models.Allergy
+	patients := db.Model(&models.Patient{}).Select("id").Where("account_id = ?", cas.PatientID)
+	db.Preload("Medicine").Where("patient_id IN (?)", patients).Find(&allergies)
+
+	issues := safetyIssues(cas, allergies, medicines)
+	for _, issue := range issues {
+		if issue.Blocking {
+			return issues, api.PrescriptionBlocked
+		}
+	}
+	if len(issues) > 0 && justification == "" {
+		return issues, api.PrescriptionWarnings
+	}
+	return issues, ""
+}
+
+/**
+ * @brief run checkPrescription on every prescription sent along with the case cas.
+ * It returns the warnings overridden in each of them, or the issues of the first one failing.
+ */
+func checkCasePrescriptions(db *gorm.DB, cas *models.Case, justification string) ([][]SafetyIssue, []SafetyIssue, api.Code) {
+	overridden := make([][]SafetyIssue, len(cas.Prescriptions))
+	for i := range cas.Prescriptions {
+		issues, code := checkPrescription(db, cas, &cas.Prescriptions[i], justification)
+		if code != "" {
+			return nil, issues, code
+		}
+		overridden[i] = issues
+	}
+	return overridden, nil, ""
+}
+
+/**
+ * @brief record in tx the warnings a doctor prescribed pre through.
+ */
+func recordOverrides(tx *gorm.DB, pre *models.Prescription, issues []SafetyIssue, justification string, by uint) error {
+	for _, issue := range issues {
+		override := models.SafetyOverride{
+			PrescriptionID: pre.ID,
+			CaseID:         pre.CaseID,
+			MedicineID:     issue.MedicineID,
+			AllergyID:      issue.AllergyID,
+			Kind:           issue.Kind,
+			Detail:         issue.Detail,
+			Justification:  justification,
+			OverriddenBy:   by,
+		}
+		if err := tx.Create(&override).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// @Summary Check a prescription
+// @Description run the safety check of a new or updated prescription without saving it. Blocking issues come from severe allergies, the others are warnings which need a justification
+// @Tags Case
+// @Produce json
+// @Param patientID path uint true "patient ID"
+// @Param caseID path uint true "case ID"
+// @Param prescriptionDetail body models.Prescription true "case ID and prescription details"
+// @Success 200 {object} api.ReturnedData{data=[]SafetyIssue}
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /patient/{patientID}/case/{caseID}/prescription/check [POST]
+func (h *CaseHandler) CheckPrescription(c echo.Context) error {
+	var pre models.Prescription
+	if err := utils.ExtractDataWithValidating(c, &pre); err != nil {
+		return api.Fail(c, api.InvalidRequest, err.Error())
+	}
+	db := utils.GetDB()
+	var cas models.Case
+	if err := db.First(&cas, pre.CaseID).Error; err != nil {
+		return api.Fail(c, api.CaseNotFound, nil)
+	}
+	issues, code := checkPrescription(db, &cas, &pre, "")
+	if code == api.MedicineNotFound {
+		return api.Fail(c, code, nil)
+	}
+	c.Logger().Debug("CheckPrescription")
+	return c.JSON(200, api.Return("ok", issues))
+}
+
+// @Summary Get the overridden warnings of a prescription
+// @Description the safety warnings its doctor prescribed through, with their justification
+// @Tags Case
+// @Produce json
+// @Param patientID path uint true "patient ID"
+// @Param caseID path uint true "case ID"
+// @Param prescriptionID path uint true "prescription ID"
+// @Success 200 {object} api.ReturnedData{data=[]models.SafetyOverride}
+// @Failure 404 {object} api.ReturnedData{}
+// @Router /patient/{patientID}/case/{caseID}/prescription/{prescriptionID}/overrides [GET]
+func (h *CaseHandler) GetSafetyOverrides(c echo.Context) error {
+	db := utils.GetDB()
+	var pre models.Prescription
+	if err := db.Unscoped().First(&pre, c.Param("prescriptionID")).Error; err != nil {
+		return api.Fail(c, api.PrescriptionNotFound, nil)
+	}
+	var cas models.Case
+	if err := db.Unscoped().First(&cas, pre.CaseID).Error; err != nil {
+		return api.Fail(c, api.CaseNotFound, nil)
+	}
+	if !FromPatient(c, cas.PatientID) {
+		return api.Fail(c, api.PermissionDenied, nil)
+	}
+	var overrides []models.SafetyOverride
+	db.Where("prescription_id = ?", pre.ID).Order("id").Find(&overrides)
+	c.Logger().Debug("GetSafetyOverrides")
+	return c.JSON(200, api.Return("ok", overrides))
+}
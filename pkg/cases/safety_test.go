@@ -0,0 +1,44 @@
+package cases
+
+import (
+	"testing"
+
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContraindicationTerms(t *testing.T) {
+	assert.Equal(t, []string{"孕妇", "青霉素", "severe liver failure"},
+		contraindicationTerms("孕妇禁用；对青霉素过敏者禁用. Contraindicated in severe liver failure"))
+	assert.Empty(t, contraindicationTerms("无"))
+}
+
+func TestSafetyIssues(t *testing.T) {
+	amoxicillin := uint(1)
+	medicines := []models.Medicine{
+		{ID: 1, Name: "阿莫西林胶囊", Contraindication: "对青霉素过敏者禁用"},
+		{ID: 2, Name: "Ibuprofen", Contraindication: "contraindicated in peptic ulcer"},
+		{ID: 3, Name: "维生素C", Contraindication: "无"},
+	}
+	allergies := []models.Allergy{
+		{ID: 10, MedicineID: &amoxicillin, Severity: models.SeveritySevere, Reaction: "皮疹"},
+		{ID: 11, Ingredient: "青霉素", Severity: models.SeverityMild},
+		{ID: 12, Note: "ibuprofen makes me dizzy", Unstructured: true, Severity: models.SeverityUnknown},
+	}
+	cas := models.Case{Diagnosis: "Peptic ulcer"}
+
+	issues := safetyIssues(&cas, allergies, medicines)
+	assert.Len(t, issues, 4)
+	assert.Equal(t, IssueAllergy, issues[0].Kind)
+	assert.True(t, issues[0].Blocking)
+	assert.Equal(t, "allergic to 阿莫西林胶囊, reaction: 皮疹", issues[0].Detail)
+	assert.Equal(t, IssueIngredient, issues[1].Kind)
+	assert.False(t, issues[1].Blocking)
+	assert.Equal(t, uint(11), *issues[1].AllergyID)
+	assert.Equal(t, IssueAllergy, issues[2].Kind)
+	assert.Equal(t, uint(2), issues[2].MedicineID)
+	assert.Equal(t, IssueContraindication, issues[3].Kind)
+	assert.Nil(t, issues[3].AllergyID)
+
+	assert.Empty(t, safetyIssues(&models.Case{}, nil, medicines[2:]))
+}
@@ -0,0 +1,180 @@
+package cases
+
+import (
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/account"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"github.com/labstack/echo/v4"
+)
+
+// CaseHit is a case found by a search, with the fragments of its fields which match, words marked by <mark>.
+type CaseHit struct {
+	Case       models.Case       `json:"case"`
+	Rank       float32           `json:"rank"`
+	Highlights map[string]string `json:"highlights"`
+}
+
+// @Summary Search cases
+// @Description full text of the complaint, diagnosis, treatment and history, best match first. Chinese is matched by character bigrams, the last word of each term by prefix. Patients only find their own cases and those of patients they act for
+// @Tags Case
+// @Produce json
+// @Param q query string true "space separated terms, all of them must match"
+// @Param department query string false "department name"
+// @Param doctorID query uint false "doctor ID"
+// @Param before query string false "a timestamp marking end time without timezone"
+// @Param after query string false "a timestamp marking start time without timezone"
+// @Param page query int false "page number, starting from 1"
+// @Param size query int false "page size, at most 100"
+// @Success 200 {string} api.ReturnedData{data=echo.Map{"total": int, "hits": []CaseHit}}
+// @Failure 400 {object} api.ReturnedData{}
+// @Router /cases/search [GET]
+func (h *CaseHandler) SearchCases(c echo.Context) error {
+	tsquery := utils.SearchQuery(c.QueryParam("q"))
+	if tsquery == "" {
+		return api.Fail(c, api.SearchQueryRequired, nil)
+	}
+
+	db := utils.GetDB()
+	query := db.Model(&models.Case{}).Where("search_vector @@ to_tsquery('simple', ?)", tsquery)
+	if !FromDoctor(c) {
+		id := c.Get("id").(uint)
+		delegated := db.Model(&models.Patient{}).Select("account_id").Where("id IN ?", account.PatientIDs(db, id))
+		query = query.Where("patient_id = ? OR patient_id IN (?)", id, delegated)
+	}
+	if c.QueryParam("doctorID") != "" {
+		query = query.Where("doctor_id = ?", c.QueryParam("doctorID"))
+	}
+	if c.QueryParam("department") != "" {
+		query = query.Where("department LIKE ?", "%"+c.QueryParam("department")+"%")
+	}
+	if c.QueryParam("before") != "" {
+		query = query.Where("date <= ?", c.QueryParam("before"))
+	}
+	if c.QueryParam("after") != "" {
+		query = query.Where("date >= ?", c.QueryParam("after"))
+	}
+
+	var total int64
+	query.Count(&total)
+	page, size := utils.Pagination(c)
+	var ranks []struct {
+		ID   uint
+		Rank float32
+	}
+	err := query.Select("id, ts_rank(search_vector, to_tsquery('simple', ?)) AS rank", tsquery).
+		Order("rank DESC, date DESC").Offset((page - 1) * size).Limit(size).Scan(&ranks).Error
+	if err != nil {
+		return api.Fail(c, api.DBError, err.Error())
+	}
+
+	ids := make([]uint, len(ranks))
+	for i, r := range ranks {
+		ids[i] = r.ID
+	}
+	var cases []models.Case
+	db.Preload("Prescriptions").Preload("Prescriptions.Guidelines").Preload("Prescriptions.Guidelines.Medicine").Find(&cases, ids)
+	byID := map[uint]models.Case{}
+	for _, cas := range cases {
+		byID[cas.ID] = cas
+	}
+
+	terms := strings.Fields(c.QueryParam("q"))
+	hits := []CaseHit{}
+	for _, r := range ranks {
+		cas := byID[r.ID]
+		hit := CaseHit{Case: cas, Rank: r.Rank, Highlights: map[string]string{}}
+		for field, text := range map[string]string{
+			"complaint": cas.Complaint,
+			"diagnosis": cas.Diagnosis,
+			"treatment": cas.Treatment,
+			"history":   cas.History,
+		} {
+			if fragment := highlight(text, terms); fragment != "" {
+				hit.Highlights[field] = fragment
+			}
+		}
+		hits = append(hits, hit)
+	}
+	c.Logger().Debug("SearchCases")
+	return c.JSON(200, api.Return("ok", echo.Map{"total": total, "hits": hits}))
+}
+
+// Runes of context kept before the first match of a fragment, and its length
+const (
+	fragmentLead = 20
+	fragmentSize = 120
+)
+
+/**
+ * @brief the fragment of text around its first match of the search terms, matches wrapped in <mark>,
+ * "" if nothing matches. Words are matched as SearchQuery does, from their start and up to their end.
+ * The text is HTML escaped, so that only the marks are markup.
+ */
+func highlight(text string, terms []string) string {
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	word := func(i int) bool {
+		return i >= 0 && i < len(lower) && (unicode.IsLetter(lower[i]) || unicode.IsDigit(lower[i])) && !utils.IsCJK(lower[i])
+	}
+
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, term := range terms {
+		for _, token := range utils.Segment(term) {
+			t := []rune(token)
+			latin := !utils.IsCJK(t[0])
+			for i := 0; i+len(t) <= len(lower); i++ {
+				if string(lower[i:i+len(t)]) != token || (latin && word(i-1)) {
+					continue
+				}
+				end := i + len(t)
+				for latin && word(end) {
+					end++
+				}
+				for j := i; j < end; j++ {
+					marked[j] = true
+				}
+				if first < 0 || i < first {
+					first = i
+				}
+			}
+		}
+	}
+	if first < 0 {
+		return ""
+	}
+
+	start := first - fragmentLead
+	if start < 0 {
+		start = 0
+	}
+	end := start + fragmentSize
+	if end > len(runes) {
+		end = len(runes)
+	}
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; i++ {
+		if marked[i] && (i == start || !marked[i-1]) {
+			b.WriteString("<mark>")
+		}
+		b.WriteString(html.EscapeString(string(runes[i])))
+		if marked[i] && (i == end-1 || !marked[i+1]) {
+			b.WriteString("</mark>")
+		}
+	}
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
@@ -0,0 +1,21 @@
+package cases
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHighlight(t *testing.T) {
+	assert.Equal(t, "Suspected <mark>pneumonia</mark>, <mark>肺炎</mark> &lt;left&gt;",
+		highlight("Suspected pneumonia, 肺炎 <left>", []string{"PNEUMON", "肺炎"}))
+	// words only match from their start
+	assert.Equal(t, "", highlight("bronchopneumonia", []string{"pneumonia"}))
+
+	long := strings.Repeat("咳嗽", 40) + "发热" + strings.Repeat("乏力", 80)
+	fragment := highlight(long, []string{"发热"})
+	assert.True(t, strings.HasPrefix(fragment, "…") && strings.HasSuffix(fragment, "…"))
+	assert.Contains(t, fragment, "<mark>发热</mark>")
+	assert.Equal(t, fragmentSize+2, len([]rune(strings.NewReplacer("<mark>", "", "</mark>", "").Replace(fragment))))
+}
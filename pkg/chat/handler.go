@@ -130,13 +130,13 @@ func (h *ChatHandler) NewPatientConn(c echo.Context) error {
 	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		c.Logger().Debug(err.Error())
-		return c.JSON(400, api.Return("Upgrade Fail", nil))
+		return api.Fail(c, api.UpgradeFailed, nil)
 	}
 
 	patientID, err := strconv.Atoi(c.Param("patientID"))
 	if err != nil {
 		c.Logger().Debug(err.Error())
-		return c.JSON(400, api.Return("Invalid ID", nil))
+		return api.Fail(c, api.InvalidID, nil)
 	}
 	newClient := &Client{
 		ID:        uint(patientID),
@@ -165,13 +165,13 @@ func (h *ChatHandler) NewDoctorConn(c echo.Context) error {
 	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		c.Logger().Debug(err.Error())
-		return c.JSON(400, api.Return("Upgrade Fail", nil))
+		return api.Fail(c, api.UpgradeFailed, nil)
 	}
 
 	doctorID, err := strconv.Atoi(c.Param("doctorID"))
 	if err != nil {
 		c.Logger().Debug(err.Error())
-		return c.JSON(400, api.Return("Invalid ID", nil))
+		return api.Fail(c, api.InvalidID, nil)
 	}
 	newClient := &Client{
 		ID:        uint(doctorID),
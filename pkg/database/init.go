@@ -1,6 +1,10 @@
 package database
 
 import (
+	"log"
+	"os"
+	"time"
+
 	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
 	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
 	"gorm.io/driver/postgres"
@@ -52,26 +56,71 @@ func InitDB() *gorm.DB {
 	if err != nil {
 		panic(err)
 	}
-	err = db.AutoMigrate(&models.Case{})
+	// cases from before full-text search get indexed once
+	indexedBefore := !db.Migrator().HasTable(&models.Case{}) || db.Migrator().HasColumn(&models.Case{}, "SearchVector")
+	err = db.AutoMigrate(&models.Case{}, &models.CaseRevision{}, &models.SafetyOverride{})
 	if err != nil {
 		panic(err)
 	}
+	if !indexedBefore {
+		indexCases(db)
+	}
 
 	utils.DB = db
 
 	// auto migrate account
+	// accounts created before email verification existed count as verified
+	verifiedBefore := !db.Migrator().HasTable(&models.Account{}) || db.Migrator().HasColumn(&models.Account{}, "EmailVerified")
+	// and their passwords count as set now, lest every staff password expire at once
+	datedBefore := !db.Migrator().HasTable(&models.Account{}) || db.Migrator().HasColumn(&models.Account{}, "PasswdChangedAt")
+	// doctors from before credential review keep working
+	reviewedBefore := !db.Migrator().HasTable(&models.Doctor{}) || db.Migrator().HasColumn(&models.Doctor{}, "Status")
+	// free-text allergies from before structured records become unstructured entries
+	structuredBefore := db.Migrator().HasTable(&models.Allergy{})
 	err = db.AutoMigrate(
 		&models.Account{},
 		&models.Auth{},
+		&models.RefreshToken{},
+		&models.RevokedToken{},
+		&models.Session{},
+		&models.RecoveryCode{},
+		&models.ExternalIdentity{},
+		&models.OIDCLogin{},
+		&models.PasswordHistory{},
+		&models.AuthAttempt{},
+		&models.LockoutEvent{},
+		&models.ErasureRequest{},
 		&models.Patient{},
 		&models.Doctor{},
+		&models.DoctorCredential{},
+		&models.DoctorProfileChange{},
+		&models.PatientDelegation{},
+		&models.PatientMerge{},
+		&models.ServiceAccount{},
+		&models.APIKey{},
+		&models.Allergy{},
+		&models.AllergyHistory{},
 	)
 
 	if err != nil {
 		panic(err)
 	}
+	if !verifiedBefore {
+		db.Model(&models.Account{}).Where("1 = 1").Update("email_verified", true)
+	}
+	if !datedBefore {
+		db.Model(&models.Account{}).Where("1 = 1").Update("passwd_changed_at", time.Now())
+	}
+	if !reviewedBefore {
+		db.Model(&models.Doctor{}).Where("1 = 1").Update("status", models.DoctorApproved)
+	}
+	if !structuredBefore {
+		migrateAllergies(db)
+	}
+	rekeyAuthCodes(db)
 
 	initDepartment()
+	initAdmin()
 	return db
 }
 
@@ -118,3 +167,100 @@ func initDepartment() {
 		DoUpdates: clause.AssignmentColumns([]string{"detail"}),
 	}).Create(&departments)
 }
+
+// migrateAllergies turns each free-text Patient.Allergy into an unstructured Allergy entry.
+func migrateAllergies(db *gorm.DB) {
+	var patients []models.Patient
+	db.Where("allergy <> ''").Find(&patients)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, patient := range patients {
+			allergy := models.Allergy{
+				PatientID:    patient.ID,
+				Severity:     models.SeverityUnknown,
+				Note:         patient.Allergy,
+				Unstructured: true,
+				RecordedAt:   time.Now(),
+			}
+			if err := tx.Create(&allergy).Error; err != nil {
+				return err
+			}
+			history := allergy.Snapshot(models.AllergyCreated, 0)
+			if err := tx.Create(&history).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// rekeyAuthCodes moves auth codes keyed by their email alone to (email, purpose),
+// so that a code sent for one purpose no longer replaces those sent for others.
+func rekeyAuthCodes(db *gorm.DB) {
+	var columns int64
+	db.Raw("SELECT count(*) FROM information_schema.key_column_usage WHERE table_name = 'auths' AND constraint_name = 'auths_pkey'").Scan(&columns)
+	if columns != 1 {
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// codes from before purposes existed could never be used anyway
+		if err := tx.Where("purpose IS NULL OR purpose = ''").Delete(&models.Auth{}).Error; err != nil {
+			return err
+		}
+		return tx.Exec("ALTER TABLE auths DROP CONSTRAINT auths_pkey, ADD PRIMARY KEY (email, purpose)").Error
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// initAdmin bootstraps the first admin account from ADMIN_EMAIL and ADMIN_PASSWD.
+// Nothing happens once any admin exists, further admins are managed through the admin API.
+// An existing account with that email is left alone rather than taken over.
+func initAdmin() {
+	email := os.Getenv("ADMIN_EMAIL")
+	passwd := os.Getenv("ADMIN_PASSWD")
+	if email == "" || passwd == "" {
+		return
+	}
+
+	db := utils.GetDB()
+	var count int64
+	db.Model(&models.Account{}).Where("type = ?", models.AdminType).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	db.Model(&models.Account{}).Where("email = ?", email).Count(&count)
+	if count > 0 {
+		log.Printf("error: cannot bootstrap admin account, %s is already taken by another account", email)
+		return
+	}
+
+	admin := models.Account{
+		Email:         email,
+		Type:          models.AdminType,
+		FirstName:     "Admin",
+		Passwd:        passwd,
+		EmailVerified: true,
+	}
+	admin.HashPassword()
+	admin.PasswdChangedAt = time.Now()
+	if err := db.Create(&admin).Error; err != nil {
+		panic(err)
+	}
+	log.Printf("bootstrapped admin account %s", email)
+}
+
+// indexCases fills the search vector of every case, deleted ones included.
+func indexCases(db *gorm.DB) {
+	var cases []models.Case
+	db.Unscoped().Find(&cases)
+	for i := range cases {
+		if err := models.IndexCase(db, &cases[i]); err != nil {
+			panic(err)
+		}
+	}
+}
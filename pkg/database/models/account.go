@@ -2,8 +2,11 @@ package models
 
 import (
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/AsterNighT/software-engineering-backend/pkg/keyring"
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
 	"github.com/dgrijalva/jwt-go"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -17,30 +20,278 @@ type Account struct {
 	LastName  string
 	Passwd    string // Considered as plaintext, but can be encrypted by frontend
 
+	PasswdChangedAt time.Time // Staff passwords expire after PASSWD_MAX_AGE_DAY days
+
 	Gender   string // male, female
 	Birthday time.Time
+
+	TokenVersion  uint   // Bumped to invalidate every access token issued before
+	Disabled      bool   // Disabled accounts can neither log in nor use their tokens
+	EmailVerified bool   // Unverified accounts are refused some actions, see account.RequireVerified
+	PendingEmail  string // New email waiting for its auth code, Email stays in use until then
+	Managed       bool   // Dependent profile without credentials, used through a PatientDelegation
+
+	TOTPSecret   string `json:"-"` // Base32 secret, set on enrollment and kept while enabled
+	TOTPEnabled  bool
+	TOTPLastStep int64 `json:"-"` // Last accepted time step, so that a code cannot be replayed
+}
+
+// RecoveryCode is a one-time code standing in for a TOTP code when the device is lost.
+// Only the hash is stored.
+type RecoveryCode struct {
+	ID        uint `gorm:"primarykey;autoIncrement;"`
+	AccountID uint `gorm:"index"`
+	CodeHash  string
+	UsedAt    *time.Time
+}
+
+// ExternalIdentity links an account to a user of the OpenID Connect provider, see package oidc.
+type ExternalIdentity struct {
+	ID          uint   `gorm:"primarykey;autoIncrement;"`
+	AccountID   uint   `gorm:"index"`
+	Issuer      string `gorm:"uniqueIndex:idx_external_identity"`
+	Subject     string `gorm:"uniqueIndex:idx_external_identity"` // Stable user ID at the provider
+	Email       string // As given by the provider at the latest login
+	CreatedAt   time.Time
+	LastLoginAt time.Time
+}
+
+// OIDCLogin is an OpenID Connect login on its way through the provider, looked up by its state.
+type OIDCLogin struct {
+	State     string `gorm:"primarykey;"`
+	Nonce     string
+	Verifier  string // PKCE code verifier
+	ExpiresAt time.Time
+}
+
+// PasswordHistory keeps the hashes of previous passwords so that they are not reused.
+type PasswordHistory struct {
+	ID        uint `gorm:"primarykey;autoIncrement;"`
+	AccountID uint `gorm:"index"`
+	Passwd    string
+	CreatedAt time.Time
 }
 
 type Auth struct {
-	Email           string `gorm:"primarykey;"` // Not a refer key !!!
+	Email           string      `gorm:"primarykey;"` // Not a refer key !!!
+	Purpose         AuthPurpose `gorm:"primarykey;"` // A code can only be used for what it was sent for, and only replaces codes sent for the same
 	AuthCode        string
 	AuthCodeExpires time.Time
+	Attempts        int // Wrong guesses so far, the code is dropped after too many
 }
 
+type AuthPurpose string
+
+const (
+	ResetPurpose  AuthPurpose = "reset"
+	VerifyPurpose AuthPurpose = "verify"
+	EmailPurpose  AuthPurpose = "email"  // Sent to the new address of an email change
+	InvitePurpose AuthPurpose = "invite" // Sets the first password of an imported account
+)
+
+// AuthAttempt counts consecutive authentication failures of one key,
+// which is "email:<address>" or "ip:<address>".
+type AuthAttempt struct {
+	Key         string `gorm:"primarykey;"`
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// LockoutEvent records an account being locked after repeated failures.
+type LockoutEvent struct {
+	ID          uint   `gorm:"primarykey;autoIncrement;"`
+	Email       string `gorm:"index"`
+	IP          string
+	Endpoint    string // The endpoint whose failure triggered the lockout
+	Failures    int
+	CreatedAt   time.Time
+	LockedUntil time.Time
+}
+
+// RefreshToken is a single-use credential exchanged for a new token pair.
+// Only the hash is stored, the token itself is handed to the client once.
+type RefreshToken struct {
+	ID        uint   `gorm:"primarykey;autoIncrement;"`
+	AccountID uint   `gorm:"index"`
+	Family    string `gorm:"index"` // Tokens rotated from the same login share a family
+	TokenHash string `gorm:"uniqueIndex"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+	MFA       bool // The login passed the second factor, carried over to refreshed access tokens
+}
+
+// Session is a login on some device, i.e. a refresh token family.
+// Access tokens name it in their sid claim and stop working once it is revoked.
+type Session struct {
+	ID         uint   `gorm:"primarykey;autoIncrement;"`
+	AccountID  uint   `gorm:"index"`
+	Family     string `gorm:"uniqueIndex" json:"-"` // RefreshToken.Family
+	UserAgent  string
+	IP         string // Of the latest login or refresh
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time // When its latest refresh token expires
+	RevokedAt  *time.Time
+	Current    bool `gorm:"-"` // The session of the token asking
+}
+
+// RevokedToken is an access token rejected before its expiry (e.g. on logout).
+// Rows are useless once ExpiresAt has passed and can be purged.
+type RevokedToken struct {
+	JTI       string `gorm:"primarykey;"`
+	AccountID uint
+	ExpiresAt time.Time
+}
+
+// TokenClaims is the payload of an access token.
+// Role information is embedded so that handlers need not look the account up.
+type TokenClaims struct {
+	AccountID uint       `json:"id"`
+	Version   uint       `json:"ver"` // Must match Account.TokenVersion
+	Type      AcountType `json:"type"`
+	DoctorID  uint       `json:"doctor_id,omitempty"`  // Doctor.ID, set for doctor accounts
+	PatientID uint       `json:"patient_id,omitempty"` // Patient.ID, set for patient accounts
+	MFA       bool       `json:"mfa,omitempty"`        // The login passed the second factor
+	Approved  bool       `json:"approved,omitempty"`   // Doctor.Status is approved
+	Purpose   string     `json:"pur,omitempty"`        // Empty for access tokens, see ChallengePurpose
+	SessionID uint       `json:"sid,omitempty"`        // Session.ID of the login
+	jwt.StandardClaims
+}
+
+// ChallengePurpose marks the short-lived token handed out between the password and the TOTP step of a login.
+const ChallengePurpose = "mfa"
+
+// ErasureRequest is a patient asking for their identifying data to be erased.
+// Medical records are kept, an approved request anonymizes the account instead.
+type ErasureRequest struct {
+	ID         uint `gorm:"primarykey;autoIncrement;"`
+	AccountID  uint `gorm:"index"`
+	Reason     string
+	Status     ErasureStatus `gorm:"default:'pending'"`
+	CreatedAt  time.Time
+	ReviewerID uint // Admin account which approved or rejected
+	ReviewedAt *time.Time
+	ReviewNote string
+}
+
+type ErasureStatus string
+
+const (
+	ErasurePending  ErasureStatus = "pending"
+	ErasureApproved ErasureStatus = "approved"
+	ErasureRejected ErasureStatus = "rejected"
+)
+
 type AcountType string // Type of account
 
 const (
 	PatientType AcountType = "patient"
 	DoctorType  AcountType = "doctor"
 	AdminType   AcountType = "admin"
+	ServiceType AcountType = "service" // Not an account, set for requests authenticated with an APIKey
 )
 
+// ServiceAccount is a machine integration (lab system, pharmacy kiosk...) calling the API with APIKeys.
+type ServiceAccount struct {
+	ID          uint   `gorm:"primarykey;autoIncrement;"`
+	Name        string `gorm:"uniqueIndex"`
+	Description string
+	Disabled    bool // Disabled service accounts cannot use any of their keys
+	CreatedBy   uint // Admin account which created it
+	CreatedAt   time.Time
+	APIKeys     []APIKey
+}
+
+// APIKey is a credential of a ServiceAccount, limited to the route groups its scopes name.
+// Only the hash is stored, the key itself is handed to the admin once.
+type APIKey struct {
+	ID               uint   `gorm:"primarykey;autoIncrement;"`
+	ServiceAccountID uint   `gorm:"index"`
+	Prefix           string `gorm:"uniqueIndex"` // Public part of the key, used to look it up and to tell keys apart
+	KeyHash          string `json:"-"`
+	Scopes           string // Comma separated, see account.Scopes
+	CreatedBy        uint
+	CreatedAt        time.Time
+	ExpiresAt        *time.Time // Never expires if nil
+	LastUsedAt       *time.Time
+	RevokedAt        *time.Time
+}
+
 type Doctor struct {
 	ID        uint `gorm:"primarykey;autoIncrement;"`
 	AccountID uint
 	Email     string
 
 	Department uint
+
+	// New doctors cannot use doctor-only endpoints until an admin approves their credentials
+	Status        DoctorStatus `gorm:"default:'pending'"`
+	LicenseNumber string
+	ReviewNote    string
+	ReviewedAt    *time.Time
+
+	// Public profile shown in the doctor directory, changed through an approved DoctorProfileChange
+	Title             string
+	Specialty         string
+	YearsOfExperience int
+	Languages         string // Comma separated, e.g. "zh,en"
+	Bio               string
+	PhotoURL          string
+}
+
+type DoctorStatus string
+
+const (
+	DoctorPending  DoctorStatus = "pending"
+	DoctorApproved DoctorStatus = "approved"
+	DoctorRejected DoctorStatus = "rejected"
+)
+
+// DoctorProfileChange is a change of the public profile proposed by a doctor.
+// It holds the whole profile as proposed and is copied into the Doctor once an admin approves it.
+type DoctorProfileChange struct {
+	ID                uint `gorm:"primarykey;autoIncrement;"`
+	DoctorID          uint `gorm:"index"`
+	Title             string
+	Specialty         string
+	YearsOfExperience int
+	Languages         string
+	Bio               string
+	PhotoURL          string
+	Status            DoctorStatus `gorm:"default:'pending'"`
+	CreatedAt         time.Time
+	ReviewerID        uint // Admin account which approved or rejected
+	ReviewedAt        *time.Time
+	ReviewNote        string
+}
+
+// DoctorProfileJSON is a doctor as listed in the public directory.
+type DoctorProfileJSON struct {
+	ID                uint     `json:"id"`
+	FirstName         string   `json:"firstname"`
+	LastName          string   `json:"lastname"`
+	DepartmentID      uint     `json:"department_id"`
+	Department        string   `json:"department"`
+	Title             string   `json:"title"`
+	Specialty         string   `json:"specialty"`
+	YearsOfExperience int      `json:"years_of_experience"`
+	Languages         []string `json:"languages"`
+	Bio               string   `json:"bio"`
+	PhotoURL          string   `json:"photo_url"`
+}
+
+// DoctorCredential is a document (license scan etc.) uploaded by a doctor for review.
+// The file itself lives under CREDENTIAL_DIR.
+type DoctorCredential struct {
+	ID          uint `gorm:"primarykey;autoIncrement;"`
+	DoctorID    uint `gorm:"index"`
+	FileName    string
+	ContentType string
+	Size        int64
+	Path        string `json:"-"`
+	CreatedAt   time.Time
 }
 
 type Patient struct {
@@ -48,10 +299,48 @@ type Patient struct {
 	AccountID uint
 	Email     string
 
-	// Contraindication string
+	// Free text kept for old clients, each change is mirrored into an unstructured Allergy entry
 	Allergy string
+
+	NationalID      *string `gorm:"uniqueIndex"` // Resident identity number (GB 11643), nil when not given
+	InsuranceNumber *string `gorm:"uniqueIndex"` // Medical insurance number, nil when not given
+	MergedInto      *uint   // Patient.ID this duplicate was merged into, see PatientMerge
+}
+
+// PatientMerge records an admin merging a duplicate patient into the surviving one.
+// Registrations, cases, allergies and delegations of Source now belong to Target.
+type PatientMerge struct {
+	ID              uint `gorm:"primarykey;autoIncrement;"`
+	SourceID        uint `gorm:"index"` // Patient.ID of the duplicate
+	TargetID        uint `gorm:"index"` // Patient.ID surviving
+	SourceAccountID uint
+	TargetAccountID uint
+	MergedBy        uint // Admin account
+	MergedAt        time.Time
+	Note            string
+}
+
+// PatientDelegation lets an account act for a patient profile other than its own,
+// e.g. a parent booking for a child. Owners manage the profile and its delegates,
+// delegates may book registrations, chat and read cases for it.
+type PatientDelegation struct {
+	ID        uint           `gorm:"primarykey;autoIncrement;"`
+	PatientID uint           `gorm:"index"` // Patient.ID of the profile
+	AccountID uint           `gorm:"index"` // Account acting for it
+	Role      DelegationRole // owner or delegate
+	Relation  string         // e.g. parent, child, spouse
+	GrantedBy uint           // Account which created the delegation
+	CreatedAt time.Time
+	RevokedAt *time.Time
 }
 
+type DelegationRole string
+
+const (
+	DelegationOwner    DelegationRole = "owner"
+	DelegationDelegate DelegationRole = "delegate"
+)
+
 /**
  * @brief private method for hashing password
  */
@@ -61,15 +350,46 @@ func (u *Account) HashPassword() {
 }
 
 /**
- * @brief private method for generateing token
+ * @brief private method for generateing a short-lived access token
+ * claims carries the role and MFA information, the rest is filled in here
  */
-func (u *Account) GenerateToken() (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":  u.ID,
-		"exp": time.Now().Add(7 * 24 * time.Hour),
-	})
-
-	jwtKey := []byte(os.Getenv("JWT_KEY"))
-	tokenString, err := token.SignedString(jwtKey)
-	return tokenString, err
+func (u *Account) GenerateToken(claims TokenClaims) (string, error) {
+	jti, err := utils.RandomString(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims.AccountID = u.ID
+	claims.Version = u.TokenVersion
+	claims.Type = u.Type
+	claims.Purpose = ""
+	claims.StandardClaims = jwt.StandardClaims{
+		Id:        jti,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(AccessTokenLifetime()).Unix(),
+	}
+	return SignToken(claims)
+}
+
+// SignToken signs claims with the signing key of the keyring.
+func SignToken(claims TokenClaims) (string, error) {
+	return keyring.Sign(claims)
+}
+
+// AccessTokenLifetime reads ACCESS_TOKEN_MIN, defaulting to 15 minutes.
+func AccessTokenLifetime() time.Duration {
+	return envDuration("ACCESS_TOKEN_MIN", 15, time.Minute)
+}
+
+// RefreshTokenLifetime reads REFRESH_TOKEN_DAY, defaulting to 30 days.
+func RefreshTokenLifetime() time.Duration {
+	return envDuration("REFRESH_TOKEN_DAY", 30, 24*time.Hour)
+}
+
+func envDuration(key string, fallback int, unit time.Duration) time.Duration {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n <= 0 {
+		n = fallback
+	}
+	return time.Duration(n) * unit
 }
@@ -1,6 +1,17 @@
 package models
 
-import "time"
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AsterNighT/software-engineering-backend/pkg/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
 
 type Case struct {
 	ID             uint `gorm:"primaryKey"` // Every object should have ID
@@ -17,13 +28,20 @@ type Case struct {
 	Prescriptions  []Prescription
 	PreviousCase   *Case // Previous case (the lastest one). If there is none previous case, set nil
 	PreviousCaseID *uint
+	DeletedAt      gorm.DeletedAt `gorm:"index" swaggertype:"string"` // Deleted cases are hidden, until restored or purged after RETENTION_DAY
+	DeletedBy      *uint          // Account.ID
+	DeleteReason   string
+	SearchVector   string `gorm:"type:tsvector;->:false;index:idx_case_search,type:gin" json:"-" swaggerignore:"true"` // Segmented text content, kept by RecordCaseRevision
 }
 
 type Prescription struct {
-	ID         uint `gorm:"primarykey"`
-	CaseID     uint
-	Advice     string `validate:"required"`
-	Guidelines []Guideline
+	ID           uint `gorm:"primarykey"`
+	CaseID       uint
+	Advice       string `validate:"required"`
+	Guidelines   []Guideline
+	DeletedAt    gorm.DeletedAt `gorm:"index" swaggertype:"string"` // See Case.DeletedAt
+	DeletedBy    *uint
+	DeleteReason string
 }
 
 type Guideline struct {
@@ -41,3 +59,233 @@ type Medicine struct {
 	Price            float32 `validate:"required"`
 	Contraindication string  `validate:"required"`
 }
+
+// Allergy is a known allergy or contraindication of a patient towards a medicine or an ingredient.
+// Entries migrated from the old free-text Patient.Allergy, or written there by the patient,
+// are Unstructured and only carry a Note until a doctor fills them in.
+type Allergy struct {
+	ID           uint `gorm:"primarykey"`
+	PatientID    uint `gorm:"index"` // Patient.ID
+	MedicineID   *uint
+	Medicine     *Medicine
+	Ingredient   string
+	Reaction     string
+	Severity     AllergySeverity `gorm:"default:'unknown'"`
+	Note         string
+	Unstructured bool
+	RecordedBy   uint // Doctor.ID, 0 for entries reported by the patient
+	RecordedAt   time.Time
+}
+
+type AllergySeverity string
+
+const (
+	SeverityUnknown  AllergySeverity = "unknown"
+	SeverityMild     AllergySeverity = "mild"
+	SeverityModerate AllergySeverity = "moderate"
+	SeveritySevere   AllergySeverity = "severe"
+)
+
+// AllergyHistory is a snapshot of an Allergy taken on every change, deleted entries included.
+type AllergyHistory struct {
+	ID           uint          `gorm:"primarykey"`
+	AllergyID    uint          `gorm:"index"`
+	PatientID    uint          `gorm:"index"`
+	Action       AllergyAction // created, updated or deleted
+	MedicineID   *uint
+	Ingredient   string
+	Reaction     string
+	Severity     AllergySeverity
+	Note         string
+	Unstructured bool
+	RecordedBy   uint
+	ChangedBy    uint // Account.ID, 0 for the migration of the free-text field
+	ChangedAt    time.Time
+}
+
+type AllergyAction string
+
+const (
+	AllergyCreated AllergyAction = "created"
+	AllergyUpdated AllergyAction = "updated"
+	AllergyDeleted AllergyAction = "deleted"
+)
+
+/**
+ * @brief snapshot the allergy for its history
+ */
+func (a *Allergy) Snapshot(action AllergyAction, by uint) AllergyHistory {
+	return AllergyHistory{
+		AllergyID:    a.ID,
+		PatientID:    a.PatientID,
+		Action:       action,
+		MedicineID:   a.MedicineID,
+		Ingredient:   a.Ingredient,
+		Reaction:     a.Reaction,
+		Severity:     a.Severity,
+		Note:         a.Note,
+		Unstructured: a.Unstructured,
+		RecordedBy:   a.RecordedBy,
+		ChangedBy:    by,
+		ChangedAt:    time.Now(),
+	}
+}
+
+// SafetyOverride is a warning of the prescription safety check which a doctor prescribed through,
+// with the justification they gave. It is kept when the prescription is deleted.
+type SafetyOverride struct {
+	ID             uint `gorm:"primarykey"`
+	PrescriptionID uint `gorm:"index"`
+	CaseID         uint `gorm:"index"`
+	MedicineID     uint
+	AllergyID      *uint  // The allergy the warning is about, nil for a contraindication of the case
+	Kind           string // See cases.SafetyIssue
+	Detail         string
+	Justification  string
+	OverriddenBy   uint // Account.ID
+	CreatedAt      time.Time
+}
+
+// CaseRevision is a snapshot of a Case and its prescriptions, taken on every change to either.
+// Revisions are never updated nor deleted, they outlive the case itself.
+type CaseRevision struct {
+	ID            uint           `gorm:"primarykey"`
+	CaseID        uint           `gorm:"uniqueIndex:idx_case_revision"`
+	Number        uint           `gorm:"uniqueIndex:idx_case_revision"` // 1, 2, ... within the case
+	PatientID     uint           `gorm:"index"`                         // Account.ID, like Case.PatientID
+	Action        RevisionAction // what changed
+	Department    string
+	Complaint     string
+	Diagnosis     string
+	Treatment     string
+	History       string
+	Prescriptions PrescriptionSnapshots `gorm:"type:text"`
+	AuthorID      uint                  // Account.ID
+	Reason        string
+	CreatedAt     time.Time
+}
+
+type RevisionAction string
+
+const (
+	CaseCreated          RevisionAction = "case_created"
+	CaseUpdated          RevisionAction = "case_updated"
+	CaseDeleted          RevisionAction = "case_deleted"
+	PrescriptionCreated  RevisionAction = "prescription_created"
+	PrescriptionUpdated  RevisionAction = "prescription_updated"
+	PrescriptionDeleted  RevisionAction = "prescription_deleted"
+	CaseRestored         RevisionAction = "case_restored"
+	PrescriptionRestored RevisionAction = "prescription_restored"
+)
+
+// PrescriptionSnapshot is a prescription as it was at a revision.
+type PrescriptionSnapshot struct {
+	ID         uint                `json:"id"`
+	Advice     string              `json:"advice"`
+	Guidelines []GuidelineSnapshot `json:"guidelines"`
+}
+
+type GuidelineSnapshot struct {
+	MedicineID uint   `json:"medicine_id"`
+	Medicine   string `json:"medicine"` // name of the medicine then
+	Dosage     string `json:"dosage"`
+	Quantity   uint   `json:"quantity"`
+}
+
+// PrescriptionSnapshots are stored as JSON in a single column.
+type PrescriptionSnapshots []PrescriptionSnapshot
+
+var ErrRevisionImmutable = errors.New("case revisions cannot be changed")
+
+func (p PrescriptionSnapshots) Value() (driver.Value, error) {
+	b, err := json.Marshal(p)
+	return string(b), err
+}
+
+func (p *PrescriptionSnapshots) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	case []byte:
+		return json.Unmarshal(v, p)
+	case nil:
+		*p = nil
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into PrescriptionSnapshots", value)
+}
+
+func (r *CaseRevision) BeforeUpdate(tx *gorm.DB) error {
+	return ErrRevisionImmutable
+}
+
+func (r *CaseRevision) BeforeDelete(tx *gorm.DB) error {
+	return ErrRevisionImmutable
+}
+
+/**
+ * @brief snapshot the case, with its prescriptions and their guidelines loaded, as revision number
+ */
+func (c *Case) Snapshot(number uint, action RevisionAction, by uint, reason string) CaseRevision {
+	revision := CaseRevision{
+		CaseID:        c.ID,
+		Number:        number,
+		PatientID:     c.PatientID,
+		Action:        action,
+		Department:    c.Department,
+		Complaint:     c.Complaint,
+		Diagnosis:     c.Diagnosis,
+		Treatment:     c.Treatment,
+		History:       c.History,
+		Prescriptions: PrescriptionSnapshots{},
+		AuthorID:      by,
+		Reason:        reason,
+	}
+	for _, p := range c.Prescriptions {
+		snapshot := PrescriptionSnapshot{ID: p.ID, Advice: p.Advice, Guidelines: []GuidelineSnapshot{}}
+		for _, g := range p.Guidelines {
+			snapshot.Guidelines = append(snapshot.Guidelines, GuidelineSnapshot{
+				MedicineID: g.MedicineID,
+				Medicine:   g.Medicine.Name,
+				Dosage:     g.Dosage,
+				Quantity:   g.Quantity,
+			})
+		}
+		revision.Prescriptions = append(revision.Prescriptions, snapshot)
+	}
+	return revision
+}
+
+/**
+ * @brief snapshot the case as it is now in tx as its next revision.
+ * The case row is locked, so that two changes of a case cannot take the same number.
+ * Deleted cases are recorded too, e.g. when a merge moves them; deleted prescriptions are left out.
+ */
+func RecordCaseRevision(tx *gorm.DB, caseID uint, action RevisionAction, by uint, reason string) error {
+	var c Case
+	err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+		Preload("Prescriptions").Preload("Prescriptions.Guidelines").Preload("Prescriptions.Guidelines.Medicine").
+		First(&c, caseID).Error
+	if err != nil {
+		return err
+	}
+	var last CaseRevision
+	number := uint(1)
+	if tx.Where("case_id = ?", caseID).Order("number DESC").Limit(1).Find(&last).RowsAffected > 0 {
+		number = last.Number + 1
+	}
+	revision := c.Snapshot(number, action, by, reason)
+	if err := tx.Create(&revision).Error; err != nil {
+		return err
+	}
+	// Every change of the case is recorded here, so its search vector follows
+	return IndexCase(tx, &c)
+}
+
+/**
+ * @brief refresh the search vector of c from its text content, see utils.Segment.
+ */
+func IndexCase(tx *gorm.DB, c *Case) error {
+	text := strings.Join(utils.Segment(strings.Join([]string{c.Complaint, c.Diagnosis, c.Treatment, c.History}, " ")), " ")
+	return tx.Exec("UPDATE cases SET search_vector = to_tsvector('simple', ?) WHERE id = ?", text, c.ID).Error
+}
@@ -80,26 +80,6 @@ const (
 	Afternoon HalfDayEnum = "afternoon"
 )
 
-type ProcessError string
-
-const (
-	InvalidSubmitFormat      ProcessError = "参数格式错误"
-	DepartmentNotFound       ProcessError = "无法找到该科室"
-	PatientNotFound          ProcessError = "无法找到该患者"
-	RegistrationNotFound     ProcessError = "找不到该挂号"
-	DoctorNotFound           ProcessError = "无法找到该医生"
-	MileStoneNotFound        ProcessError = "找不到该 MileStone"
-	MileStoneUnauthorized    ProcessError = "你无权操作该 MileStone"
-	InvalidSchedule          ProcessError = "该时段不可用"
-	NotEnoughCapacity        ProcessError = "该时段已经没有足够的挂号余量"
-	CreateRegistrationFailed ProcessError = "挂号失败，请检查科室是否有余量或者时间冲突"
-	CreateMileStoneFailed    ProcessError = "创建 MileStone 失败"
-	CannotAssignDoctor       ProcessError = "无法为该挂号分配医生"
-	AccountNotFound          ProcessError = "找不到用户"
-	RegistrationUpdateFailed ProcessError = "挂号状态更新失败"
-	SearchFailed             ProcessError = "查询失败"
-)
-
 type SearchKey string
 
 const (
@@ -113,6 +93,7 @@ type DepartmentDetailJSON struct {
 	Name      string               `json:"name"`
 	Detail    string               `json:"detail"`
 	Doctors   []string             `json:"doctors"`
+	Profiles  []DoctorProfileJSON  `json:"profiles"` // Same doctors with their public profiles
 	Schedules []DepartmentSchedule `json:"schedules"`
 }
 
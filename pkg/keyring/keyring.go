@@ -0,0 +1,273 @@
+// Package keyring holds the keys access tokens are signed and verified with.
+//
+// One key signs, every key of the ring verifies, so that a new signing key
+// can be rolled out while tokens signed by the previous one are still alive.
+// Asymmetric keys (RS256, EdDSA) are named by a kid header and published as a
+// JWKS, letting other services verify tokens without knowing any secret.
+package keyring
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Key is a signing or verification key.
+type Key struct {
+	ID        string // kid header, empty for the legacy HS256 secret
+	Method    jwt.SigningMethod
+	signKey   interface{} // nil for keys which only verify
+	verifyKey interface{}
+}
+
+type Keyring struct {
+	signing *Key
+	keys    map[string]*Key // By ID
+}
+
+var keyring *Keyring
+
+// Set replaces the keyring used by Sign and Keyfunc.
+func Set(k *Keyring) {
+	keyring = k
+}
+
+// Current is the keyring set with Set, or one made of JWT_KEY alone.
+func Current() *Keyring {
+	if keyring != nil {
+		return keyring
+	}
+	k, _ := New(nil, nil, []byte(os.Getenv("JWT_KEY")))
+	return k
+}
+
+// Sign signs claims with the current signing key.
+func Sign(claims jwt.Claims) (string, error) {
+	return Current().Sign(claims)
+}
+
+// Keyfunc finds the key of a token in the current keyring, see jwt.Parse.
+func Keyfunc(token *jwt.Token) (interface{}, error) {
+	return Current().Keyfunc(token)
+}
+
+// NewFromEnv loads the keys configured in the environment:
+// JWT_SIGNING_KEY is the PEM file of the private key signing new tokens,
+// JWT_VERIFY_KEYS the comma separated PEM files of keys still accepted,
+// and JWT_KEY the HS256 secret, which signs only while JWT_SIGNING_KEY is empty.
+// Once JWT_SIGNING_KEY is set, JWT_KEY only verifies with JWT_ACCEPT_HS256=true,
+// lest a forgotten secret keep accepting forged tokens.
+func NewFromEnv() (*Keyring, error) {
+	var signing *Key
+	if path := strings.TrimSpace(os.Getenv("JWT_SIGNING_KEY")); path != "" {
+		key, err := LoadKey(path)
+		if err != nil {
+			return nil, err
+		}
+		if key.signKey == nil {
+			return nil, fmt.Errorf("%s: a private key is needed for signing", path)
+		}
+		signing = key
+	}
+	var verify []*Key
+	for _, path := range strings.Split(os.Getenv("JWT_VERIFY_KEYS"), ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		key, err := LoadKey(path)
+		if err != nil {
+			return nil, err
+		}
+		verify = append(verify, key)
+	}
+	secret := []byte(os.Getenv("JWT_KEY"))
+	if signing != nil && len(secret) > 0 {
+		if os.Getenv("JWT_ACCEPT_HS256") == "true" {
+			log.Printf("warning: JWT_KEY still verifies HS256 tokens, unset JWT_ACCEPT_HS256 once they have expired")
+		} else {
+			log.Printf("warning: JWT_KEY is ignored since JWT_SIGNING_KEY is set, set JWT_ACCEPT_HS256=true to accept HS256 tokens during a rotation")
+			secret = nil
+		}
+	}
+	return New(signing, verify, secret)
+}
+
+// New makes a keyring signing with signing, or with secret if signing is nil.
+// secret, when not empty, verifies HS256 tokens without kid.
+func New(signing *Key, verify []*Key, secret []byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]*Key)}
+	if len(secret) > 0 {
+		hmac := &Key{Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+		k.keys[""] = hmac
+		k.signing = hmac
+	}
+	for _, key := range append(verify, signing) {
+		// The same key given twice has the same ID
+		if key != nil {
+			k.keys[key.ID] = key
+		}
+	}
+	if signing != nil {
+		k.signing = signing
+	}
+	if k.signing == nil {
+		return nil, errors.New("no signing key: set JWT_SIGNING_KEY or JWT_KEY")
+	}
+	return k, nil
+}
+
+// Sign signs claims, naming the key in the kid header.
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	if k == nil || k.signing == nil {
+		return "", errors.New("no signing key")
+	}
+	token := jwt.NewWithClaims(k.signing.Method, claims)
+	if k.signing.ID != "" {
+		token.Header["kid"] = k.signing.ID
+	}
+	return token.SignedString(k.signing.signKey)
+}
+
+// Keyfunc returns the key named by the kid header, provided the token uses its algorithm.
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if k == nil {
+		return nil, errors.New("no keys")
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	// Otherwise a public key could be passed off as an HMAC secret
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.verifyKey, nil
+}
+
+// JWK is a public key in JSON Web Key format.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // OKP curve
+	X   string `json:"x,omitempty"`   // OKP public key
+}
+
+// JWKS is the set of public keys of a keyring, the HS256 secret is never part of it.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (k *Keyring) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	if k == nil {
+		return set
+	}
+	// The signing key first, then the rest
+	var rest []*Key
+	for _, key := range k.keys {
+		if key != k.signing {
+			rest = append(rest, key)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].ID < rest[j].ID })
+	keys := append([]*Key{k.signing}, rest...)
+	for _, key := range keys {
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// LoadKey reads a PEM file holding an RSA or Ed25519 private key (PKCS #1 or PKCS #8) or public key (PKIX).
+func LoadKey(path string) (*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// ParseKey parses a PEM encoded key, see LoadKey.
+func ParseKey(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.signKey, key.verifyKey = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.verifyKey = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.signKey, key.verifyKey = SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.Method, key.verifyKey = SigningMethodEdDSA, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	if key.ID, err = keyID(key.verifyKey); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// keyID derives the kid from the public key, so that every copy of a key has the same one.
+func keyID(pub interface{}) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12]), nil
+}
@@ -0,0 +1,120 @@
+package keyring
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKey(t *testing.T, name string, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+	return path
+}
+
+func claims() jwt.StandardClaims {
+	return jwt.StandardClaims{Subject: "42", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+}
+
+func parse(k *Keyring, token string) error {
+	_, err := jwt.ParseWithClaims(token, &jwt.StandardClaims{}, k.Keyfunc)
+	return err
+}
+
+func TestRotation(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaPath := writeKey(t, "old.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	rsaPub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	rsaPubPath := writeKey(t, "old.pub", "PUBLIC KEY", rsaPub)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+	edPath := writeKey(t, "new.pem", "PRIVATE KEY", edDER)
+
+	// Before: the HS256 secret, then RS256 signing
+	legacy, err := New(nil, nil, []byte("secret"))
+	require.NoError(t, err)
+	legacyToken, err := legacy.Sign(claims())
+	require.NoError(t, err)
+
+	os.Setenv("JWT_KEY", "secret")
+	os.Setenv("JWT_SIGNING_KEY", rsaPath)
+	os.Setenv("JWT_VERIFY_KEYS", "")
+	// The secret left over from before is not trusted unless asked for
+	strict, err := NewFromEnv()
+	require.NoError(t, err)
+	assert.Error(t, parse(strict, legacyToken))
+
+	os.Setenv("JWT_ACCEPT_HS256", "true")
+	defer os.Unsetenv("JWT_ACCEPT_HS256")
+	old, err := NewFromEnv()
+	require.NoError(t, err)
+	oldToken, err := old.Sign(claims())
+	require.NoError(t, err)
+	assert.NoError(t, parse(old, legacyToken))
+	assert.NoError(t, parse(old, oldToken))
+
+	// After: EdDSA signing, the RS256 public key and the secret still accepted
+	os.Setenv("JWT_SIGNING_KEY", edPath)
+	os.Setenv("JWT_VERIFY_KEYS", rsaPubPath)
+	rotated, err := NewFromEnv()
+	require.NoError(t, err)
+	newToken, err := rotated.Sign(claims())
+	require.NoError(t, err)
+	token, _, err := new(jwt.Parser).ParseUnverified(newToken, &jwt.StandardClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, "EdDSA", token.Header["alg"])
+	assert.NotEmpty(t, token.Header["kid"])
+
+	for _, signed := range []string{legacyToken, oldToken, newToken} {
+		assert.NoError(t, parse(rotated, signed))
+	}
+	assert.Error(t, parse(old, newToken))
+
+	// Once the rotation is over, older tokens are refused
+	os.Setenv("JWT_KEY", "")
+	os.Setenv("JWT_VERIFY_KEYS", "")
+	done, err := NewFromEnv()
+	require.NoError(t, err)
+	assert.Error(t, parse(done, legacyToken))
+	assert.Error(t, parse(done, oldToken))
+	assert.NoError(t, parse(done, newToken))
+
+	// Only public keys are published, the signing key first
+	set := rotated.JWKS()
+	require.Len(t, set.Keys, 2)
+	assert.Equal(t, "OKP", set.Keys[0].Kty)
+	assert.Equal(t, token.Header["kid"], set.Keys[0].Kid)
+	assert.Equal(t, "RSA", set.Keys[1].Kty)
+	assert.Equal(t, "RS256", set.Keys[1].Alg)
+
+	// A public key must not pass for an HMAC secret
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	forged.Header["kid"] = set.Keys[1].Kid
+	forgedToken, err := forged.SignedString(rsaPub)
+	require.NoError(t, err)
+	assert.Error(t, parse(rotated, forgedToken))
+
+	os.Unsetenv("JWT_SIGNING_KEY")
+	os.Unsetenv("JWT_VERIFY_KEYS")
+	_, err = NewFromEnv()
+	assert.Error(t, err)
+	os.Setenv("JWT_SIGNING_KEY", rsaPubPath)
+	_, err = NewFromEnv()
+	assert.Error(t, err)
+	os.Unsetenv("JWT_SIGNING_KEY")
+}
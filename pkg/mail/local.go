@@ -0,0 +1,65 @@
+package mail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileMailer writes every message as an .eml file into Dir, for development.
+type FileMailer struct {
+	Dir string
+
+	mu    sync.Mutex
+	count int
+}
+
+// NewFileMailer creates dir if needed. An empty dir defaults to "build/mail".
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if dir == "" {
+		dir = filepath.Join("build", "mail")
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &FileMailer{Dir: dir}, nil
+}
+
+func (m *FileMailer) Send(msg *Message) error {
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.count++
+	name := fmt.Sprintf("%s-%d.eml", time.Now().Format("20060102-150405"), m.count)
+	m.mu.Unlock()
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), body, 0600)
+}
+
+// MemoryMailer keeps every message in memory, for tests.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, *msg)
+	return nil
+}
+
+// Messages returns a copy of the messages sent so far.
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
@@ -0,0 +1,136 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// Message is a rendered email ready to be delivered.
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers messages. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+var mailer Mailer = NewMemoryMailer()
+
+// SetMailer replaces the mailer used by Send and SendTemplate.
+func SetMailer(m Mailer) {
+	mailer = m
+}
+
+func GetMailer() Mailer {
+	return mailer
+}
+
+// NewFromEnv builds the mailer selected by MAIL_BACKEND:
+// "smtp" (default) uses the EMAIL_SERVER_* settings, "file" writes .eml files into MAIL_DIR
+// and "memory" keeps messages in memory.
+func NewFromEnv() (Mailer, error) {
+	switch backend := os.Getenv("MAIL_BACKEND"); backend {
+	case "", "smtp":
+		return &SMTPMailer{
+			Host:   os.Getenv("EMAIL_SERVER_HOST"),
+			Port:   os.Getenv("EMAIL_SERVER_PORT"),
+			User:   os.Getenv("EMAIL_USER"),
+			Passwd: os.Getenv("EMAIL_PASSWD"),
+		}, nil
+	case "file":
+		return NewFileMailer(os.Getenv("MAIL_DIR"))
+	case "memory":
+		return NewMemoryMailer(), nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_BACKEND %q", backend)
+	}
+}
+
+// Send delivers msg through the configured mailer, filling in the default sender.
+func Send(msg *Message) error {
+	if msg.From == "" {
+		msg.From = defaultFrom()
+	}
+	return mailer.Send(msg)
+}
+
+// SendTemplate renders the template name in lang and sends it to a single recipient.
+func SendTemplate(to string, lang string, name string, data interface{}) error {
+	msg, err := Render(lang, name, data)
+	if err != nil {
+		return err
+	}
+	msg.To = []string{to}
+	return Send(msg)
+}
+
+func defaultFrom() string {
+	if from := os.Getenv("MAIL_FROM"); from != "" {
+		return from
+	}
+	return `"MediConnect" <noreply@mediconnect.com>`
+}
+
+// Bytes encodes msg as a MIME message with a text and an html alternative.
+func (msg *Message) Bytes() ([]byte, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain", msg.Text},
+		{"text/html", msg.HTML},
+	} {
+		if part.content == "" {
+			continue
+		}
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + `; charset="UTF-8"`},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(wrapBase64([]byte(part.content))); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", msg.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", writer.Boundary())
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// wrapBase64 encodes b with lines of at most 76 characters as required by RFC 2045.
+func wrapBase64(b []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(b)
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	return buf.Bytes()
+}
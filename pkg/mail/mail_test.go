@@ -0,0 +1,42 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLanguage(t *testing.T) {
+	assert.Equal(t, ZhCN, Language("zh-CN,zh;q=0.9,en;q=0.8"))
+	assert.Equal(t, EnUS, Language("en-GB, zh;q=0.5"))
+	assert.Equal(t, DefaultLanguage, Language("fr-FR"))
+	assert.Equal(t, DefaultLanguage, Language(""))
+}
+
+func TestSendTemplate(t *testing.T) {
+	m := NewMemoryMailer()
+	SetMailer(m)
+
+	data := map[string]interface{}{"Code": "123456", "ExpireMin": 10}
+	assert.NoError(t, SendTemplate("a@a.com", ZhCN, "reset_password", data))
+	assert.NoError(t, SendTemplate("b@b.com", "fr-FR", "reset_password", data))
+
+	messages := m.Messages()
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, []string{"a@a.com"}, messages[0].To)
+		assert.Contains(t, messages[0].Subject, "账户重置")
+		assert.Contains(t, messages[0].Text, "123456")
+		assert.Contains(t, messages[0].HTML, "<strong>123456</strong>")
+		assert.Contains(t, messages[1].Subject, "Account Reset")
+	}
+
+	body, err := messages[0].Bytes()
+	if assert.NoError(t, err) {
+		assert.True(t, strings.Contains(string(body), "Subject: =?UTF-8?b?"))
+		assert.Contains(t, string(body), "multipart/alternative")
+	}
+
+	_, err = Render(EnUS, "no_such_template", data)
+	assert.Error(t, err)
+}
@@ -0,0 +1,31 @@
+package mail
+
+import (
+	"net/mail"
+	"net/smtp"
+)
+
+// SMTPMailer delivers messages through an SMTP server with PLAIN auth.
+type SMTPMailer struct {
+	Host   string
+	Port   string
+	User   string
+	Passwd string
+}
+
+func (m *SMTPMailer) Send(msg *Message) error {
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	to := make([]string, len(msg.To))
+	for i, addr := range msg.To {
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil {
+			return err
+		}
+		to[i] = parsed.Address
+	}
+	auth := smtp.PlainAuth("", m.User, m.Passwd, m.Host)
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.User, to, body)
+}
@@ -0,0 +1,63 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/AsterNighT/software-engineering-backend/api"
+)
+
+const (
+	ZhCN = api.ZhCN
+	EnUS = api.EnUS
+
+	DefaultLanguage = api.DefaultLanguage
+)
+
+// Every template has a templates/<lang>/<name>.txt defining "subject" and "text",
+// and a templates/<lang>/<name>.html with the html body.
+//
+//go:embed templates
+var templateFS embed.FS
+
+// Language picks the supported language best matching an Accept-Language header.
+func Language(acceptLanguage string) string {
+	return api.Language(acceptLanguage)
+}
+
+// Render renders the template name in lang, falling back to DefaultLanguage.
+func Render(lang string, name string, data interface{}) (*Message, error) {
+	if lang != ZhCN && lang != EnUS {
+		lang = DefaultLanguage
+	}
+	base := "templates/" + lang + "/" + name
+
+	text, err := texttemplate.ParseFS(templateFS, base+".txt")
+	if err != nil {
+		return nil, fmt.Errorf("mail template %s: %w", name, err)
+	}
+	html, err := htmltemplate.ParseFS(templateFS, base+".html")
+	if err != nil {
+		return nil, fmt.Errorf("mail template %s: %w", name, err)
+	}
+
+	var subject, textBody, htmlBody bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := text.ExecuteTemplate(&textBody, "text", data); err != nil {
+		return nil, err
+	}
+	if err := html.Execute(&htmlBody, data); err != nil {
+		return nil, err
+	}
+	return &Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(textBody.String()) + "\n",
+		HTML:    htmlBody.String(),
+	}, nil
+}
@@ -0,0 +1,146 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testIdP is a stand-in provider issuing ID tokens for a single authorization code.
+type testIdP struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	code     string
+	verifier string
+	claims   jwt.MapClaims
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	idp := &testIdP{key: key, code: "the-code"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Discovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.PostFormValue("code") != idp.code || Challenge(r.PostFormValue("code_verifier")) != Challenge(idp.verifier) ||
+			id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, idp.claims), "token_type": "Bearer"})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *testIdP) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(idp.key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestProvider(t *testing.T) {
+	idp := newTestIdP(t)
+	ctx := context.Background()
+	p, err := NewProvider(ctx, Config{
+		Issuer:       idp.server.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/callback",
+		Scopes:       []string{"email", "profile"},
+	}, idp.server.Client())
+	require.NoError(t, err)
+
+	verifier, err := NewVerifier()
+	require.NoError(t, err)
+	idp.verifier = verifier
+	authURL, err := url.Parse(p.AuthCodeURL("st", "n0nce", Challenge(verifier)))
+	require.NoError(t, err)
+	assert.Equal(t, "/authorize", authURL.Path)
+	assert.Equal(t, "openid email profile", authURL.Query().Get("scope"))
+	assert.Equal(t, "S256", authURL.Query().Get("code_challenge_method"))
+
+	now := time.Now()
+	idp.claims = jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"sub":            "staff-42",
+		"aud":            []string{"client", "other"},
+		"exp":            now.Add(time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          "n0nce",
+		"email":          "doc@hospital.org",
+		"email_verified": true,
+	}
+
+	_, err = p.Exchange(ctx, idp.code, "wrong-verifier")
+	assert.Error(t, err)
+
+	raw, err := p.Exchange(ctx, idp.code, verifier)
+	require.NoError(t, err)
+	claims, err := p.Verify(ctx, raw, "n0nce")
+	require.NoError(t, err)
+	assert.Equal(t, "staff-42", claims.Subject)
+	assert.Equal(t, "doc@hospital.org", claims.Email)
+	assert.True(t, claims.EmailVerified)
+
+	_, err = p.Verify(ctx, raw, "other-nonce")
+	assert.Error(t, err)
+
+	for name, change := range map[string]func(jwt.MapClaims){
+		"audience": func(c jwt.MapClaims) { c["aud"] = "other" },
+		"issuer":   func(c jwt.MapClaims) { c["iss"] = "https://evil.example" },
+		"expired":  func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Hour).Unix() },
+	} {
+		claims := jwt.MapClaims{}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		change(claims)
+		_, err := p.Verify(ctx, idp.sign(t, claims), "n0nce")
+		assert.Error(t, err, name)
+	}
+
+	// Signed by someone else
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	forged := jwt.NewWithClaims(jwt.SigningMethodRS256, idp.claims)
+	forged.Header["kid"] = "k1"
+	raw, err = forged.SignedString(other)
+	require.NoError(t, err)
+	_, err = p.Verify(ctx, raw, "n0nce")
+	assert.Error(t, err)
+}
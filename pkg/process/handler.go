@@ -10,6 +10,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/AsterNighT/software-engineering-backend/pkg/account"
 	"github.com/AsterNighT/software-engineering-backend/pkg/chat"
 
 	"github.com/AsterNighT/software-engineering-backend/api"
@@ -26,7 +27,7 @@ func (h *ProcessHandler) Search(c echo.Context) error {
 	response, err := http.Get(string("http://zhouxunwang.cn/data/?id=111&key="+models.AlphaKey+"&title=") + c.Param("keyWord"))
 	if err != nil {
 		c.Logger().Debug("search failed...")
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.SearchFailed))
+		return api.Fail(c, api.SearchFailed, nil)
 	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
@@ -96,10 +97,10 @@ func (h *ProcessHandler) GetDepartmentByID(c echo.Context) error {
 
 	err := db.First(&department, c.Param("departmentID")).Error
 	if err != nil {
-		return c.JSON(http.StatusNotFound, api.Return("error", models.DepartmentNotFound))
+		return api.Fail(c, api.DepartmentNotFound, nil)
 	}
 	db.Where("department_id = ?", department.ID).Find(&schedules)
-	db.Where("department_id = ?", department.ID).Find(&doctorsAll)
+	db.Where("department = ? AND status = ?", department.ID, models.DoctorApproved).Find(&doctorsAll)
 
 	for _, doctor := range doctorsAll {
 		var a models.Account
@@ -115,6 +116,7 @@ func (h *ProcessHandler) GetDepartmentByID(c echo.Context) error {
 		Name:      department.Name,
 		Detail:    department.Detail,
 		Doctors:   doctors,
+		Profiles:  account.DoctorProfiles(db, doctorsAll),
 		Schedules: schedules,
 	}
 
@@ -131,6 +133,7 @@ func (h *ProcessHandler) GetDepartmentByID(c echo.Context) error {
 // @Param month body int true "Month"
 // @Param day body int true "Day"
 // @Param halfday body int true "HalfDay"
+// @Param patient_id body uint false "patient ID of another profile the account acts for, its own one by default"
 // @Produce json
 // @Success 200 {object} api.ReturnedData{data=int}
 // @Router /registrations [POST]
@@ -141,45 +144,50 @@ func (h *ProcessHandler) CreateRegistrationTX(c echo.Context) error {
 		Month        int                `json:"month"`
 		Day          int                `json:"day"`
 		HalfDay      models.HalfDayEnum `json:"halfday" validate:"halfday"`
+		PatientID    uint               `json:"patient_id"`
 	}
 
 	// extract submit data
 	var submit RegistrationSubmitJSON
 	if err := c.Bind(&submit); err != nil {
 		c.Logger().Debug("JSON format failed when trying to create a registration ...")
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.InvalidSubmitFormat))
+		return api.Fail(c, api.InvalidRequest, nil)
 	}
 
 	// validate halfday enum
 	err := models.Validate.Struct(submit)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.InvalidSubmitFormat))
+		return api.Fail(c, api.InvalidRequest, nil)
 	}
 
 	var res = 1
 
 	db := utils.GetDB()
+
+	// the patient comes from the token claims, unless booking for another profile
+	patient := models.Patient{ID: c.Get("patientID").(uint), AccountID: c.Get("id").(uint)}
+	if submit.PatientID != 0 && submit.PatientID != patient.ID {
+		if err := db.First(&patient, submit.PatientID).Error; err != nil {
+			return api.Fail(c, api.PatientNotFound, nil)
+		}
+		if !account.ActsFor(db, c.Get("id").(uint), &patient) {
+			return api.Fail(c, api.PermissionDenied, nil)
+		}
+	}
+
 	err = db.Transaction(func(tx *gorm.DB) error {
 		// get department
 		var department models.Department
-		err = db.First(&department, submit.DepartmentID).Error
+		err = tx.First(&department, submit.DepartmentID).Error
 		if err != nil {
-			c.Logger().Error(models.DepartmentNotFound)
-			return err
-		}
-
-		// get patient
-		var patient models.Patient
-		err = db.Where("account_id = ?", c.Get("id").(uint)).First(&patient).Error
-		if err != nil {
-			c.Logger().Error(models.PatientNotFound)
+			c.Logger().Error(api.DepartmentNotFound)
 			return err
 		}
 
 		var possibleDuplicates []models.Registration
 
 		// check duplicate registration
-		if db.Where(&models.Registration{
+		if tx.Where(&models.Registration{
 			DepartmentID: department.ID,
 			PatientID:    patient.ID,
 			Year:         submit.Year,
@@ -196,7 +204,7 @@ func (h *ProcessHandler) CreateRegistrationTX(c echo.Context) error {
 
 		// check schedule
 		var schedule models.DepartmentSchedule
-		err = db.Where(&models.DepartmentSchedule{
+		err = tx.Where(&models.DepartmentSchedule{
 			DepartmentID: department.ID,
 			Year:         submit.Year,
 			Month:        submit.Month,
@@ -208,13 +216,14 @@ func (h *ProcessHandler) CreateRegistrationTX(c echo.Context) error {
 		if err != nil || !models.ValidateSchedule(&schedule) {
 			return errors.New("invalid schedule")
 		} else if schedule.Current >= schedule.Capacity {
-			c.Logger().Error(models.NotEnoughCapacity)
+			c.Logger().Error(api.NotEnoughCapacity)
 			return err
 		}
 
 		// assign the doctor with the minimal registrations
 		var doctors []models.Doctor
-		db.Where("department_id = ?", department.ID).Find(&doctors)
+		// only approved doctors take patients
+		tx.Where("department = ? AND status = ?", department.ID, models.DoctorApproved).Find(&doctors)
 		var doctorRegistrationCount = make([]int64, len(doctors))
 
 		registration := models.Registration{
@@ -228,7 +237,7 @@ func (h *ProcessHandler) CreateRegistrationTX(c echo.Context) error {
 		// find min count of registrations
 		minCount, minIndex := int64(math.MaxInt64), -1
 		for i := range doctors {
-			db.Model(&models.Registration{}).Where(&registration).Count(&doctorRegistrationCount[i])
+			tx.Model(&models.Registration{}).Where(&registration).Count(&doctorRegistrationCount[i])
 			if minCount > doctorRegistrationCount[i] {
 				minCount = doctorRegistrationCount[i]
 				minIndex = i
@@ -237,7 +246,7 @@ func (h *ProcessHandler) CreateRegistrationTX(c echo.Context) error {
 
 		// cannot find a doctor
 		if minIndex == -1 {
-			c.Logger().Error(models.CannotAssignDoctor)
+			c.Logger().Error(api.CannotAssignDoctor)
 			return echo.ErrBadRequest
 		}
 
@@ -245,7 +254,7 @@ func (h *ProcessHandler) CreateRegistrationTX(c echo.Context) error {
 		registration.PatientID = patient.ID
 		registration.DoctorID = doctors[minIndex].ID
 
-		if err := db.Create(&registration).Error; err != nil {
+		if err := tx.Create(&registration).Error; err != nil {
 			return err
 		}
 
@@ -264,16 +273,21 @@ func (h *ProcessHandler) CreateRegistrationTX(c echo.Context) error {
 			Guidelines: nil,
 		}}
 
-		dbErr := db.Where("department = ?", department.Name).Order("date DESC").Limit(1).First(&preCase)
+		dbErr := tx.Where("department = ?", department.Name).Order("date DESC").Limit(1).First(&preCase)
 		if dbErr == nil {
 			correspondingCase.PreviousCase = &preCase
 		}
 
-		db.Create(&correspondingCase)
+		if err := tx.Create(&correspondingCase).Error; err != nil {
+			return err
+		}
+		if err := models.RecordCaseRevision(tx, correspondingCase.ID, models.CaseCreated, c.Get("id").(uint), "Registration"); err != nil {
+			return err
+		}
 
 		schedule.Current = schedule.Current + 1
-		if err := db.Save(&schedule).Error; err != nil {
-			c.Logger().Error(models.InvalidSchedule)
+		if err := tx.Save(&schedule).Error; err != nil {
+			c.Logger().Error(api.InvalidSchedule)
 			return err
 		}
 
@@ -281,9 +295,9 @@ func (h *ProcessHandler) CreateRegistrationTX(c echo.Context) error {
 		var patientAccount models.Account
 		var doctor models.Doctor
 		var doctorAccount models.Account
-		db.First(&patientAccount, patient.AccountID)
-		db.First(&doctor, registration.DoctorID)
-		db.First(&doctorAccount, doctor.AccountID)
+		tx.First(&patientAccount, patient.AccountID)
+		tx.First(&doctor, registration.DoctorID)
+		tx.First(&doctorAccount, doctor.AccountID)
 
 		res = int(registration.ID)
 
@@ -292,7 +306,7 @@ func (h *ProcessHandler) CreateRegistrationTX(c echo.Context) error {
 
 	if err != nil {
 		c.Logger().Debug("JSON format failed when trying to create a registration ...")
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.CreateRegistrationFailed))
+		return api.Fail(c, api.RegistrationFailed, nil)
 	}
 
 	return c.JSON(http.StatusOK, api.Return("ok", res))
@@ -301,7 +315,8 @@ func (h *ProcessHandler) CreateRegistrationTX(c echo.Context) error {
 // GetRegistrations
 // @Summary get all registrations
 // @Tags Process
-// @Description display all registrations
+// @Description display all registrations; patients see those of every profile they act for
+// @Param patient_id query uint false "only those of this patient profile"
 // @Produce json
 // @Success 200 {object} api.ReturnedData{data=[]models.RegistrationJSON}
 // @Router /registrations [GET]
@@ -309,30 +324,23 @@ func (h *ProcessHandler) GetRegistrations(c echo.Context) error {
 	db := utils.GetDB()
 	var registrations []models.Registration
 
-	// get account type
-	var acc models.Account
-	err := db.First(&acc, c.Get("id")).Error
-	if err != nil {
-		return c.JSON(http.StatusUnauthorized, api.Return("error", nil))
-	}
+	// account type and role IDs come from the token claims
+	accountType := c.Get("type")
 
-	if acc.Type == models.PatientType {
-		// get patient
-		var patient models.Patient
-		err := db.Where("account_id = ?", c.Get("id").(uint)).First(&patient).Error
-		if err != nil {
-			return c.JSON(http.StatusBadRequest, api.Return("error", models.PatientNotFound))
-		}
-
-		db.Where("patient_id = ?", patient.ID).Find(&registrations)
-	} else if acc.Type == models.DoctorType {
-		// get doctor
-		var doctor models.Doctor
-		err := db.Where("account_id = ?", c.Get("id").(uint)).First(&doctor).Error
-		if err != nil {
-			return c.JSON(http.StatusBadRequest, api.Return("error", models.DoctorNotFound))
+	if accountType == models.PatientType {
+		patientIDs := account.PatientIDs(db, c.Get("id").(uint))
+		if p := c.QueryParam("patient_id"); p != "" {
+			var patient models.Patient
+			if err := db.First(&patient, p).Error; err != nil {
+				return api.Fail(c, api.PatientNotFound, nil)
+			}
+			if !account.ActsFor(db, c.Get("id").(uint), &patient) {
+				return api.Fail(c, api.PermissionDenied, nil)
+			}
+			patientIDs = []uint{patient.ID}
 		}
-
+		db.Where("patient_id IN ?", patientIDs).Find(&registrations)
+	} else if accountType == models.DoctorType {
 		year, month, day := time.Now().Date()
 		hours, _, _ := time.Now().Clock()
 		halfday := models.Morning
@@ -341,9 +349,9 @@ func (h *ProcessHandler) GetRegistrations(c echo.Context) error {
 			halfday = models.Afternoon
 		}
 		db.Where("doctor_id = ? AND status <> ? AND year = ? AND month = ? AND day = ? AND half_day = ?",
-			doctor.ID, models.Terminated, year, int(month), day, halfday).Find(&registrations)
+			c.Get("doctorID").(uint), models.Terminated, year, int(month), day, halfday).Find(&registrations)
 	} else {
-		return c.JSON(http.StatusUnauthorized, api.Return("error", nil))
+		return api.Fail(c, api.PermissionDenied, nil)
 	}
 
 	var registrationJSONs = make([]models.RegistrationJSON, len(registrations))
@@ -384,32 +392,23 @@ func (h *ProcessHandler) GetRegistrationByID(c echo.Context) error {
 	db := utils.GetDB()
 	var registration models.Registration
 
-	// get account type
-	var acc models.Account
-	err := db.First(&acc, c.Get("id")).Error
-	if err != nil {
-		return c.JSON(http.StatusUnauthorized, api.Return("error", nil))
-	}
+	// account type and role IDs come from the token claims
+	accountType := c.Get("type")
 
 	var doctorID uint
 	var doctorName string
 	var patientName string
 
 	// judge account type
-	if acc.Type == models.PatientType {
-		// get patient
-		var patient models.Patient
-		err := db.Where("account_id = ?", c.Get("id").(uint)).First(&patient).Error
+	if accountType == models.PatientType {
+		err := db.Where("patient_id IN ?", account.PatientIDs(db, c.Get("id").(uint))).First(&registration, c.Param("registrationID")).Error
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, api.Return("error", models.PatientNotFound))
-		}
-
-		err = db.Where("patient_id = ?", patient.ID).First(&registration, c.Param("registrationID")).Error
-		if err != nil {
-			return c.JSON(http.StatusBadRequest, api.Return("error", models.RegistrationNotFound))
+			return api.Fail(c, api.RegistrationNotFound, nil)
 		}
 
+		var patient models.Patient
 		var patientAccount models.Account
+		db.First(&patient, registration.PatientID)
 		db.First(&patientAccount, patient.AccountID)
 		patientName = patientAccount.LastName + patientAccount.FirstName
 
@@ -420,21 +419,14 @@ func (h *ProcessHandler) GetRegistrationByID(c echo.Context) error {
 
 		doctorID = doctor.AccountID
 		doctorName = doctorAccount.LastName + doctorAccount.FirstName
-	} else if acc.Type == models.DoctorType {
-		// get doctor
-		var doctor models.Doctor
-		err := db.Where("account_id = ?", c.Get("id").(uint)).First(&doctor).Error
-		if err != nil {
-			return c.JSON(http.StatusBadRequest, api.Return("error", models.DoctorNotFound))
-		}
-
-		err = db.Where("doctor_id = ?", doctor.ID).First(&registration, c.Param("registrationID")).Error
+	} else if accountType == models.DoctorType {
+		err := db.Where("doctor_id = ?", c.Get("doctorID").(uint)).First(&registration, c.Param("registrationID")).Error
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, api.Return("error", models.RegistrationNotFound))
+			return api.Fail(c, api.RegistrationNotFound, nil)
 		}
 
 		var doctorAccount models.Account
-		db.First(&doctorAccount, doctor.AccountID)
+		db.First(&doctorAccount, c.Get("id").(uint))
 		doctorName = doctorAccount.LastName + doctorAccount.FirstName
 
 		var patient models.Patient
@@ -444,7 +436,7 @@ func (h *ProcessHandler) GetRegistrationByID(c echo.Context) error {
 		db.First(&patientAccount, patient.AccountID)
 		patientName = patientAccount.LastName + patientAccount.FirstName
 	} else {
-		return c.JSON(http.StatusUnauthorized, api.Return("error", nil))
+		return api.Fail(c, api.PermissionDenied, nil)
 	}
 
 	// get names
@@ -495,7 +487,7 @@ func (h *ProcessHandler) UpdateRegistrationStatus(c echo.Context) error {
 	var submit RegistrationSubmitJSON
 	if err := c.Bind(&submit); err != nil {
 		c.Logger().Debug("JSON format failed when trying to create a registration ...")
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.InvalidSubmitFormat))
+		return api.Fail(c, api.InvalidRequest, nil)
 	}
 
 	db := utils.GetDB()
@@ -505,32 +497,35 @@ func (h *ProcessHandler) UpdateRegistrationStatus(c echo.Context) error {
 	var registration models.Registration
 	err := db.First(&registration, c.Param("registrationID")).Error
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", err.Error()))
+		return api.Fail(c, api.RegistrationNotFound, nil)
 	}
 	currentStatus := registration.Status
-	var acc models.Account
-	err = db.Where("id = ?", c.Get("id").(uint)).First(&acc).Error
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.AccountNotFound))
+	accountType := c.Get("type")
+	if accountType == models.PatientType {
+		var patient models.Patient
+		db.First(&patient, registration.PatientID)
+		if !account.ActsFor(db, c.Get("id").(uint), &patient) {
+			return api.Fail(c, api.PermissionDenied, nil)
+		}
 	}
 	if currentStatus == models.Committed {
-		if acc.Type == models.PatientType {
+		if accountType == models.PatientType {
 			if status == models.Terminated {
 				registration.Status = status
 				db.Save(&registration)
 				return c.JSON(http.StatusOK, api.Return("ok", "修改挂号成功"))
 			}
 		}
-		if acc.Type == models.DoctorType {
+		if accountType == models.DoctorType {
 			if status == models.Accepted {
 				registration.Status = status
 
 				// to start a new chat
 				var patient models.Patient
 				db.First(&patient, registration.PatientID)
-				err = chat.StartNewChat(acc.ID, patient.AccountID, c)
+				err = chat.StartNewChat(c.Get("id").(uint), patient.AccountID, c)
 				if err != nil {
-					return c.JSON(http.StatusInternalServerError, api.Return("error", "无法启动会话，请重试"))
+					return api.Fail(c, api.ChatStartFailed, nil)
 				}
 
 				db.Save(&registration)
@@ -543,12 +538,12 @@ func (h *ProcessHandler) UpdateRegistrationStatus(c echo.Context) error {
 					db.Save(&registration)
 					return c.JSON(http.StatusOK, api.Return("ok", "修改挂号成功"))
 				}
-				return c.JSON(http.StatusBadRequest, api.Return("error", "Missing terminated causes"))
+				return api.Fail(c, api.TerminatedCauseRequired, nil)
 			}
 		}
 	}
 	if currentStatus == models.Accepted {
-		if acc.Type == models.DoctorType {
+		if accountType == models.DoctorType {
 			if status == models.Terminated {
 				if terminatedCause != "" {
 					registration.Status = status
@@ -556,11 +551,11 @@ func (h *ProcessHandler) UpdateRegistrationStatus(c echo.Context) error {
 					db.Save(&registration)
 					return c.JSON(http.StatusOK, api.Return("ok", "修改挂号成功"))
 				}
-				return c.JSON(http.StatusBadRequest, api.Return("error", "Missing terminated causes"))
+				return api.Fail(c, api.TerminatedCauseRequired, nil)
 			}
 		}
 	}
-	return c.JSON(http.StatusBadRequest, api.Return("error", models.RegistrationUpdateFailed))
+	return api.Fail(c, api.RegistrationUpdateFailed, nil)
 }
 
 // CreateMileStoneByDoctor
@@ -582,24 +577,17 @@ func (h *ProcessHandler) CreateMileStoneByDoctor(c echo.Context) error {
 	var submit MileStoneSubmitJSON
 	if err := c.Bind(&submit); err != nil {
 		c.Logger().Debug("JSON format failed when trying to create a registration ...")
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.InvalidSubmitFormat))
+		return api.Fail(c, api.InvalidRequest, nil)
 	}
 
 	db := utils.GetDB()
 
-	// get doctor
-	var doctor models.Doctor
-	err := db.Where("account_id = ?", c.Get("id").(uint)).First(&doctor).Error
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.DoctorNotFound))
-	}
-
 	var registration models.Registration
-	err = db.First(&registration, submit.RegistrationID).Error
+	err := db.First(&registration, submit.RegistrationID).Error
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.RegistrationNotFound))
+		return api.Fail(c, api.RegistrationNotFound, nil)
 	} else if registration.Status == models.Terminated {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.MileStoneUnauthorized))
+		return api.Fail(c, api.PermissionDenied, nil)
 	}
 
 	mileStone := models.MileStone{
@@ -609,7 +597,7 @@ func (h *ProcessHandler) CreateMileStoneByDoctor(c echo.Context) error {
 
 	err = db.Create(&mileStone).Error
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.CreateMileStoneFailed))
+		return api.Fail(c, api.MileStoneFailed, nil)
 	}
 
 	return c.JSON(http.StatusOK, api.Return("ok", mileStone.ID))
@@ -634,32 +622,28 @@ func (h *ProcessHandler) UpdateMileStoneByDoctor(c echo.Context) error {
 	var submit MileStoneSubmitJSON
 	if err := c.Bind(&submit); err != nil {
 		c.Logger().Debug("JSON format failed when trying to create a registration ...")
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.InvalidSubmitFormat))
+		return api.Fail(c, api.InvalidRequest, nil)
 	}
 
 	db := utils.GetDB()
-	// get doctor
-	var doctor models.Doctor
-	err := db.Where("account_id = ?", c.Get("id").(uint)).First(&doctor).Error
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.DoctorNotFound))
-	}
+	// the doctor comes from the token claims
+	doctorID := c.Get("doctorID").(uint)
 
 	// get mileStone
 	var mileStone models.MileStone
-	err = db.First(&mileStone, c.Param("mileStoneID")).Error
+	err := db.First(&mileStone, c.Param("mileStoneID")).Error
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.MileStoneNotFound))
+		return api.Fail(c, api.MileStoneNotFound, nil)
 	}
 	var registration models.Registration
 	err = db.First(&registration, mileStone.RegistrationID).Error
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.RegistrationNotFound))
+		return api.Fail(c, api.RegistrationNotFound, nil)
 	}
 
 	// check milestone authority
-	if registration.Status == models.Terminated || registration.DoctorID != doctor.ID {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.MileStoneUnauthorized))
+	if registration.Status == models.Terminated || registration.DoctorID != doctorID {
+		return api.Fail(c, api.PermissionDenied, nil)
 	}
 
 	mileStone.Checked = submit.Checked
@@ -680,28 +664,24 @@ func (h *ProcessHandler) UpdateMileStoneByDoctor(c echo.Context) error {
 func (h *ProcessHandler) DeleteMileStoneByDoctor(c echo.Context) error {
 	db := utils.GetDB()
 
-	// get doctor
-	var doctor models.Doctor
-	err := db.Where("account_id = ?", c.Get("id").(uint)).First(&doctor).Error
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.DoctorNotFound))
-	}
+	// the doctor comes from the token claims
+	doctorID := c.Get("doctorID").(uint)
 
 	// get mileStone
 	var mileStone models.MileStone
-	err = db.First(&mileStone, c.Param("mileStoneID")).Error
+	err := db.First(&mileStone, c.Param("mileStoneID")).Error
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.MileStoneNotFound))
+		return api.Fail(c, api.MileStoneNotFound, nil)
 	}
 	var registration models.Registration
 	err = db.First(&registration, mileStone.RegistrationID).Error
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.RegistrationNotFound))
+		return api.Fail(c, api.RegistrationNotFound, nil)
 	}
 
 	// check milestone authority
-	if registration.Status == models.Terminated || registration.DoctorID != doctor.ID {
-		return c.JSON(http.StatusBadRequest, api.Return("error", models.MileStoneUnauthorized))
+	if registration.Status == models.Terminated || registration.DoctorID != doctorID {
+		return api.Fail(c, api.PermissionDenied, nil)
 	}
 
 	db.Delete(&mileStone)
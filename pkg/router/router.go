@@ -6,6 +6,7 @@ import (
 	"github.com/AsterNighT/software-engineering-backend/pkg/account"
 	"github.com/AsterNighT/software-engineering-backend/pkg/cases"
 	"github.com/AsterNighT/software-engineering-backend/pkg/chat"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
 	"github.com/AsterNighT/software-engineering-backend/pkg/process"
 
 	"github.com/AsterNighT/software-engineering-backend/api"
@@ -39,40 +40,141 @@ func RegisterRouters(app *echo.Echo) error {
 	{
 		router := app.Group("/api")
 		router.GET("/ping", h.Ping)
+		{
+			var h account.AccountHandler
+			router.GET("/doctors", h.ListDoctorDirectory)
+			router.GET("/.well-known/jwks.json", h.JWKS)
+		}
 		{
 			// Use nested scopes and shadowing for subgroups
 			var h account.AccountHandler
 			router := router.Group("/account")
 			router.POST("/create", h.CreateAccount)
-			router.POST("/setdoctor", h.SetDoctor, account.CheckAccountID)
-			router.POST("/setpatient", h.SetPatient, account.CheckAccountID)
+			router.POST("/setdoctor", h.SetDoctor, account.CheckAccountID, account.RequireRole(models.DoctorType))
+			router.POST("/setpatient", h.SetPatient, account.CheckAccountID, account.RequireRole(models.PatientType))
 			router.POST("/checkemail", h.CheckEmail)
 			router.POST("/login", h.LoginAccount)
+			router.POST("/login/totp", h.LoginTOTP)
+			router.GET("/oidc/login", h.OIDCLogin)
+			router.POST("/oidc/callback", h.OIDCCallback)
+			router.POST("/refresh", h.RefreshToken)
+			router.POST("/logout", h.Logout, account.CheckAccountID)
+			router.POST("/logoutall", h.LogoutAll, account.CheckAccountID)
+			router.GET("/sessions", h.ListSessions, account.CheckAccountID)
+			router.DELETE("/sessions/:sessionID", h.RevokeSession, account.CheckAccountID)
 			router.POST("/modifypasswd", h.ModifyPasswd)
+			router.GET("/passwdpolicy", h.GetPasswdPolicy)
 			router.POST("/sendemail", h.SendEmail)
 			router.POST("/checkauthcode", h.CheckAuthCode)
 			router.POST("/resetpasswd", h.ResetPasswd)
+			router.POST("/acceptinvite", h.AcceptInvite)
+			router.POST("/verifyemail", h.VerifyEmail)
+			router.POST("/sendverification", h.SendVerification, account.CheckAccountID)
 			router.GET("/getinfo", h.GetInfo, account.CheckAccountID)
+			router.PUT("/profile", h.UpdateProfile, account.CheckAccountID)
+			router.POST("/confirmemail", h.ConfirmEmail, account.CheckAccountID)
+			router.GET("/export", h.ExportData, account.CheckAccountID, account.RequireRole(models.PatientType))
+			router.PUT("/doctor/license", h.SetLicense, account.CheckAccountID, account.RequireRole(models.DoctorType))
+			router.POST("/doctor/credentials", h.UploadCredential, account.CheckAccountID, account.RequireRole(models.DoctorType))
+			router.GET("/doctor/credentials", h.GetCredentials, account.CheckAccountID, account.RequireRole(models.DoctorType))
+			router.GET("/doctor/profile", h.GetDoctorProfile, account.CheckAccountID, account.RequireRole(models.DoctorType))
+			router.PUT("/doctor/profile", h.UpdateDoctorProfile, account.CheckAccountID, account.RequireRole(models.DoctorType))
+			router.GET("/profiles", h.ListProfiles, account.CheckAccountID, account.RequireRole(models.PatientType))
+			router.POST("/profiles", h.CreateProfile, account.CheckAccountID, account.RequireRole(models.PatientType))
+			router.PUT("/profiles/:patientID", h.UpdateManagedProfile, account.CheckAccountID, account.RequireRole(models.PatientType))
+			router.GET("/profiles/:patientID/delegates", h.ListDelegates, account.CheckAccountID, account.RequireRole(models.PatientType))
+			router.POST("/profiles/:patientID/delegates", h.AddDelegate, account.CheckAccountID, account.RequireRole(models.PatientType))
+			router.DELETE("/profiles/:patientID/delegates/:delegationID", h.RevokeDelegate, account.CheckAccountID, account.RequireRole(models.PatientType))
+			router.POST("/erasure", h.RequestErasure, account.CheckAccountID, account.RequireRole(models.PatientType))
+			router.GET("/erasure", h.GetErasureRequests, account.CheckAccountID, account.RequireRole(models.PatientType))
+			router.POST("/totp/enroll", h.EnrollTOTP, account.CheckAccountID)
+			router.POST("/totp/confirm", h.ConfirmTOTP, account.CheckAccountID)
+			router.POST("/totp/disable", h.DisableTOTP, account.CheckAccountID)
+			router.POST("/totp/recoverycodes", h.RegenerateRecoveryCodes, account.CheckAccountID)
 			router.GET("/getinfobypatid/:patientID", h.GetInfoByPatID)
 		}
 		router = app.Group("/api")
 		router.Use(account.CheckAccountID)
+		{
+			var h account.AdminHandler
+			router := router.Group("/admin", account.RequireRole(models.AdminType))
+			router.GET("/accounts", h.ListAccounts)
+			router.POST("/accounts/import", h.ImportAccounts)
+			router.GET("/accounts/:accountID", h.GetAccount)
+			router.PUT("/accounts/:accountID/disable", h.DisableAccount)
+			router.PUT("/accounts/:accountID/enable", h.EnableAccount)
+			router.PUT("/accounts/:accountID/type", h.ChangeAccountType)
+			router.DELETE("/accounts/:accountID", h.DeleteAccount)
+			router.PUT("/accounts/:accountID/unlock", h.UnlockAccount)
+			router.PUT("/accounts/:accountID/verify", h.VerifyAccount)
+			router.POST("/accounts/:accountID/sendverification", h.SendVerification)
+			router.POST("/accounts/:accountID/invite", h.SendInvite)
+			router.PUT("/accounts/:accountID/totp/reset", h.ResetTOTP)
+			router.GET("/lockouts", h.ListLockouts)
+			router.GET("/accounts/:accountID/export", h.ExportData)
+			router.GET("/erasures", h.ListErasureRequests)
+			router.PUT("/erasures/:requestID/approve", h.ApproveErasure)
+			router.PUT("/erasures/:requestID/reject", h.RejectErasure)
+			router.GET("/doctors", h.ListDoctors)
+			router.GET("/doctors/:doctorID/credentials/:credentialID", h.GetCredentialFile)
+			router.PUT("/doctors/:doctorID/approve", h.ApproveDoctor)
+			router.PUT("/doctors/:doctorID/reject", h.RejectDoctor)
+			router.POST("/serviceaccounts", h.CreateServiceAccount)
+			router.GET("/serviceaccounts", h.ListServiceAccounts)
+			router.PUT("/serviceaccounts/:serviceAccountID/disable", h.DisableServiceAccount)
+			router.PUT("/serviceaccounts/:serviceAccountID/enable", h.EnableServiceAccount)
+			router.POST("/serviceaccounts/:serviceAccountID/keys", h.CreateAPIKey)
+			router.DELETE("/serviceaccounts/:serviceAccountID/keys/:keyID", h.RevokeAPIKey)
+			router.GET("/patients/duplicates", h.ListDuplicatePatients)
+			router.POST("/patients/:patientID/merge", h.MergePatients)
+			router.GET("/profilechanges", h.ListProfileChanges)
+			router.PUT("/profilechanges/:changeID/approve", h.ApproveProfileChange)
+			router.PUT("/profilechanges/:changeID/reject", h.RejectProfileChange)
+		}
 		{
 			var h cases.CaseHandler
-			router.GET("/cases", h.GetAllCases)
-			router := router.Group("/patient")
+			// Doctors waiting for credential review are kept out of every case
+			router.GET("/cases", h.GetAllCases, account.RequireRole(models.DoctorType, models.AdminType), account.RequireApproved)
+			// Everyone may search, patients only find the cases they may read
+			router.GET("/cases/search", h.SearchCases, account.RequireApproved)
+			{
+				// Deleted records are only seen by admins
+				router := router.Group("/admin", account.RequireRole(models.AdminType))
+				router.GET("/cases/deleted", h.ListDeletedCases)
+				router.PUT("/cases/:caseID/restore", h.RestoreCase)
+				router.DELETE("/cases/:caseID/purge", h.PurgeCase)
+				router.GET("/prescriptions/deleted", h.ListDeletedPrescriptions)
+				router.PUT("/prescriptions/:prescriptionID/restore", h.RestorePrescription)
+				router.DELETE("/prescriptions/:prescriptionID/purge", h.PurgePrescription)
+			}
+			router := router.Group("/patient", account.RequireApproved)
+			// Patients may read their own cases, handlers check the ownership
 			router.GET("/:patientID/case", h.GetLastCaseByPatientID)
-			router.POST("/:patientID/case", h.NewCase)
 			router.GET("/:patientID/cases", h.GetCasesByPatientID)
 			router.GET("/:patientID/case/:caseID", h.GetPreviousCases)
 			router.GET("/:patientID/cases/:caseID", h.GetCaseByCaseID)
-			router.PUT("/:patientID/case/:caseID", h.UpdateCase)
-			router.DELETE("/:patientID/case/:caseID", h.DeleteCaseByCaseID)
 			router.GET("/:patientID/case/:caseID/prescription", h.GetPrescriptionByCaseID)
-			router.POST("/:patientID/case/:caseID/prescription", h.NewPrescription)
 			router.GET("/:patientID/case/:caseID/prescription/:prescriptionID", h.GetPrescriptionByPrescriptionID)
-			router.PUT("/:patientID/case/:caseID/prescription/:prescriptionID", h.UpdatePrescription)
-			router.DELETE("/:patientID/case/:caseID/prescription/:prescriptionID", h.DeletePrescription)
+			router.GET("/:patientID/case/:caseID/prescription/:prescriptionID/overrides", h.GetSafetyOverrides)
+			router.GET("/:patientID/case/:caseID/revisions", h.GetCaseRevisions)
+			router.GET("/:patientID/case/:caseID/revisions/diff", h.DiffCaseRevisions)
+			router.GET("/:patientID/case/:caseID/revisions/:number", h.GetCaseRevision)
+			router.GET("/:patientID/allergies", h.GetAllergies)
+			router.GET("/:patientID/allergies/history", h.GetAllergyHistory)
+			{
+				// Only doctors may write them
+				router := router.Group("", account.RequireRole(models.DoctorType, models.AdminType))
+				router.POST("/:patientID/case", h.NewCase)
+				router.PUT("/:patientID/case/:caseID", h.UpdateCase)
+				router.DELETE("/:patientID/case/:caseID", h.DeleteCaseByCaseID)
+				router.POST("/:patientID/case/:caseID/prescription", h.NewPrescription)
+				router.POST("/:patientID/case/:caseID/prescription/check", h.CheckPrescription)
+				router.PUT("/:patientID/case/:caseID/prescription/:prescriptionID", h.UpdatePrescription)
+				router.DELETE("/:patientID/case/:caseID/prescription/:prescriptionID", h.DeletePrescription)
+				router.POST("/:patientID/allergies", h.NewAllergy)
+				router.PUT("/:patientID/allergies/:allergyID", h.UpdateAllergy)
+				router.DELETE("/:patientID/allergies/:allergyID", h.DeleteAllergy)
+			}
 		}
 		{
 			var h cases.MedicineHandler
@@ -82,8 +184,8 @@ func RegisterRouters(app *echo.Echo) error {
 			// Use nested scopes and shadowing for subgroups
 			var h chat.ChatHandler
 			routerPatient := router.Group("/patient")
-			routerPatient.GET("/:patientID/chat", h.NewPatientConn)
-			routerDoctor := router.Group("/doctor")
+			routerPatient.GET("/:patientID/chat", h.NewPatientConn, account.RequireRole(models.PatientType), account.RequirePatientAccount("patientID"))
+			routerDoctor := router.Group("/doctor", account.RequireRole(models.DoctorType), account.RequireApproved)
 			routerDoctor.GET("/:doctorID/chat", h.NewDoctorConn)
 		}
 
@@ -95,15 +197,19 @@ func RegisterRouters(app *echo.Echo) error {
 			// Use nested scopes and shadowing for subgroups
 			// G4-Process's router
 			var h process.ProcessHandler
+			patientOnly := account.RequireRole(models.PatientType)
+			doctorOnly := account.RequireRole(models.DoctorType)
+			patientOrDoctor := account.RequireRole(models.PatientType, models.DoctorType)
+			approved := account.RequireApproved
 			router.GET("/departments", h.GetAllDepartments)
 			router.GET("/department/:departmentID", h.GetDepartmentByID)
-			router.POST("/registrations", h.CreateRegistrationTX)
-			router.GET("/registrations", h.GetRegistrations)
-			router.GET("/registration/:registrationID", h.GetRegistrationByID)
-			router.PUT("/registration/:registrationID", h.UpdateRegistrationStatus)
-			router.POST("/milestones", h.CreateMileStoneByDoctor)
-			router.PUT("/milestone/:mileStoneID", h.UpdateMileStoneByDoctor)
-			router.DELETE("/milestone/:mileStoneID", h.DeleteMileStoneByDoctor)
+			router.POST("/registrations", h.CreateRegistrationTX, patientOnly, account.RequireVerified)
+			router.GET("/registrations", h.GetRegistrations, patientOrDoctor, approved)
+			router.GET("/registration/:registrationID", h.GetRegistrationByID, patientOrDoctor, approved)
+			router.PUT("/registration/:registrationID", h.UpdateRegistrationStatus, patientOrDoctor, approved)
+			router.POST("/milestones", h.CreateMileStoneByDoctor, doctorOnly, approved)
+			router.PUT("/milestone/:mileStoneID", h.UpdateMileStoneByDoctor, doctorOnly, approved)
+			router.DELETE("/milestone/:mileStoneID", h.DeleteMileStoneByDoctor, doctorOnly, approved)
 			router.GET("/search/:keyWord", h.Search)
 		}
 	}
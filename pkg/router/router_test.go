@@ -3,10 +3,15 @@ package router
 import (
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 
+	"github.com/AsterNighT/software-engineering-backend/api"
+	"github.com/AsterNighT/software-engineering-backend/pkg/database/models"
+	"github.com/AsterNighT/software-engineering-backend/pkg/keyring"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPing(t *testing.T) {
@@ -22,3 +27,48 @@ func TestPing(t *testing.T) {
 		assert.Equal(t, "{\"status\":\"pong\"}\n", rec.Body.String())
 	}
 }
+
+func TestTOTPRequiredOnReadRoutes(t *testing.T) {
+	os.Setenv("TOTP_REQUIRED_ROLES", "doctor")
+	defer os.Unsetenv("TOTP_REQUIRED_ROLES")
+	ring, err := keyring.New(nil, nil, []byte("secret"))
+	require.NoError(t, err)
+	keyring.Set(ring)
+	defer keyring.Set(nil)
+
+	e := echo.New()
+	require.NoError(t, RegisterRouters(e))
+	token, err := keyring.Sign(models.TokenClaims{AccountID: 1, Type: models.DoctorType, Approved: true, MFA: false})
+	require.NoError(t, err)
+
+	// Read routes only guarded by RequireApproved as well as role guarded ones
+	for _, path := range []string{"/api/patient/2/cases", "/api/cases/search?q=pneumonia", "/api/cases"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code, path)
+		assert.Contains(t, rec.Body.String(), string(api.TOTPRequired), path)
+	}
+}
+
+func TestAPIKeysCannotWriteCases(t *testing.T) {
+	e := echo.New()
+	require.NoError(t, RegisterRouters(e))
+
+	// Refused by route before the key is even looked up, whatever its scopes
+	for _, route := range []struct{ method, path string }{
+		{http.MethodPost, "/api/patient/2/case"},
+		{http.MethodPut, "/api/patient/2/case/3"},
+		{http.MethodDelete, "/api/patient/2/case/3"},
+		{http.MethodPost, "/api/patient/2/case/3/prescription"},
+		{http.MethodPut, "/api/patient/2/case/3/prescription/4"},
+	} {
+		req := httptest.NewRequest(route.method, route.path, nil)
+		req.Header.Set("X-API-Key", "abcdef.readscopedkey")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code, route.path)
+		assert.Contains(t, rec.Body.String(), string(api.APIKeyNotAllowed), route.path)
+	}
+}
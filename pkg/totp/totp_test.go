@@ -0,0 +1,59 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test vectors of RFC 6238 appendix B for SHA1.
+func TestHOTPVectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	for unix, want := range map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	} {
+		assert.Equal(t, want, hotp(key, uint64(unix/Period), 8), unix)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+
+	code, err := Code(secret, Step(now))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "081804", code)
+	}
+
+	// One step of drift is tolerated, two are not
+	previous, _ := Code(secret, Step(now)-1)
+	step, ok := Validate(secret, previous, now, 1)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now)-1, step)
+	older, _ := Code(secret, Step(now)-2)
+	_, ok = Validate(secret, older, now, 1)
+	assert.False(t, ok)
+
+	_, ok = Validate(secret, "000000", now, 1)
+	assert.False(t, ok)
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if assert.NoError(t, err) {
+		assert.Len(t, secret, 32)
+		_, err = Code(secret, 0)
+		assert.NoError(t, err)
+	}
+	uri := URI("MediConnect", "a@a.com", secret)
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/MediConnect:a@a.com?"))
+	assert.Contains(t, uri, "secret="+secret)
+}
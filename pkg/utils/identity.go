@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+var insuranceNumberPattern = regexp.MustCompile(`^[0-9A-Z]{8,20}$`)
+
+// NormalizeIdentifier trims an identifier and upper-cases it, so that 'x' and 'X' check digits compare equal.
+func NormalizeIdentifier(id string) string {
+	return strings.ToUpper(strings.TrimSpace(id))
+}
+
+// ValidNationalID checks an 18-digit resident identity number (GB 11643-1999):
+// its birth date and its ISO 7064 MOD 11-2 check digit. id must be normalized.
+func ValidNationalID(id string) bool {
+	if len(id) != 18 {
+		return false
+	}
+	weights := [17]int{7, 9, 10, 5, 8, 4, 2, 1, 6, 3, 7, 9, 10, 5, 8, 4, 2}
+	sum := 0
+	for i, w := range weights {
+		if id[i] < '0' || id[i] > '9' {
+			return false
+		}
+		sum += int(id[i]-'0') * w
+	}
+	if "10X98765432"[sum%11] != id[17] {
+		return false
+	}
+	_, ok := NationalIDBirthday(id)
+	return ok
+}
+
+// NationalIDBirthday is the birth date encoded in a national ID.
+func NationalIDBirthday(id string) (time.Time, bool) {
+	if len(id) != 18 {
+		return time.Time{}, false
+	}
+	birthday, err := time.Parse("20060102", id[6:14])
+	if err != nil || birthday.After(time.Now()) {
+		return time.Time{}, false
+	}
+	return birthday, true
+}
+
+// ValidInsuranceNumber checks the shape of a medical insurance number: 8 to 20 digits or capital letters.
+// Numbers differ between regions, many are the holder's national ID. n must be normalized.
+func ValidInsuranceNumber(n string) bool {
+	return insuranceNumberPattern.MatchString(n)
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidNationalID(t *testing.T) {
+	assert.True(t, ValidNationalID("11010519491231002X"))
+	assert.True(t, ValidNationalID(NormalizeIdentifier(" 11010519491231002x ")))
+	assert.True(t, ValidNationalID("440524188001010014"))
+
+	assert.False(t, ValidNationalID("110105194912310021"), "check digit")
+	assert.False(t, ValidNationalID("11010519491331002X"), "month 13")
+	assert.False(t, ValidNationalID("11010519491231002"), "length")
+	assert.False(t, ValidNationalID("1101051949123100AX"), "letters")
+
+	birthday, ok := NationalIDBirthday("11010519491231002X")
+	assert.True(t, ok)
+	assert.Equal(t, "1949-12-31", birthday.Format("2006-01-02"))
+}
+
+func TestValidInsuranceNumber(t *testing.T) {
+	assert.True(t, ValidInsuranceNumber("11010519491231002X"))
+	assert.True(t, ValidInsuranceNumber("ZJ12345678"))
+	assert.False(t, ValidInsuranceNumber("zj12345678"))
+	assert.False(t, ValidInsuranceNumber("ZJ-1234567"))
+	assert.False(t, ValidInsuranceNumber("1234567"))
+}
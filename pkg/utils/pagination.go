@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Pagination reads the page and size query parameters: page from 1, size at most 100, 20 by default.
+func Pagination(c echo.Context) (page int, size int) {
+	page, _ = strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+	size, _ = strconv.Atoi(c.QueryParam("size"))
+	if size < 1 || size > 100 {
+		size = 20
+	}
+	return page, size
+}
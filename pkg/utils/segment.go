@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Segment splits text into the tokens indexed for full-text search.
+// Runs of letters and digits are lower-cased words. PostgreSQL does not segment Chinese,
+// so runs of CJK characters become their overlapping bigrams, "肺炎患者" is "肺炎 炎患 患者",
+// and a lone character stays a unigram. Anything else separates tokens.
+func Segment(text string) []string {
+	var tokens []string
+	var word, cjk []rune
+	flush := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+		if len(cjk) == 1 {
+			tokens = append(tokens, string(cjk))
+		}
+		for i := 0; i+1 < len(cjk); i++ {
+			tokens = append(tokens, string(cjk[i:i+2]))
+		}
+		cjk = cjk[:0]
+	}
+	for _, r := range text {
+		switch {
+		case IsCJK(r):
+			if len(word) > 0 {
+				flush()
+			}
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if len(cjk) > 0 {
+				flush()
+			}
+			word = append(word, unicode.ToLower(r))
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// SearchQuery turns what a user typed into a tsquery over Segment tokens, "" if nothing is searchable.
+// Every space-separated term must match, the tokens of a term next to each other.
+// The last word of a term also matches longer words, and a single CJK character any bigram it starts.
+func SearchQuery(q string) string {
+	var terms []string
+	for _, term := range strings.Fields(q) {
+		tokens := Segment(term)
+		if len(tokens) == 0 {
+			continue
+		}
+		last := []rune(tokens[len(tokens)-1])
+		if !IsCJK(last[0]) || len(last) == 1 {
+			tokens[len(tokens)-1] += ":*"
+		}
+		terms = append(terms, "("+strings.Join(tokens, " <-> ")+")")
+	}
+	return strings.Join(terms, " & ")
+}
+
+// IsCJK is true for the characters Segment splits into bigrams.
+func IsCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegment(t *testing.T) {
+	assert.Equal(t, []string{"肺炎", "炎患", "患者", "copd", "2", "级"}, Segment("肺炎患者, COPD-2级"))
+	assert.Equal(t, []string{"咳"}, Segment("咳"))
+	assert.Empty(t, Segment(" ,。"))
+}
+
+func TestSearchQuery(t *testing.T) {
+	assert.Equal(t, "(肺炎 <-> 炎患 <-> 患者) & (pneumonia:*)", SearchQuery("肺炎患者  Pneumonia"))
+	assert.Equal(t, "(肺:*) & (covid <-> 19:*)", SearchQuery("肺 covid-19"))
+	assert.Equal(t, "", SearchQuery(" ; "))
+}